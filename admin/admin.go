@@ -0,0 +1,82 @@
+// Package admin serves the redirector's management API. It lives under a
+// secret path on the main listener, since Cloud Run exposes a single port,
+// and anything that fails authentication gets the decoy so the API can't
+// be told apart from any other refused request.
+package admin
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"google-redirector/clientip"
+	"google-redirector/config"
+	"google-redirector/filter"
+)
+
+// API routes ADMIN_PATH/<name> to the handlers registered with Handle.
+type API struct {
+	prefix   string
+	token    string
+	decoy    *filter.Decoy
+	handlers map[string]http.Handler
+}
+
+// New returns nil unless ADMIN_TOKEN is set. Requests must carry it as
+// "Authorization: Bearer <token>".
+func New(cfg *config.Config, decoy *filter.Decoy) (*API, error) {
+	token := cfg.String("ADMIN_TOKEN", "")
+	if token == "" {
+		return nil, nil
+	}
+	if len(token) < 16 {
+		return nil, fmt.Errorf("ADMIN_TOKEN must be at least 16 characters")
+	}
+	return &API{
+		prefix:   "/" + strings.Trim(cfg.String("ADMIN_PATH", "/_admin/"), "/") + "/",
+		token:    token,
+		decoy:    decoy,
+		handlers: make(map[string]http.Handler),
+	}, nil
+}
+
+func (a *API) String() string {
+	names := make([]string, 0, len(a.handlers))
+	for name := range a.handlers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return fmt.Sprintf("%s{%s}", a.prefix, strings.Join(names, ","))
+}
+
+// Handle serves h at ADMIN_PATH/name.
+func (a *API) Handle(name string, h http.Handler) {
+	a.handlers[name] = h
+}
+
+// Handles reports whether r is addressed to the admin API.
+func (a *API) Handles(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, a.prefix)
+}
+
+func (a *API) authorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) == 1
+}
+
+func (a *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !a.authorized(r) {
+		log.Printf("Rejected admin request from %s: bad or missing token", clientip.From(r))
+		a.decoy.Serve(w, r)
+		return
+	}
+	h, ok := a.handlers[strings.TrimPrefix(r.URL.Path, a.prefix)]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
@@ -0,0 +1,69 @@
+package admin
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google-redirector/config"
+	"google-redirector/filter"
+)
+
+const testToken = "0123456789abcdef"
+
+func newTestAPI(t *testing.T) *API {
+	t.Helper()
+	decoy, err := filter.NewDecoy(config.FromMap(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	api, err := New(config.FromMap(map[string]string{"ADMIN_TOKEN": testToken, "ADMIN_PATH": "/ops"}), decoy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	api.Handle("ping", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("pong"))
+	}))
+	return api
+}
+
+func TestAPI_Auth(t *testing.T) {
+	api := newTestAPI(t)
+	tests := []struct {
+		auth string
+		code int
+		body string
+	}{
+		{"", http.StatusBadGateway, "Bad Gateway"},
+		{"Bearer wrong-token-value", http.StatusBadGateway, "Bad Gateway"},
+		{testToken, http.StatusBadGateway, "Bad Gateway"},
+		{"Bearer " + testToken, http.StatusOK, "pong"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ops/ping", nil)
+		if tt.auth != "" {
+			r.Header.Set("Authorization", tt.auth)
+		}
+		if !api.Handles(r) {
+			t.Fatalf("Expected %s to be handled", r.URL.Path)
+		}
+		rec := httptest.NewRecorder()
+		api.ServeHTTP(rec, r)
+		if rec.Code != tt.code || rec.Body.String() != tt.body {
+			t.Errorf("%q: expected %d %q, got %d %q", tt.auth, tt.code, tt.body, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestAPI_Config(t *testing.T) {
+	if api, err := New(config.FromMap(nil), nil); api != nil || err != nil {
+		t.Errorf("Expected no admin API by default, got %v (%v)", api, err)
+	}
+	if _, err := New(config.FromMap(map[string]string{"ADMIN_TOKEN": "short"}), nil); err == nil {
+		t.Errorf("Expected a short token to be rejected")
+	}
+	api := newTestAPI(t)
+	if api.Handles(httptest.NewRequest("GET", "/opsx/ping", nil)) {
+		t.Errorf("Expected only paths under the prefix to be handled")
+	}
+}
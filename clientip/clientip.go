@@ -0,0 +1,49 @@
+// Package clientip works out which address a request really came from when
+// the redirector sits behind one or more proxies (like Cloud Run's front end).
+package clientip
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// TrustedHops is the number of proxies in front of the redirector that
+// append to X-Forwarded-For (1 on Cloud Run). Zero means RemoteAddr is the
+// client.
+var TrustedHops int
+
+// From returns the address of the client that connected to the first
+// trusted proxy. Entries to the left of that are client-supplied and ignored.
+func From(r *http.Request) string {
+	if TrustedHops > 0 {
+		var hops []string
+		for _, v := range r.Header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(v, ",")...)
+		}
+		if i := len(hops) - TrustedHops; i >= 0 && i < len(hops) {
+			if ip := strings.TrimSpace(hops[i]); ip != "" {
+				return ip
+			}
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+type key struct{}
+
+// With stores the client address in r's context so transports and other
+// code that only sees the outbound request can attribute it.
+func With(r *http.Request) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), key{}, From(r)))
+}
+
+func FromContext(ctx context.Context) string {
+	ip, _ := ctx.Value(key{}).(string)
+	return ip
+}
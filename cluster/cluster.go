@@ -0,0 +1,235 @@
+// Package cluster shares gating state between a fleet of redirectors, so a
+// client banned, a nonce used or an implant revoked at one node is treated
+// the same at every other. Nodes push batches of events to each other over
+// HTTPS through the admin API, which all of them must run with the same
+// ADMIN_TOKEN and ADMIN_PATH; there is no central store to deploy.
+// Bandwidth throttles stay per node, and one-time URLs are out of scope
+// since the redirector has no such feature.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google-redirector/config"
+)
+
+// Event is one change to shared state. Kind selects the subscriber, and the
+// other fields mean whatever that subscriber says they mean.
+type Event struct {
+	Kind    string `json:"kind"`
+	Key     string `json:"key"`
+	Value   string `json:"value,omitempty"`
+	Expires int64  `json:"expires,omitempty"` // Unix seconds
+	Deleted bool   `json:"deleted,omitempty"`
+}
+
+// Node sends local events to every peer and applies theirs. Events are
+// queued per peer and sent every CLUSTER_SYNC_INTERVAL, so state converges
+// within about that long; a peer that is down keeps its last
+// CLUSTER_QUEUE_SIZE events until it comes back. Peers are sent to in
+// parallel, one batch at a time each, so a slow peer delays only its own
+// events. Peers don't forward what they receive, so CLUSTER_PEERS must list
+// every other node.
+type Node struct {
+	peers     []string // cluster endpoint URLs
+	token     string
+	interval  time.Duration
+	queueSize int
+	client    *http.Client
+
+	mu       sync.Mutex
+	queues   map[string][]Event
+	sending  map[string]bool // peers with a batch in flight
+	failing  map[string]bool
+	handlers map[string]func(Event) error
+}
+
+// New returns nil unless CLUSTER_PEERS lists the base URLs of the other
+// nodes. ADMIN_TOKEN is required, since peers authenticate with it.
+func New(cfg *config.Config) (*Node, error) {
+	peers := cfg.List("CLUSTER_PEERS", "")
+	if len(peers) == 0 {
+		return nil, nil
+	}
+	n := &Node{
+		token:     cfg.String("ADMIN_TOKEN", ""),
+		interval:  cfg.Duration("CLUSTER_SYNC_INTERVAL", time.Second),
+		queueSize: cfg.Int("CLUSTER_QUEUE_SIZE", 10000),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		queues:    make(map[string][]Event),
+		sending:   make(map[string]bool),
+		failing:   make(map[string]bool),
+		handlers:  make(map[string]func(Event) error),
+	}
+	if n.token == "" {
+		return nil, fmt.Errorf("CLUSTER_PEERS needs ADMIN_TOKEN")
+	}
+	if n.interval <= 0 || n.queueSize <= 0 {
+		return nil, fmt.Errorf("CLUSTER_SYNC_INTERVAL and CLUSTER_QUEUE_SIZE must be positive")
+	}
+	path := "/" + strings.Trim(cfg.String("ADMIN_PATH", "/_admin/"), "/") + "/cluster"
+	for _, peer := range peers {
+		if !strings.HasPrefix(peer, "http://") && !strings.HasPrefix(peer, "https://") {
+			return nil, fmt.Errorf("invalid CLUSTER_PEERS entry %q (expected a base URL)", peer)
+		}
+		n.peers = append(n.peers, strings.TrimRight(peer, "/")+path)
+	}
+	return n, nil
+}
+
+func (n *Node) String() string {
+	return fmt.Sprintf("%d peers, sync every %v", len(n.peers), n.interval)
+}
+
+// Subscribe has fn apply every event of kind received from a peer. Events
+// applied this way are not published again. fn should ignore events it
+// can't make sense of, and return an error only when applying failed, in
+// which case the peer sends the whole batch again.
+func (n *Node) Subscribe(kind string, fn func(Event) error) {
+	n.mu.Lock()
+	n.handlers[kind] = fn
+	n.mu.Unlock()
+}
+
+// Publish queues e for every peer.
+func (n *Node) Publish(e Event) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, peer := range n.peers {
+		q := append(n.queues[peer], e)
+		if len(q) > n.queueSize {
+			q = q[len(q)-n.queueSize:]
+		}
+		n.queues[peer] = q
+	}
+}
+
+// Start sends the queued events every CLUSTER_SYNC_INTERVAL until ctx is
+// cancelled.
+func (n *Node) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(n.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				n.Flush()
+			}
+		}
+	}()
+}
+
+// Flush sends the queued events now and waits for the peers to answer.
+// Peers that are still answering an earlier Flush are skipped, and keep
+// their events for the next. Events a peer didn't accept are put back at
+// the front of its queue.
+func (n *Node) Flush() {
+	n.mu.Lock()
+	batches := make(map[string][]Event)
+	for peer, events := range n.queues {
+		if len(events) > 0 && !n.sending[peer] {
+			batches[peer] = events
+			n.sending[peer] = true
+			delete(n.queues, peer)
+		}
+	}
+	n.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for peer, events := range batches {
+		wg.Add(1)
+		go func(peer string, events []Event) {
+			defer wg.Done()
+			n.flushPeer(peer, events)
+		}(peer, events)
+	}
+	wg.Wait()
+}
+
+func (n *Node) flushPeer(peer string, events []Event) {
+	err := n.send(peer, events)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sending[peer] = false
+	if err != nil {
+		q := append(events, n.queues[peer]...)
+		if len(q) > n.queueSize {
+			q = q[len(q)-n.queueSize:]
+		}
+		n.queues[peer] = q
+		if !n.failing[peer] {
+			log.Printf("Cluster sync to %s failed, will retry: %v", peer, err)
+		}
+	} else if n.failing[peer] {
+		log.Printf("Cluster sync to %s recovered", peer)
+	}
+	n.failing[peer] = err != nil
+}
+
+func (n *Node) send(peer string, events []Event) error {
+	body, _ := json.Marshal(events)
+	req, err := http.NewRequest(http.MethodPost, peer, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+n.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("peer answered %s", resp.Status)
+	}
+	return nil
+}
+
+// ServeHTTP is the admin API endpoint peers POST their events to. The admin
+// API has already checked the token. It answers 500 if any event failed to
+// apply, after applying the rest, so the peer retries the batch; events
+// are safe to apply twice.
+func (n *Node) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var events []Event
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16<<20)).Decode(&events); err != nil {
+		http.Error(w, "invalid JSON body", http.StatusBadRequest)
+		return
+	}
+	n.mu.Lock()
+	handlers := make(map[string]func(Event) error, len(n.handlers))
+	for kind, fn := range n.handlers {
+		handlers[kind] = fn
+	}
+	n.mu.Unlock()
+
+	failed := 0
+	for _, e := range events {
+		if fn := handlers[e.Kind]; fn != nil {
+			if err := fn(e); err != nil {
+				log.Printf("Applying cluster %s event failed: %v", e.Kind, err)
+				failed++
+			}
+		}
+	}
+	if failed > 0 {
+		http.Error(w, fmt.Sprintf("%d events failed to apply", failed), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
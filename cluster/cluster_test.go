@@ -0,0 +1,182 @@
+package cluster
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"google-redirector/config"
+)
+
+const testToken = "0123456789abcdef"
+
+// peer serves a node's cluster endpoint the way the admin API would.
+func peer(t *testing.T, n *Node) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_admin/cluster" || r.Header.Get("Authorization") != "Bearer "+testToken {
+			http.NotFound(w, r)
+			return
+		}
+		n.ServeHTTP(w, r)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func newTestNode(t *testing.T, peers string) *Node {
+	n, err := New(config.FromMap(map[string]string{"CLUSTER_PEERS": peers, "ADMIN_TOKEN": testToken}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestNode_Sync(t *testing.T) {
+	receiver := newTestNode(t, "http://unused.invalid")
+	var mu sync.Mutex
+	var got []Event
+	receiver.Subscribe("ban", func(e Event) error {
+		mu.Lock()
+		got = append(got, e)
+		mu.Unlock()
+		return nil
+	})
+	server := peer(t, receiver)
+
+	sender := newTestNode(t, server.URL+"/")
+	sender.Publish(Event{Kind: "ban", Key: "192.0.2.1", Expires: 1700000000})
+	sender.Publish(Event{Kind: "unknown", Key: "ignored"})
+	sender.Flush()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 || got[0].Key != "192.0.2.1" || got[0].Expires != 1700000000 {
+		t.Errorf("Expected the ban to reach the peer, got %+v", got)
+	}
+	if len(sender.queues[sender.peers[0]]) != 0 {
+		t.Error("Expected delivered events to leave the queue")
+	}
+}
+
+func TestNode_Retry(t *testing.T) {
+	receiver := newTestNode(t, "http://unused.invalid")
+	delivered := 0
+	receiver.Subscribe("nonce", func(Event) error { delivered++; return nil })
+	server := peer(t, receiver)
+
+	sender, _ := New(config.FromMap(map[string]string{
+		"CLUSTER_PEERS":      server.URL,
+		"ADMIN_TOKEN":        "fedcba9876543210", // rejected by the peer
+		"CLUSTER_QUEUE_SIZE": "2",
+	}))
+	for _, key := range []string{"a", "b", "c"} {
+		sender.Publish(Event{Kind: "nonce", Key: key})
+	}
+	sender.Flush()
+	q := sender.queues[sender.peers[0]]
+	if len(q) != 2 || q[0].Key != "b" || !sender.failing[sender.peers[0]] {
+		t.Fatalf("Expected the newest 2 events to be kept for a failing peer, got %+v", q)
+	}
+
+	sender.token = testToken
+	sender.Flush()
+	if delivered != 2 || sender.failing[sender.peers[0]] {
+		t.Errorf("Expected the kept events to be delivered once the peer accepts them, got %d", delivered)
+	}
+}
+
+func TestNode_ApplyFailure(t *testing.T) {
+	receiver := newTestNode(t, "http://unused.invalid")
+	fail := true
+	applied := 0
+	receiver.Subscribe("revocation", func(Event) error {
+		if fail {
+			return errors.New("disk full")
+		}
+		applied++
+		return nil
+	})
+	server := peer(t, receiver)
+
+	sender := newTestNode(t, server.URL)
+	sender.Publish(Event{Kind: "revocation", Key: "token", Value: "implant-7"})
+	sender.Flush()
+	if len(sender.queues[sender.peers[0]]) != 1 || !sender.failing[sender.peers[0]] {
+		t.Fatalf("Expected an event the peer failed to apply to be kept, got %+v", sender.queues)
+	}
+	fail = false
+	sender.Flush()
+	if applied != 1 || sender.failing[sender.peers[0]] {
+		t.Errorf("Expected the event to be applied on retry, applied %d", applied)
+	}
+}
+
+func TestNode_OneSendPerPeer(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	inFlight, most := 0, 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		most = max(most, inFlight)
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	sender := newTestNode(t, server.URL)
+	sender.Publish(Event{Kind: "nonce", Key: "a"})
+	done := make(chan struct{})
+	go func() {
+		sender.Flush()
+		close(done)
+	}()
+	for {
+		mu.Lock()
+		n := inFlight
+		mu.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// A second Flush while the first batch is in flight leaves the peer
+	// alone and keeps the new event queued
+	sender.Publish(Event{Kind: "nonce", Key: "b"})
+	sender.Flush()
+	close(release)
+	<-done
+	if most != 1 {
+		t.Errorf("Expected one send in flight per peer, saw %d", most)
+	}
+	if q := sender.queues[sender.peers[0]]; len(q) != 1 || q[0].Key != "b" {
+		t.Errorf("Expected the new event to wait for the next flush, got %+v", q)
+	}
+}
+
+func TestNode_Config(t *testing.T) {
+	if n, err := New(config.FromMap(nil)); n != nil || err != nil {
+		t.Errorf("Expected no cluster by default, got %v (%v)", n, err)
+	}
+	for _, settings := range []map[string]string{
+		{"CLUSTER_PEERS": "https://eu.example.com"},
+		{"CLUSTER_PEERS": "eu.example.com", "ADMIN_TOKEN": testToken},
+		{"CLUSTER_PEERS": "https://eu.example.com", "ADMIN_TOKEN": testToken, "CLUSTER_SYNC_INTERVAL": "0s"},
+	} {
+		if _, err := New(config.FromMap(settings)); err == nil {
+			t.Errorf("Expected an error for %v", settings)
+		}
+	}
+	n := newTestNode(t, "https://eu.example.com/,https://us.example.com")
+	if n.peers[0] != "https://eu.example.com/_admin/cluster" || n.peers[1] != "https://us.example.com/_admin/cluster" {
+		t.Errorf("Expected peer endpoints under ADMIN_PATH, got %v", n.peers)
+	}
+}
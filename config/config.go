@@ -0,0 +1,123 @@
+// Package config is where every part of the redirector reads its settings
+// from. Keys are the environment variable names documented in the README, so
+// the binary reads the process environment while programs embedding the
+// redirector can supply the same keys from a map.
+package config
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config is a source of settings. Empty values count as unset.
+type Config struct {
+	lookup func(key string) string
+}
+
+// FromEnv reads settings from the process environment.
+func FromEnv() *Config {
+	return &Config{lookup: os.Getenv}
+}
+
+// FromMap reads settings from m, for programs that embed the redirector.
+func FromMap(m map[string]string) *Config {
+	return &Config{lookup: func(key string) string { return m[key] }}
+}
+
+// String returns the value of key, or def if it is unset.
+func (c *Config) String(key, def string) string {
+	if value := c.lookup(key); value != "" {
+		return value
+	}
+	return def
+}
+
+// Bool returns key parsed as a boolean. Invalid values are logged and
+// replaced by def, as for Duration and Int.
+func (c *Config) Bool(key string, def bool) bool {
+	value := c.lookup(key)
+	if value == "" {
+		return def
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, value, err)
+		return def
+	}
+	return b
+}
+
+func (c *Config) Duration(key string, def time.Duration) time.Duration {
+	value := c.lookup(key)
+	if value == "" {
+		return def
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, value, err)
+		return def
+	}
+	return d
+}
+
+func (c *Config) Int(key string, def int) int {
+	value := c.lookup(key)
+	if value == "" {
+		return def
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q: %v", key, value, err)
+		return def
+	}
+	return n
+}
+
+// List returns key (or def) split on commas.
+func (c *Config) List(key, def string) []string {
+	return SplitList(c.String(key, def))
+}
+
+// ByteSize returns key (or def) parsed with ParseByteSize.
+func (c *Config) ByteSize(key, def string) (int64, error) {
+	return ParseByteSize(key, c.String(key, def))
+}
+
+// SplitList splits a comma-separated list, dropping empty entries.
+func SplitList(s string) []string {
+	var out []string
+	for _, part := range strings.Split(s, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// ParseByteSize accepts a plain byte count or one with a K, M or G suffix
+// (powers of 1024, optionally followed by "B" or "iB").
+func ParseByteSize(key, value string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(value))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+	mult := int64(1)
+	switch {
+	case strings.HasSuffix(s, "K"):
+		mult = 1 << 10
+	case strings.HasSuffix(s, "M"):
+		mult = 1 << 20
+	case strings.HasSuffix(s, "G"):
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q", key, value)
+	}
+	return n * mult, nil
+}
@@ -0,0 +1,58 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseByteSize(t *testing.T) {
+	tests := map[string]int64{
+		"0":     0,
+		"1500":  1500,
+		"64k":   64 << 10,
+		"512KB": 512 << 10,
+		"2MiB":  2 << 20,
+		"1G":    1 << 30,
+	}
+	for in, want := range tests {
+		got, err := ParseByteSize("TEST", in)
+		if err != nil || got != want {
+			t.Errorf("ParseByteSize(%q) = %d, %v; want %d", in, got, err, want)
+		}
+	}
+	if _, err := ParseByteSize("TEST", "fast"); err == nil {
+		t.Error("Expected invalid size to be rejected")
+	}
+}
+
+func TestFromMap(t *testing.T) {
+	cfg := FromMap(map[string]string{
+		"NAME":    "redirector",
+		"ENABLED": "true",
+		"TIMEOUT": "soon",
+		"TARGETS": "a, b,,c",
+	})
+	if got := cfg.String("NAME", "x"); got != "redirector" {
+		t.Errorf("Expected redirector, got %s", got)
+	}
+	if got := cfg.String("MISSING", "x"); got != "x" {
+		t.Errorf("Expected default for missing key, got %s", got)
+	}
+	if !cfg.Bool("ENABLED", false) {
+		t.Errorf("Expected ENABLED to be true")
+	}
+	if got := cfg.Duration("TIMEOUT", time.Second); got != time.Second {
+		t.Errorf("Expected invalid duration to fall back to default, got %v", got)
+	}
+	if got := cfg.List("TARGETS", ""); !reflect.DeepEqual(got, []string{"a", "b", "c"}) {
+		t.Errorf("Expected [a b c], got %q", got)
+	}
+}
+
+func TestFromEnv(t *testing.T) {
+	t.Setenv("CONFIG_TEST_INT", "42")
+	if got := FromEnv().Int("CONFIG_TEST_INT", 0); got != 42 {
+		t.Errorf("Expected 42, got %d", got)
+	}
+}
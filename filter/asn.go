@@ -0,0 +1,236 @@
+package filter
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"google-redirector/clientip"
+	"google-redirector/config"
+	"google-redirector/proxy"
+)
+
+// ASNFilter refuses clients by the network they connect from rather than
+// their country. Sandboxes and URL scanners mostly run in a handful of
+// cloud and security-vendor networks, so blocking those ASNs (or every ASN
+// whose name matches an organisation) catches them wherever the datacenter
+// is.
+//
+// The database is an iptoasn.com style TSV (range start, range end, AS
+// number, country, description; optionally gzipped), read from ASN_DB as a
+// file or downloaded from it as a URL and refreshed every ASN_DB_REFRESH.
+type ASNFilter struct {
+	source  string
+	refresh time.Duration
+	asns    map[uint32]bool
+	orgs    []string // lowercased substrings of the AS description
+
+	db atomic.Pointer[asnDB]
+}
+
+type asnRange struct {
+	start, end netip.Addr
+	asn        uint32
+	country    string
+	org        string
+}
+
+// asnDB is sorted by start; ranges don't overlap.
+type asnDB []asnRange
+
+// NewASNFilter returns nil unless ASN_DB, ASN_BLOCK or ASN_BLOCK_ORGS is
+// set. The block lists need ASN_DB, which is loaded before it returns; on
+// its own it only serves Network lookups.
+func NewASNFilter(cfg *config.Config) (*ASNFilter, error) {
+	f := &ASNFilter{
+		source:  cfg.String("ASN_DB", ""),
+		refresh: cfg.Duration("ASN_DB_REFRESH", 24*time.Hour),
+		asns:    make(map[uint32]bool),
+	}
+	for _, v := range cfg.List("ASN_BLOCK", "") {
+		n, err := strconv.ParseUint(strings.TrimPrefix(strings.ToUpper(v), "AS"), 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid ASN_BLOCK entry %q", v)
+		}
+		f.asns[uint32(n)] = true
+	}
+	for _, org := range cfg.List("ASN_BLOCK_ORGS", "") {
+		f.orgs = append(f.orgs, strings.ToLower(org))
+	}
+	if f.source == "" && len(f.asns) == 0 && len(f.orgs) == 0 {
+		return nil, nil
+	}
+	if f.source == "" {
+		return nil, fmt.Errorf("ASN_BLOCK and ASN_BLOCK_ORGS need ASN_DB")
+	}
+
+	db, err := loadASNDB(f.source)
+	if err != nil {
+		return nil, fmt.Errorf("loading ASN_DB: %v", err)
+	}
+	f.db.Store(&db)
+	return f, nil
+}
+
+// Start reloads an ASN_DB URL every ASN_DB_REFRESH until ctx is cancelled.
+func (f *ASNFilter) Start(ctx context.Context) {
+	if isURL(f.source) && f.refresh > 0 {
+		go f.refreshLoop(ctx)
+	}
+}
+
+func isURL(source string) bool {
+	return strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://")
+}
+
+func (f *ASNFilter) String() string {
+	return fmt.Sprintf("%d ASNs, %d organisations, %d ranges", len(f.asns), len(f.orgs), len(*f.db.Load()))
+}
+
+func (f *ASNFilter) refreshLoop(ctx context.Context) {
+	ticker := time.NewTicker(f.refresh)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		db, err := loadASNDB(f.source)
+		if err != nil {
+			log.Printf("ASN database refresh failed, keeping previous copy: %v", err)
+			continue
+		}
+		f.db.Store(&db)
+	}
+}
+
+func loadASNDB(source string) (asnDB, error) {
+	var r io.Reader
+	if isURL(source) {
+		client := &http.Client{Timeout: 2 * time.Minute}
+		resp, err := client.Get(source)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("download answered %s", resp.Status)
+		}
+		r = resp.Body
+	} else {
+		file, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		r = file
+	}
+
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		defer gz.Close()
+		br = bufio.NewReader(gz)
+	}
+	return parseASNDB(br)
+}
+
+func parseASNDB(r io.Reader) (asnDB, error) {
+	var db asnDB
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		start, err1 := netip.ParseAddr(fields[0])
+		end, err2 := netip.ParseAddr(fields[1])
+		asn, err3 := strconv.ParseUint(fields[2], 10, 32)
+		if err1 != nil || err2 != nil || err3 != nil || end.Less(start) {
+			return nil, fmt.Errorf("line %d: malformed range", line)
+		}
+		if asn == 0 {
+			continue // not routed
+		}
+		rng := asnRange{start: start.Unmap(), end: end.Unmap(), asn: uint32(asn)}
+		if len(fields) >= 5 {
+			rng.country, rng.org = fields[3], fields[4]
+		}
+		db = append(db, rng)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(db) == 0 {
+		return nil, fmt.Errorf("no ranges found")
+	}
+	sort.Slice(db, func(i, j int) bool { return db[i].start.Less(db[j].start) })
+	return db, nil
+}
+
+// lookup returns the range containing ip, or nil.
+func (db asnDB) lookup(ip netip.Addr) *asnRange {
+	i := sort.Search(len(db), func(i int) bool { return ip.Less(db[i].start) }) - 1
+	if i < 0 || db[i].end.Less(ip) {
+		return nil
+	}
+	return &db[i]
+}
+
+// Network describes the autonomous system ip is in, or returns nil if the
+// database doesn't cover it.
+func (f *ASNFilter) Network(ip string) *proxy.ClientNetwork {
+	addr, err := netip.ParseAddr(ip)
+	if err != nil {
+		return nil
+	}
+	rng := f.db.Load().lookup(addr.Unmap())
+	if rng == nil {
+		return nil
+	}
+	return &proxy.ClientNetwork{ASN: rng.asn, Country: rng.country, Org: rng.org}
+}
+
+// Blocked describes the blocked network r's client is in ("AS8075
+// MICROSOFT-CORP-MSN-AS-BLOCK"), or returns "" if it may pass. Addresses
+// missing from the database pass.
+func (f *ASNFilter) Blocked(r *http.Request) string {
+	ip, err := netip.ParseAddr(clientip.From(r))
+	if err != nil {
+		return ""
+	}
+	rng := f.db.Load().lookup(ip.Unmap())
+	if rng == nil {
+		return ""
+	}
+	blocked := f.asns[rng.asn]
+	if !blocked && len(f.orgs) > 0 {
+		org := strings.ToLower(rng.org)
+		for _, o := range f.orgs {
+			if strings.Contains(org, o) {
+				blocked = true
+				break
+			}
+		}
+	}
+	if !blocked {
+		return ""
+	}
+	return fmt.Sprintf("AS%d %s", rng.asn, rng.org)
+}
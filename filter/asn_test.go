@@ -0,0 +1,113 @@
+package filter
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google-redirector/config"
+)
+
+const testASNDB = "1.0.0.0\t1.0.0.255\t13335\tUS\tCLOUDFLARENET\n" +
+	"13.64.0.0\t13.107.255.255\t8075\tUS\tMICROSOFT-CORP-MSN-AS-BLOCK\n" +
+	"100.0.0.0\t100.0.0.255\t0\tNone\tNot routed\n" +
+	"165.225.0.0\t165.225.255.255\t53813\tUS\tZSCALER-INC\n" +
+	"2a01:111::\t2a01:111:ffff:ffff:ffff:ffff:ffff:ffff\t8075\tUS\tMICROSOFT-CORP-MSN-AS-BLOCK\n"
+
+func TestASNFilter_Blocked(t *testing.T) {
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte(testASNDB))
+	w.Close()
+	file := filepath.Join(t.TempDir(), "ip2asn.tsv.gz")
+	os.WriteFile(file, gz.Bytes(), 0o600)
+
+	f, err := NewASNFilter(config.FromMap(map[string]string{
+		"ASN_DB":         file,
+		"ASN_BLOCK":      "AS8075",
+		"ASN_BLOCK_ORGS": "zscaler",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ ip, want string }{
+		{"13.70.1.2", "AS8075 MICROSOFT-CORP-MSN-AS-BLOCK"},
+		{"2a01:111::5", "AS8075 MICROSOFT-CORP-MSN-AS-BLOCK"},
+		{"165.225.8.9", "AS53813 ZSCALER-INC"},
+		{"1.0.0.1", ""},
+		{"100.0.0.1", ""},
+		{"8.8.8.8", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.ip + ":1234"
+		if tt.ip[0] == '2' {
+			r.RemoteAddr = "[" + tt.ip + "]:1234"
+		}
+		if got := f.Blocked(r); got != tt.want {
+			t.Errorf("%s: expected %q, got %q", tt.ip, tt.want, got)
+		}
+	}
+}
+
+func TestASNFilter_Network(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "ip2asn.tsv")
+	os.WriteFile(file, []byte(testASNDB), 0o600)
+
+	// ASN_DB on its own loads for lookups and blocks nothing
+	f, err := NewASNFilter(config.FromMap(map[string]string{"ASN_DB": file}))
+	if err != nil || f == nil {
+		t.Fatalf("Expected a lookup-only filter, got %v (%v)", f, err)
+	}
+	n := f.Network("13.70.1.2")
+	if n == nil || n.ASN != 8075 || n.Country != "US" || n.Org != "MICROSOFT-CORP-MSN-AS-BLOCK" {
+		t.Errorf("Expected AS8075 US MICROSOFT-CORP-MSN-AS-BLOCK, got %+v", n)
+	}
+	if n := f.Network("8.8.8.8"); n != nil {
+		t.Errorf("Expected no network for an uncovered address, got %+v", n)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "13.70.1.2:1234"
+	if got := f.Blocked(r); got != "" {
+		t.Errorf("Expected nothing blocked without block lists, got %q", got)
+	}
+}
+
+func TestASNFilter_Download(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(testASNDB))
+	}))
+	defer server.Close()
+
+	f, err := NewASNFilter(config.FromMap(map[string]string{"ASN_DB": server.URL, "ASN_BLOCK": "13335"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "1.0.0.7:1234"
+	if got := f.Blocked(r); got != "AS13335 CLOUDFLARENET" {
+		t.Errorf("Expected the downloaded database to be used, got %q", got)
+	}
+}
+
+func TestASNFilter_Config(t *testing.T) {
+	if f, err := NewASNFilter(config.FromMap(nil)); f != nil || err != nil {
+		t.Errorf("Expected no ASN filter by default, got %v (%v)", f, err)
+	}
+	file := filepath.Join(t.TempDir(), "bad.tsv")
+	os.WriteFile(file, []byte("1.0.0.0\tnot-an-ip\t13335\tUS\tX\n"), 0o600)
+	for _, settings := range []map[string]string{
+		{"ASN_BLOCK": "AS8075"},
+		{"ASN_BLOCK": "microsoft", "ASN_DB": file},
+		{"ASN_BLOCK": "8075", "ASN_DB": file},
+		{"ASN_BLOCK": "8075", "ASN_DB": filepath.Join(t.TempDir(), "missing")},
+	} {
+		if _, err := NewASNFilter(config.FromMap(settings)); err == nil {
+			t.Errorf("%v: expected configuration error", settings)
+		}
+	}
+}
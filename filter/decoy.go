@@ -0,0 +1,52 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"google-redirector/config"
+)
+
+// Decoy is the response served to requests the redirector refuses to proxy.
+// By default it mimics the bare "Bad Gateway" the redirector has always
+// returned for unverified requests.
+type Decoy struct {
+	status      int
+	body        []byte
+	contentType string
+}
+
+// NewDecoy reads the DECOY_* settings from cfg.
+func NewDecoy(cfg *config.Config) (*Decoy, error) {
+	d := &Decoy{
+		status:      http.StatusBadGateway,
+		body:        []byte(cfg.String("DECOY_BODY", "Bad Gateway")),
+		contentType: cfg.String("DECOY_CONTENT_TYPE", ""),
+	}
+	if v := cfg.String("DECOY_STATUS", ""); v != "" {
+		status, err := strconv.Atoi(v)
+		if err != nil || status < 100 || status > 599 {
+			return nil, fmt.Errorf("invalid DECOY_STATUS %q", v)
+		}
+		d.status = status
+	}
+	if file := cfg.String("DECOY_BODY_FILE", ""); file != "" {
+		body, err := os.ReadFile(file)
+		if err != nil {
+			return nil, fmt.Errorf("reading DECOY_BODY_FILE: %v", err)
+		}
+		d.body = body
+	}
+	return d, nil
+}
+
+// Serve writes the decoy response.
+func (d *Decoy) Serve(w http.ResponseWriter, r *http.Request) {
+	if d.contentType != "" {
+		w.Header().Set("Content-Type", d.contentType)
+	}
+	w.WriteHeader(d.status)
+	w.Write(d.body)
+}
@@ -0,0 +1,150 @@
+package filter
+
+import (
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"google-redirector/config"
+)
+
+// ResponseDelay holds responses back before their headers are sent, so the
+// redirector answers with the latency of the application it poses as
+// instead of the near-instant turnaround of a reverse proxy. Rules match by
+// path prefix and, optionally, status class; decoy responses are delayed
+// like any other.
+type ResponseDelay struct {
+	routes routeTable[delayRoute]
+}
+
+// delayRoute is the delay for each status class under a prefix, with index
+// 0 for any status.
+type delayRoute [6]*delayRange
+
+type delayRange struct {
+	min, max time.Duration
+}
+
+// NewResponseDelay returns nil unless RESPONSE_DELAYS has at least one
+// prefix[:Nxx]=delay rule, where delay is a duration or a min-max range.
+func NewResponseDelay(cfg *config.Config) (*ResponseDelay, error) {
+	entries := cfg.List("RESPONSE_DELAYS", "")
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	d := &ResponseDelay{}
+	for _, entry := range entries {
+		match, delay, err := splitRoute("RESPONSE_DELAYS", entry, "=", "/prefix[:Nxx]=delay")
+		if err != nil {
+			return nil, err
+		}
+		prefix, class := match, 0
+		if p, c, ok := strings.Cut(match, ":"); ok {
+			if len(c) != 3 || c[0] < '1' || c[0] > '5' || strings.ToLower(c[1:]) != "xx" {
+				return nil, fmt.Errorf("invalid status class %q in RESPONSE_DELAYS (expected 1xx-5xx)", c)
+			}
+			prefix, class = p, int(c[0]-'0')
+		}
+		r, err := parseDelayRange(delay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid delay %q in RESPONSE_DELAYS entry %q", delay, entry)
+		}
+		d.routes.at(prefix)[class] = r
+	}
+	d.routes.sort()
+	return d, nil
+}
+
+func parseDelayRange(delay string) (*delayRange, error) {
+	min, max, isRange := strings.Cut(delay, "-")
+	r := &delayRange{}
+	var err error
+	if r.min, err = time.ParseDuration(min); err != nil {
+		return nil, err
+	}
+	r.max = r.min
+	if isRange {
+		if r.max, err = time.ParseDuration(max); err != nil {
+			return nil, err
+		}
+	}
+	if r.min < 0 || r.max < r.min {
+		return nil, fmt.Errorf("negative or inverted range")
+	}
+	return r, nil
+}
+
+func (d *ResponseDelay) String() string {
+	return fmt.Sprintf("%d routes", d.routes.len())
+}
+
+// delayFor picks the delay for a response to path with status from the
+// longest prefix with a rule for its class, or for any status.
+func (d *ResponseDelay) delayFor(path string, status int) time.Duration {
+	var r *delayRange
+	d.routes.each(path, func(route *delayRoute) bool {
+		if class := status / 100; class >= 1 && class <= 5 && route[class] != nil {
+			r = route[class]
+		} else {
+			r = route[0]
+		}
+		return r == nil
+	})
+	if r == nil {
+		return 0
+	}
+	if r.max > r.min {
+		return r.min + time.Duration(mathrand.Int63n(int64(r.max-r.min)))
+	}
+	return r.min
+}
+
+// Wrap returns a writer that waits out the matching delay when the response
+// to r starts. Streamed responses are only delayed once, before the headers.
+func (d *ResponseDelay) Wrap(w http.ResponseWriter, r *http.Request) http.ResponseWriter {
+	return &delayedResponseWriter{ResponseWriter: w, delay: d, r: r}
+}
+
+type delayedResponseWriter struct {
+	http.ResponseWriter
+	delay       *ResponseDelay
+	r           *http.Request
+	wroteHeader bool
+}
+
+func (w *delayedResponseWriter) WriteHeader(status int) {
+	if !w.wroteHeader && status >= 200 {
+		w.wroteHeader = true
+		w.wait(status)
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *delayedResponseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+// wait sleeps unless the client goes away first.
+func (w *delayedResponseWriter) wait(status int) {
+	d := w.delay.delayFor(w.r.URL.Path, status)
+	if d <= 0 {
+		return
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-w.r.Context().Done():
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer so
+// streamed responses are still flushed.
+func (w *delayedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
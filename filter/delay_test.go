@@ -0,0 +1,78 @@
+package filter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google-redirector/config"
+)
+
+func TestResponseDelay_Rules(t *testing.T) {
+	d, err := NewResponseDelay(config.FromMap(map[string]string{
+		"RESPONSE_DELAYS": "/=10ms, /api/=20ms, /api/:4xx=30ms, /login:5xx=40ms-50ms",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path   string
+		status int
+		min    time.Duration
+		max    time.Duration
+	}{
+		{"/index.html", 200, 10 * time.Millisecond, 10 * time.Millisecond},
+		{"/api/tasks", 200, 20 * time.Millisecond, 20 * time.Millisecond},
+		{"/api/tasks", 404, 30 * time.Millisecond, 30 * time.Millisecond},
+		{"/login", 503, 40 * time.Millisecond, 50 * time.Millisecond},
+		{"/login", 200, 10 * time.Millisecond, 10 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		if got := d.delayFor(tt.path, tt.status); got < tt.min || got > tt.max {
+			t.Errorf("%s %d: expected %v-%v, got %v", tt.path, tt.status, tt.min, tt.max, got)
+		}
+	}
+}
+
+func TestResponseDelay_Config(t *testing.T) {
+	if d, err := NewResponseDelay(config.FromMap(nil)); d != nil || err != nil {
+		t.Errorf("Expected no response delay by default, got %v (%v)", d, err)
+	}
+	for _, rules := range []string{"/api=soon", "/api:6xx=10ms", "/api:404=10ms", "/api=50ms-10ms"} {
+		if _, err := NewResponseDelay(config.FromMap(map[string]string{"RESPONSE_DELAYS": rules})); err == nil {
+			t.Errorf("%q: expected configuration error", rules)
+		}
+	}
+}
+
+func TestResponseDelay_Wrap(t *testing.T) {
+	d, err := NewResponseDelay(config.FromMap(map[string]string{"RESPONSE_DELAYS": "/slow:2xx=100ms"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		w = d.Wrap(w, r)
+		if r.URL.Path == "/slow/missing" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("ok"))
+	}
+
+	for _, tt := range []struct {
+		path    string
+		delayed bool
+	}{
+		{"/slow/page", true},
+		{"/slow/missing", false},
+		{"/fast", false},
+	} {
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		handler(rec, httptest.NewRequest("GET", tt.path, nil))
+		if delayed := time.Since(start) >= 100*time.Millisecond; delayed != tt.delayed {
+			t.Errorf("%s: expected delayed=%v, took %v", tt.path, tt.delayed, time.Since(start))
+		}
+	}
+}
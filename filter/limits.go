@@ -0,0 +1,87 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"google-redirector/config"
+)
+
+// Limits rejects oversized requests before they are proxied. Limits
+// are enforced in the handler so rejections can be served as the decoy
+// instead of net/http's recognisable 431 page.
+type Limits struct {
+	maxHeaderBytes int
+	maxURILength   int
+	rejectStatus   int // 0 serves the decoy
+	decoy          *Decoy
+}
+
+// NewLimits reads the request size limits from cfg. Rejections are served
+// as d unless LIMIT_REJECT_STATUS is set.
+func NewLimits(cfg *config.Config, d *Decoy) (*Limits, error) {
+	l := &Limits{decoy: d}
+	var err error
+	if v := cfg.String("MAX_HEADER_BYTES", ""); v != "" {
+		var n int64
+		if n, err = config.ParseByteSize("MAX_HEADER_BYTES", v); err != nil {
+			return nil, err
+		}
+		l.maxHeaderBytes = int(n)
+	}
+	l.maxURILength = cfg.Int("MAX_URI_LENGTH", 0)
+	if v := cfg.String("LIMIT_REJECT_STATUS", ""); v != "" {
+		if l.rejectStatus, err = strconv.Atoi(v); err != nil || l.rejectStatus < 100 || l.rejectStatus > 599 {
+			return nil, fmt.Errorf("invalid LIMIT_REJECT_STATUS %q", v)
+		}
+	}
+	return l, nil
+}
+
+// maxHeaderHeadroom is how far over MAX_HEADER_BYTES a request may go and
+// still reach the handler for the configured rejection. Anything larger is
+// cut off by net/http itself with a 431.
+const maxHeaderHeadroom = 4096
+
+// ServerMaxHeaderBytes is the hard cap handed to http.Server: the configured
+// limit plus maxHeaderHeadroom, or net/http's default without a limit.
+func (l *Limits) ServerMaxHeaderBytes() int {
+	if l.maxHeaderBytes == 0 {
+		return http.DefaultMaxHeaderBytes
+	}
+	return l.maxHeaderBytes + maxHeaderHeadroom
+}
+
+// Exceeded reports which limit r breaks, or "" if it is within all of them.
+func (l *Limits) Exceeded(r *http.Request) string {
+	if l.maxURILength > 0 && len(r.RequestURI) > l.maxURILength {
+		return "URI length"
+	}
+	if l.maxHeaderBytes > 0 && headerBytes(r) > l.maxHeaderBytes {
+		return "header size"
+	}
+	return ""
+}
+
+// Reject serves the configured rejection for a request over a limit.
+func (l *Limits) Reject(w http.ResponseWriter, r *http.Request) {
+	if l.rejectStatus == 0 {
+		l.decoy.Serve(w, r)
+		return
+	}
+	http.Error(w, http.StatusText(l.rejectStatus), l.rejectStatus)
+}
+
+// headerBytes approximates the size of r's request line and headers as they
+// appeared on the wire.
+func headerBytes(r *http.Request) int {
+	n := len(r.Method) + len(r.RequestURI) + len(r.Proto) + 4
+	n += len("Host: ") + len(r.Host) + 2
+	for name, values := range r.Header {
+		for _, v := range values {
+			n += len(name) + len(v) + 4
+		}
+	}
+	return n
+}
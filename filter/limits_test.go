@@ -0,0 +1,54 @@
+package filter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestLimits_Reject(t *testing.T) {
+	limits := &Limits{
+		maxHeaderBytes: 256,
+		maxURILength:   32,
+		decoy:          &Decoy{status: http.StatusNotFound, body: []byte("nothing here")},
+	}
+
+	req := httptest.NewRequest("GET", "/ok", nil)
+	if limit := limits.Exceeded(req); limit != "" {
+		t.Fatalf("Expected small request to pass, got %s", limit)
+	}
+
+	req = httptest.NewRequest("GET", "/"+strings.Repeat("a", 40), nil)
+	if limit := limits.Exceeded(req); limit != "URI length" {
+		t.Errorf("Expected URI length limit, got %q", limit)
+	}
+
+	req = httptest.NewRequest("GET", "/ok", nil)
+	req.Header.Set("X-Stuffing", strings.Repeat("b", 300))
+	if limit := limits.Exceeded(req); limit != "header size" {
+		t.Errorf("Expected header size limit, got %q", limit)
+	}
+
+	w := httptest.NewRecorder()
+	limits.Reject(w, req)
+	if w.Code != http.StatusNotFound || w.Body.String() != "nothing here" {
+		t.Errorf("Expected decoy response, got %d %q", w.Code, w.Body.String())
+	}
+
+	limits.rejectStatus = http.StatusRequestURITooLong
+	w = httptest.NewRecorder()
+	limits.Reject(w, req)
+	if w.Code != http.StatusRequestURITooLong {
+		t.Errorf("Expected configured status, got %d", w.Code)
+	}
+}
+
+func TestRequestLimits_ServerMaxHeaderBytes(t *testing.T) {
+	if got := (&Limits{}).ServerMaxHeaderBytes(); got != http.DefaultMaxHeaderBytes {
+		t.Errorf("Expected net/http's default without a limit, got %d", got)
+	}
+	if got := (&Limits{maxHeaderBytes: 16 << 10}).ServerMaxHeaderBytes(); got != 16<<10+maxHeaderHeadroom {
+		t.Errorf("Expected the limit plus headroom, got %d", got)
+	}
+}
@@ -0,0 +1,103 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google-redirector/config"
+)
+
+// MethodFilter restricts which HTTP methods reach each route and can change
+// the method a request is proxied with. The client's method is taken from
+// the override header first (on POSTs, the only method clients tunnel
+// others through), then checked against the longest matching
+// METHOD_RULES prefix, then rewritten by METHOD_REWRITE for the backend.
+type MethodFilter struct {
+	rules    routeTable[methodRule]
+	override string
+	rewrite  map[string]string
+}
+
+// methodRule is the set of methods allowed under a prefix.
+type methodRule map[string]bool
+
+// NewMethodFilter returns nil unless METHOD_RULES, METHOD_OVERRIDE_HEADER
+// or METHOD_REWRITE is set.
+func NewMethodFilter(cfg *config.Config) (*MethodFilter, error) {
+	f := &MethodFilter{
+		override: cfg.String("METHOD_OVERRIDE_HEADER", ""),
+		rewrite:  make(map[string]string),
+	}
+	for _, entry := range cfg.List("METHOD_RULES", "") {
+		prefix, methods, err := splitRoute("METHOD_RULES", entry, "=", "/prefix=GET|POST")
+		if err != nil {
+			return nil, err
+		}
+		rule := f.rules.at(prefix)
+		if *rule == nil {
+			*rule = make(methodRule)
+		}
+		for _, m := range strings.Split(methods, "|") {
+			(*rule)[strings.ToUpper(strings.TrimSpace(m))] = true
+		}
+	}
+	f.rules.sort()
+
+	for _, pair := range cfg.List("METHOD_REWRITE", "") {
+		from, to, ok := strings.Cut(pair, "=")
+		if !ok || from == "" || to == "" {
+			return nil, fmt.Errorf("invalid METHOD_REWRITE entry %q (expected FROM=TO)", pair)
+		}
+		f.rewrite[strings.ToUpper(from)] = strings.ToUpper(to)
+	}
+
+	if f.rules.len() == 0 && f.override == "" && len(f.rewrite) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func (f *MethodFilter) String() string {
+	s := fmt.Sprintf("%d routes, %d rewrites", f.rules.len(), len(f.rewrite))
+	if f.override != "" {
+		s += ", override via " + f.override
+	}
+	return s
+}
+
+// Apply returns the request to proxy, with its method overridden or
+// rewritten, or false if the method isn't allowed on r's route.
+func (f *MethodFilter) Apply(r *http.Request) (*http.Request, bool) {
+	method := r.Method
+	override := ""
+	if f.override != "" {
+		override = strings.ToUpper(strings.TrimSpace(r.Header.Get(f.override)))
+		if override != "" && method == http.MethodPost {
+			method = override
+		}
+	}
+
+	allowed := true
+	f.rules.each(r.URL.Path, func(rule *methodRule) bool {
+		allowed = (*rule)[method]
+		return false
+	})
+	if !allowed {
+		return r, false
+	}
+
+	if to, ok := f.rewrite[method]; ok {
+		method = to
+	}
+	if method == r.Method && override == "" {
+		return r, true
+	}
+	r = r.Clone(r.Context())
+	r.Method = method
+	if override != "" {
+		// The backend sees the effective method, not how it was tunnelled
+		r.Header.Del(f.override)
+	}
+	return r, true
+}
@@ -0,0 +1,60 @@
+package filter
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"google-redirector/config"
+)
+
+func TestMethodFilter_Apply(t *testing.T) {
+	f, err := NewMethodFilter(config.FromMap(map[string]string{
+		"METHOD_RULES":           "/=GET|HEAD, /api/=get|post, /api/upload=PUT",
+		"METHOD_OVERRIDE_HEADER": "X-HTTP-Method-Override",
+		"METHOD_REWRITE":         "PUT=POST",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method, path, override string
+		ok                     bool
+		proxied                string
+	}{
+		{"GET", "/index.html", "", true, "GET"},
+		{"POST", "/index.html", "", false, ""},
+		{"POST", "/api/tasks", "", true, "POST"},
+		{"DELETE", "/api/tasks", "", false, ""},
+		{"PUT", "/api/upload/1", "", true, "POST"},
+		{"POST", "/api/upload/1", "PUT", true, "POST"},
+		{"POST", "/api/tasks", "DELETE", false, ""},
+		{"POST", "/api/tasks", "GET", true, "GET"},
+		{"GET", "/api/tasks", "DELETE", true, "GET"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.override != "" {
+			r.Header.Set("X-HTTP-Method-Override", tt.override)
+		}
+		got, ok := f.Apply(r)
+		if ok != tt.ok {
+			t.Errorf("%s %s (override %q): expected allowed=%v", tt.method, tt.path, tt.override, tt.ok)
+			continue
+		}
+		if ok && got.Method != tt.proxied {
+			t.Errorf("%s %s (override %q): expected %s to be proxied, got %s", tt.method, tt.path, tt.override, tt.proxied, got.Method)
+		}
+		if ok && got.Header.Get("X-HTTP-Method-Override") != "" {
+			t.Errorf("%s %s: expected the override header to be removed", tt.method, tt.path)
+		}
+	}
+}
+
+func TestMethodFilter_Config(t *testing.T) {
+	if f, err := NewMethodFilter(config.FromMap(nil)); f != nil || err != nil {
+		t.Errorf("Expected no method filter by default, got %v (%v)", f, err)
+	}
+	if _, err := NewMethodFilter(config.FromMap(map[string]string{"METHOD_REWRITE": "PUT"})); err == nil {
+		t.Error("Expected an error for a rewrite without a target method")
+	}
+}
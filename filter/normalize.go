@@ -0,0 +1,161 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+
+	"google-redirector/config"
+)
+
+// Normalizer removes the ambiguities that let a request mean one thing to
+// the redirector and another to the backend, which is what request
+// smuggling and filter bypasses exploit. It either rejects such requests
+// or rewrites them into a single canonical form before any check sees them.
+// Absolute-form targets and encoded slashes are rejected either way, since
+// no rewrite of them is safe: the Host header could still name another
+// authority, and "%2F" is a literal slash to some backends and a separator
+// to others.
+//
+// Message framing is already covered by net/http: it refuses conflicting
+// Content-Length headers and unknown transfer codings, drops Content-Length
+// when the body is chunked, and the backend transport writes its own
+// framing. What remains is handled here:
+//   - absolute-form targets ("GET http://host/path"), whose authority
+//     silently replaces the Host header
+//   - paths with dot segments, empty segments, backslashes or encoded
+//     dots and backslashes, which backends resolve differently
+//   - repeated headers that should appear once
+//   - header names with underscores, which CGI-style backends fold onto
+//     their hyphenated twins
+//   - Connection tokens naming end-to-end headers, which the reverse
+//     proxy would otherwise strip after the redirector has added them
+type Normalizer struct {
+	reject bool
+	unique []string
+}
+
+// hopByHop are the Connection tokens with a legitimate hop-by-hop meaning.
+var hopByHop = map[string]bool{"close": true, "keep-alive": true, "upgrade": true, "te": true, "trailer": true}
+
+// NewNormalizer reads REQUEST_NORMALIZATION: off (the default),
+// canonicalize or reject. Rewriting requests is never turned on by
+// HARDENED_MODE, so a backend only sees altered paths and headers when
+// asked for. NORMALIZE_UNIQUE_HEADERS adds to the headers allowed only
+// once, as does VERIFICATION_HEADER.
+func NewNormalizer(cfg *config.Config) (*Normalizer, error) {
+	n := &Normalizer{}
+	switch mode := cfg.String("REQUEST_NORMALIZATION", "off"); mode {
+	case "off":
+		return nil, nil
+	case "canonicalize":
+	case "reject":
+		n.reject = true
+	default:
+		return nil, fmt.Errorf("invalid REQUEST_NORMALIZATION %q (expected off, canonicalize or reject)", mode)
+	}
+	unique := cfg.List("NORMALIZE_UNIQUE_HEADERS", "Authorization,Content-Type,Content-Encoding,Range,Expect,Upgrade")
+	if h := cfg.String("VERIFICATION_HEADER", ""); h != "" {
+		unique = append(unique, h)
+	}
+	for _, name := range unique {
+		n.unique = append(n.unique, http.CanonicalHeaderKey(name))
+	}
+	return n, nil
+}
+
+func (n *Normalizer) String() string {
+	mode := "canonicalize"
+	if n.reject {
+		mode = "reject"
+	}
+	return fmt.Sprintf("%s, unique %s", mode, strings.Join(n.unique, ","))
+}
+
+// Normalize returns why r is ambiguous when rejecting. Otherwise it
+// rewrites whatever is ambiguous in r and returns "".
+func (n *Normalizer) Normalize(r *http.Request) string {
+	if r.RequestURI != "*" && !strings.HasPrefix(r.RequestURI, "/") && r.Method != http.MethodConnect {
+		return "absolute-form request target"
+	}
+	if strings.Contains(strings.ToLower(r.URL.EscapedPath()), "%2f") {
+		return "encoded slash in path"
+	}
+
+	if ambiguousPath(r.URL.EscapedPath()) {
+		if n.reject {
+			return "ambiguous path"
+		}
+		p := strings.ReplaceAll(r.URL.Path, "\\", "/")
+		clean := path.Clean("/" + p)
+		if strings.HasSuffix(p, "/") && clean != "/" {
+			clean += "/"
+		}
+		r.URL.Path, r.URL.RawPath = clean, ""
+		r.RequestURI = r.URL.RequestURI()
+	}
+
+	for _, name := range n.unique {
+		if values := r.Header[name]; len(values) > 1 {
+			if n.reject {
+				return "duplicate " + name + " header"
+			}
+			r.Header[name] = values[:1]
+		}
+	}
+
+	for name := range r.Header {
+		if strings.Contains(name, "_") {
+			if n.reject {
+				return "underscore in header name " + name
+			}
+			delete(r.Header, name)
+		}
+	}
+
+	if values := r.Header.Values("Connection"); len(values) > 0 {
+		var keep []string
+		for _, v := range values {
+			for _, token := range strings.Split(v, ",") {
+				token = strings.TrimSpace(token)
+				if token == "" {
+					continue
+				}
+				if !hopByHop[strings.ToLower(token)] {
+					if n.reject {
+						return "Connection header naming " + token
+					}
+					continue
+				}
+				keep = append(keep, token)
+			}
+		}
+		if len(keep) == 0 {
+			r.Header.Del("Connection")
+		} else {
+			r.Header.Set("Connection", strings.Join(keep, ", "))
+		}
+	}
+	return ""
+}
+
+// ambiguousPath reports whether an escaped path could be resolved to
+// something else by the backend.
+func ambiguousPath(escaped string) bool {
+	if strings.Contains(escaped, "//") || strings.Contains(escaped, "\\") {
+		return true
+	}
+	lower := strings.ToLower(escaped)
+	for _, enc := range []string{"%2e", "%5c"} {
+		if strings.Contains(lower, enc) {
+			return true
+		}
+	}
+	for _, seg := range strings.Split(escaped, "/") {
+		if seg == "." || seg == ".." {
+			return true
+		}
+	}
+	return false
+}
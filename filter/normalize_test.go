@@ -0,0 +1,106 @@
+package filter
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google-redirector/config"
+)
+
+func TestNormalizer_Reject(t *testing.T) {
+	n, err := NewNormalizer(config.FromMap(map[string]string{
+		"REQUEST_NORMALIZATION": "reject",
+		"VERIFICATION_HEADER":   "X-Session-Id",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		target string
+		header http.Header
+		want   string
+	}{
+		{"/api/v1/beacon?x=1", http.Header{"Connection": {"keep-alive"}}, ""},
+		{"http://cdn.example.com/api", nil, "absolute-form request target"},
+		{"/static/../admin", nil, "ambiguous path"},
+		{"/static/%2e%2e/admin", nil, "ambiguous path"},
+		{"/api//beacon", nil, "ambiguous path"},
+		{"/api/a%2Fb", nil, "encoded slash in path"},
+		{"/", http.Header{"X-Session-Id": {"a", "b"}}, "duplicate X-Session-Id header"},
+		{"/", http.Header{"Authorization": {"Bearer a", "Bearer b"}}, "duplicate Authorization header"},
+		{"/", http.Header{"X_forwarded_for": {"10.0.0.1"}}, "underscore in header name X_forwarded_for"},
+		{"/", http.Header{"Connection": {"close, X-Session-Id"}}, "Connection header naming X-Session-Id"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		for name, values := range tt.header {
+			r.Header[name] = values
+		}
+		if got := n.Normalize(r); got != tt.want {
+			t.Errorf("%s %v: expected %q, got %q", tt.target, tt.header, tt.want, got)
+		}
+	}
+}
+
+func TestNormalizer_Canonicalize(t *testing.T) {
+	n, err := NewNormalizer(config.FromMap(map[string]string{"REQUEST_NORMALIZATION": "canonicalize"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct{ target, path, requestURI string }{
+		{"/static/../admin/", "/admin/", "/admin/"},
+		{"/static/%2e%2e/admin?q", "/admin", "/admin?q"},
+		{"/api//beacon", "/api/beacon", "/api/beacon"},
+		{"/a%5c..%5cb", "/b", "/b"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		if got := n.Normalize(r); got != "" {
+			t.Errorf("%s: expected no rejection when canonicalizing, got %q", tt.target, got)
+		}
+		if r.URL.Path != tt.path || r.RequestURI != tt.requestURI || r.Host != "example.com" {
+			t.Errorf("%s: expected path %q and target %q on example.com, got %q and %q on %s", tt.target, tt.path, tt.requestURI, r.URL.Path, r.RequestURI, r.Host)
+		}
+	}
+
+	// Some targets have no safe rewrite and are refused in this mode too
+	for target, want := range map[string]string{
+		"http://cdn.example.com/api?x=1": "absolute-form request target",
+		"/api/a%2Fb":                     "encoded slash in path",
+	} {
+		r := httptest.NewRequest("GET", target, nil)
+		if got := n.Normalize(r); got != want {
+			t.Errorf("%s: expected %q, got %q", target, want, got)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header["Authorization"] = []string{"Bearer a", "Bearer b"}
+	r.Header["X_forwarded_for"] = []string{"10.0.0.1"}
+	r.Header.Set("Connection", "Upgrade, X-Client-Envelope")
+	n.Normalize(r)
+	if got := r.Header["Authorization"]; len(got) != 1 || got[0] != "Bearer a" {
+		t.Errorf("Expected the first Authorization header to be kept, got %v", got)
+	}
+	if _, ok := r.Header["X_forwarded_for"]; ok {
+		t.Error("Expected the underscored header to be dropped")
+	}
+	if got := r.Header.Get("Connection"); got != "Upgrade" {
+		t.Errorf("Expected only hop-by-hop Connection tokens to remain, got %q", got)
+	}
+}
+
+func TestNormalizer_Config(t *testing.T) {
+	if n, err := NewNormalizer(config.FromMap(nil)); n != nil || err != nil {
+		t.Errorf("Expected no normalization by default, got %v (%v)", n, err)
+	}
+	if n, _ := NewNormalizer(config.FromMap(map[string]string{"HARDENED_MODE": "true"})); n != nil {
+		t.Error("Expected HARDENED_MODE not to turn on rewriting")
+	}
+	if _, err := NewNormalizer(config.FromMap(map[string]string{"REQUEST_NORMALIZATION": "strict"})); err == nil {
+		t.Error("Expected an error for an unknown mode")
+	}
+}
@@ -0,0 +1,121 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"google-redirector/config"
+)
+
+// QueryFilter gates routes on their query parameters and watches for canary
+// parameters. A canary is a parameter that only appears in URLs handed out
+// as bait (or left in a sample), so a request carrying one means the URL
+// has escaped, typically into an analyst's sandbox.
+type QueryFilter struct {
+	rules    routeTable[[]queryRule]
+	canaries []queryMatch
+}
+
+// queryRule requires (or with forbid, rules out) a match on every request
+// under its prefix.
+type queryRule struct {
+	forbid bool
+	queryMatch
+}
+
+// queryMatch is a parameter, with a specific value unless value is "".
+type queryMatch struct {
+	param string
+	value string
+}
+
+func (m queryMatch) matches(q url.Values) bool {
+	values, ok := q[m.param]
+	if !ok || m.value == "" {
+		return ok
+	}
+	for _, v := range values {
+		if v == m.value {
+			return true
+		}
+	}
+	return false
+}
+
+func (m queryMatch) String() string {
+	if m.value == "" {
+		return m.param
+	}
+	return m.param + "=" + m.value
+}
+
+func parseQueryMatch(s string) queryMatch {
+	param, value, _ := strings.Cut(strings.TrimSpace(s), "=")
+	return queryMatch{param: param, value: value}
+}
+
+// NewQueryFilter returns nil unless QUERY_RULES or QUERY_CANARIES is set.
+func NewQueryFilter(cfg *config.Config) (*QueryFilter, error) {
+	f := &QueryFilter{}
+	for _, entry := range cfg.List("QUERY_RULES", "") {
+		const syntax = "/prefix:[!]param[=value]"
+		prefix, match, err := splitRoute("QUERY_RULES", entry, ":", syntax)
+		if err != nil {
+			return nil, err
+		}
+		var rule queryRule
+		match, rule.forbid = strings.CutPrefix(match, "!")
+		if rule.queryMatch = parseQueryMatch(match); rule.param == "" {
+			return nil, fmt.Errorf("invalid QUERY_RULES entry %q (expected %s)", entry, syntax)
+		}
+		rules := f.rules.at(prefix)
+		*rules = append(*rules, rule)
+	}
+	f.rules.sort()
+	for _, entry := range cfg.List("QUERY_CANARIES", "") {
+		m := parseQueryMatch(entry)
+		if m.param == "" {
+			return nil, fmt.Errorf("invalid QUERY_CANARIES entry %q (expected param[=value])", entry)
+		}
+		f.canaries = append(f.canaries, m)
+	}
+	if f.rules.len() == 0 && len(f.canaries) == 0 {
+		return nil, nil
+	}
+	return f, nil
+}
+
+func (f *QueryFilter) String() string {
+	return fmt.Sprintf("%d routes, %d canaries", f.rules.len(), len(f.canaries))
+}
+
+// Canary returns the canary r carries, or "" if it carries none.
+func (f *QueryFilter) Canary(r *http.Request) string {
+	if len(f.canaries) == 0 {
+		return ""
+	}
+	q := r.URL.Query()
+	for _, c := range f.canaries {
+		if c.matches(q) {
+			return c.String()
+		}
+	}
+	return ""
+}
+
+// Allowed reports whether r satisfies every rule for its path.
+func (f *QueryFilter) Allowed(r *http.Request) bool {
+	q := r.URL.Query()
+	allowed := true
+	f.rules.each(r.URL.Path, func(rules *[]queryRule) bool {
+		for _, rule := range *rules {
+			if rule.matches(q) == rule.forbid {
+				allowed = false
+			}
+		}
+		return allowed
+	})
+	return allowed
+}
@@ -0,0 +1,65 @@
+package filter
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"google-redirector/config"
+)
+
+func TestQueryFilter_Allowed(t *testing.T) {
+	f, err := NewQueryFilter(config.FromMap(map[string]string{
+		"QUERY_RULES": "/dl/:id, /dl/:v=2, /api/:!debug, /api/:!mode=test",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		target string
+		ok     bool
+	}{
+		{"/dl/invoice.doc?id=7&v=2", true},
+		{"/dl/invoice.doc?id=7&v=1", false},
+		{"/dl/invoice.doc?v=2", false},
+		{"/dl/invoice.doc?id=&v=1&v=2", true},
+		{"/api/tasks", true},
+		{"/api/tasks?debug=0", false},
+		{"/api/tasks?mode=live", true},
+		{"/api/tasks?mode=test", false},
+		{"/other?debug=1", true},
+	}
+	for _, tt := range tests {
+		if got := f.Allowed(httptest.NewRequest("GET", tt.target, nil)); got != tt.ok {
+			t.Errorf("%s: expected allowed=%v", tt.target, tt.ok)
+		}
+	}
+}
+
+func TestQueryFilter_Canary(t *testing.T) {
+	f, err := NewQueryFilter(config.FromMap(map[string]string{"QUERY_CANARIES": "utm_term=q3-board, cid"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ target, want string }{
+		{"/dl/report.pdf?utm_term=q3-board", "utm_term=q3-board"},
+		{"/dl/report.pdf?utm_term=other", ""},
+		{"/?cid=", "cid"},
+		{"/", ""},
+	}
+	for _, tt := range tests {
+		if got := f.Canary(httptest.NewRequest("GET", tt.target, nil)); got != tt.want {
+			t.Errorf("%s: expected canary %q, got %q", tt.target, tt.want, got)
+		}
+	}
+}
+
+func TestQueryFilter_Config(t *testing.T) {
+	if f, err := NewQueryFilter(config.FromMap(nil)); f != nil || err != nil {
+		t.Errorf("Expected no query filter by default, got %v (%v)", f, err)
+	}
+	for _, rules := range []string{"/dl/:!", "/dl/:=x"} {
+		if _, err := NewQueryFilter(config.FromMap(map[string]string{"QUERY_RULES": rules})); err == nil {
+			t.Errorf("%q: expected configuration error", rules)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"google-redirector/clientip"
+	"google-redirector/config"
+)
+
+// Redirects answers matching requests with a redirect of its own, without
+// contacting the backend, so the redirector can also hand out short links
+// and bounce lure clicks on to their landing pages.
+//
+// A rule is "status match target". match is an optional host (a leading
+// "*." matches any subdomain), a path pattern and an optional ?query of
+// param or param=value terms that must all be present. Path segments
+// written {name} capture one segment and a final {name*} the rest of the
+// path. target may use the captures along with {host}, {path}, {query} and
+// {?query} (the raw query with its "?", or nothing):
+//
+//	302 go.example.com/l/{id} https://portal.example.com/login?c={id}
+//	301 /old/{rest*} https://www.example.com/{rest}{?query}
+//	307 /dl/?src=mail /files/invoice.doc
+type Redirects struct {
+	rules []redirectRule
+}
+
+type redirectRule struct {
+	status   int
+	host     string
+	segments []string
+	query    []queryMatch
+	target   string
+}
+
+var redirectStatuses = map[int]bool{301: true, 302: true, 303: true, 307: true, 308: true}
+
+// NewRedirects returns nil unless REDIRECT_RULES (comma-separated) or
+// REDIRECT_RULES_FILE (one rule per line, # comments) holds a rule. Rules
+// are tried in order, inline ones first.
+func NewRedirects(cfg *config.Config) (*Redirects, error) {
+	d := &Redirects{}
+	for _, entry := range cfg.List("REDIRECT_RULES", "") {
+		rule, err := parseRedirectRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("REDIRECT_RULES: %v", err)
+		}
+		d.rules = append(d.rules, rule)
+	}
+	if file := cfg.String("REDIRECT_RULES_FILE", ""); file != "" {
+		f, err := os.Open(file)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			entry := scanner.Text()
+			if i := strings.IndexByte(entry, '#'); i >= 0 {
+				entry = entry[:i]
+			}
+			if strings.TrimSpace(entry) == "" {
+				continue
+			}
+			rule, err := parseRedirectRule(entry)
+			if err != nil {
+				return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+			}
+			d.rules = append(d.rules, rule)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if len(d.rules) == 0 {
+		return nil, nil
+	}
+	return d, nil
+}
+
+func parseRedirectRule(entry string) (redirectRule, error) {
+	var rule redirectRule
+	fields := strings.Fields(entry)
+	if len(fields) != 3 {
+		return rule, fmt.Errorf("invalid rule %q (expected \"status match target\")", entry)
+	}
+	status, err := strconv.Atoi(fields[0])
+	if err != nil || !redirectStatuses[status] {
+		return rule, fmt.Errorf("invalid redirect status %q (expected 301, 302, 303, 307 or 308)", fields[0])
+	}
+	rule.status, rule.target = status, fields[2]
+
+	match, query, _ := strings.Cut(fields[1], "?")
+	slash := strings.IndexByte(match, '/')
+	if slash < 0 {
+		return rule, fmt.Errorf("invalid match %q (expected [host]/path)", fields[1])
+	}
+	rule.host = strings.ToLower(match[:slash])
+	rule.segments = strings.Split(match[slash+1:], "/")
+	for i, seg := range rule.segments {
+		if strings.HasSuffix(seg, "*}") && i != len(rule.segments)-1 {
+			return rule, fmt.Errorf("invalid match %q: %s must be the last segment", fields[1], seg)
+		}
+	}
+	for _, term := range strings.Split(query, "&") {
+		if term != "" {
+			rule.query = append(rule.query, parseQueryMatch(term))
+		}
+	}
+	return rule, nil
+}
+
+func (d *Redirects) String() string {
+	return fmt.Sprintf("%d rules", len(d.rules))
+}
+
+// match returns the rule's captures, or false if r doesn't match it.
+func (rule *redirectRule) match(r *http.Request) (map[string]string, bool) {
+	if rule.host != "" {
+		host := strings.ToLower(r.Host)
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if suffix, wildcard := strings.CutPrefix(rule.host, "*"); wildcard {
+			if !strings.HasSuffix(host, suffix) {
+				return nil, false
+			}
+		} else if host != rule.host {
+			return nil, false
+		}
+	}
+
+	captures := make(map[string]string)
+	path := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	for i, seg := range rule.segments {
+		if name, ok := strings.CutSuffix(seg, "*}"); ok && strings.HasPrefix(name, "{") {
+			if i > len(path) {
+				return nil, false
+			}
+			captures[name[1:]] = strings.Join(path[i:], "/")
+			path = path[:i]
+			break
+		}
+		if i >= len(path) {
+			return nil, false
+		}
+		if strings.HasPrefix(seg, "{") && strings.HasSuffix(seg, "}") {
+			if path[i] == "" {
+				return nil, false
+			}
+			captures[seg[1:len(seg)-1]] = path[i]
+		} else if seg != path[i] {
+			return nil, false
+		}
+	}
+	if len(path) > len(rule.segments) {
+		return nil, false
+	}
+
+	q := r.URL.Query()
+	for _, m := range rule.query {
+		if !m.matches(q) {
+			return nil, false
+		}
+	}
+	return captures, true
+}
+
+// Serve redirects r if a rule matches it, reporting whether it did.
+func (d *Redirects) Serve(w http.ResponseWriter, r *http.Request) bool {
+	for i := range d.rules {
+		rule := &d.rules[i]
+		captures, ok := rule.match(r)
+		if !ok {
+			continue
+		}
+		pairs := []string{"{host}", r.Host, "{path}", r.URL.EscapedPath(), "{query}", r.URL.RawQuery, "{?query}", ""}
+		if r.URL.RawQuery != "" {
+			pairs[7] = "?" + r.URL.RawQuery
+		}
+		for name, value := range captures {
+			pairs = append(pairs, "{"+name+"}", value)
+		}
+		location := strings.NewReplacer(pairs...).Replace(rule.target)
+
+		log.Printf("Redirecting %s %s from %s to %s (%d)", r.Method, r.URL.Path, clientip.From(r), location, rule.status)
+		w.Header().Set("Location", location)
+		w.WriteHeader(rule.status)
+		return true
+	}
+	return false
+}
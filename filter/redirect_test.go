@@ -0,0 +1,62 @@
+package filter
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"google-redirector/config"
+)
+
+func TestRedirects_Serve(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "links")
+	os.WriteFile(file, []byte("# short links\n301 /old/{rest*} https://www.example.com/{rest}{?query}\n"), 0o600)
+	d, err := NewRedirects(config.FromMap(map[string]string{
+		"REDIRECT_RULES":      "302 go.example.com/l/{id} https://portal.example.com/login?c={id}, 307 *.example.net/dl/?src=mail /files/invoice.doc",
+		"REDIRECT_RULES_FILE": file,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host, target string
+		status       int
+		location     string
+	}{
+		{"go.example.com", "/l/abc123", 302, "https://portal.example.com/login?c=abc123"},
+		{"GO.example.com:443", "/l/abc123", 302, "https://portal.example.com/login?c=abc123"},
+		{"other.example.com", "/l/abc123", 0, ""},
+		{"go.example.com", "/l/abc123/more", 0, ""},
+		{"go.example.com", "/l/", 0, ""},
+		{"cdn.example.net", "/dl/?src=mail&x=1", 307, "/files/invoice.doc"},
+		{"cdn.example.net", "/dl/?src=web", 0, ""},
+		{"any.host", "/old/a/b%20c?x=1", 301, "https://www.example.com/a/b%20c?x=1"},
+		{"any.host", "/old/", 301, "https://www.example.com/"},
+		{"any.host", "/older", 0, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.target, nil)
+		r.Host = tt.host
+		rec := httptest.NewRecorder()
+		served := d.Serve(rec, r)
+		if served != (tt.status != 0) {
+			t.Errorf("%s%s: expected served=%v", tt.host, tt.target, tt.status != 0)
+			continue
+		}
+		if served && (rec.Code != tt.status || rec.Header().Get("Location") != tt.location) {
+			t.Errorf("%s%s: expected %d to %s, got %d to %s", tt.host, tt.target, tt.status, tt.location, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+}
+
+func TestRedirects_Config(t *testing.T) {
+	if d, err := NewRedirects(config.FromMap(nil)); d != nil || err != nil {
+		t.Errorf("Expected no redirects by default, got %v (%v)", d, err)
+	}
+	for _, rules := range []string{"200 /a /b", "302 nohost /b", "302 /a/{x*}/b /c", "302 /a"} {
+		if _, err := NewRedirects(config.FromMap(map[string]string{"REDIRECT_RULES": rules})); err == nil {
+			t.Errorf("%q: expected configuration error", rules)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package filter
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"google-redirector/config"
+)
+
+// RefererGate only lets requests through to a route when they were linked
+// from an expected page, so a payload URL followed from the phishing flow
+// works while the same URL pasted into a sandbox gets the decoy.
+//
+// Browsers send the full referring URL only to the same origin. Under the
+// default strict-origin-when-cross-origin policy a link from another site
+// carries just its origin ("https://portal.example.com/"), so an exact
+// cross-origin rule must name the origin rather than the page.
+type RefererGate struct {
+	routes routeTable[refererRoute]
+}
+
+// refererRoute accepts a Referer equal to one of exact or fully matching
+// one of patterns.
+type refererRoute struct {
+	exact    map[string]bool
+	patterns []*regexp.Regexp
+}
+
+// NewRefererGate returns nil unless REFERER_RULES has at least one
+// /prefix=referer entry. Entries are separated by whitespace rather than
+// commas, which regular expressions use in repetitions like {2,8}; a
+// Referer never contains a literal space, and patterns can use \s. A
+// referer starting with ~ is a regular expression the whole header must
+// match; several entries for a prefix are alternatives.
+func NewRefererGate(cfg *config.Config) (*RefererGate, error) {
+	entries := strings.Fields(cfg.String("REFERER_RULES", ""))
+	if len(entries) == 0 {
+		return nil, nil
+	}
+	g := &RefererGate{}
+	for _, entry := range entries {
+		prefix, referer, err := splitRoute("REFERER_RULES", entry, "=", "/prefix=referer or /prefix=~regex")
+		if err != nil {
+			return nil, err
+		}
+		route := g.routes.at(prefix)
+		if route.exact == nil {
+			route.exact = make(map[string]bool)
+		}
+		if expr, isPattern := strings.CutPrefix(referer, "~"); isPattern {
+			re, err := regexp.Compile("^(?:" + expr + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid REFERER_RULES pattern %q: %v", expr, err)
+			}
+			route.patterns = append(route.patterns, re)
+		} else {
+			route.exact[referer] = true
+		}
+	}
+	g.routes.sort()
+	return g, nil
+}
+
+func (g *RefererGate) String() string {
+	return strings.Join(g.routes.prefixes(), ", ")
+}
+
+// Allowed reports whether r's Referer is acceptable for its route. Routes
+// without a rule accept anything.
+func (g *RefererGate) Allowed(r *http.Request) bool {
+	allowed := true
+	g.routes.each(r.URL.Path, func(route *refererRoute) bool {
+		referer := r.Referer()
+		allowed = route.exact[referer]
+		for _, re := range route.patterns {
+			allowed = allowed || re.MatchString(referer)
+		}
+		return false
+	})
+	return allowed
+}
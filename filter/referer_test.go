@@ -0,0 +1,50 @@
+package filter
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"google-redirector/config"
+)
+
+func TestRefererGate_Allowed(t *testing.T) {
+	g, err := NewRefererGate(config.FromMap(map[string]string{
+		"REFERER_RULES": `/dl/=https://portal.example.com/login /dl/=~https://[a-z]{2,16}\.example\.com/share/.*
+			/dl/public/=~.*`,
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		path, referer string
+		ok            bool
+	}{
+		{"/dl/invoice.doc", "https://portal.example.com/login", true},
+		{"/dl/invoice.doc", "https://portal.example.com/login?next=1", false},
+		{"/dl/invoice.doc", "https://files.example.com/share/abc", true},
+		{"/dl/invoice.doc", "https://files.example.com.evil.test/share/abc", false},
+		{"/dl/invoice.doc", "", false},
+		{"/dl/public/logo.png", "", true},
+		{"/index.html", "", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.path, nil)
+		if tt.referer != "" {
+			r.Header.Set("Referer", tt.referer)
+		}
+		if got := g.Allowed(r); got != tt.ok {
+			t.Errorf("%s from %q: expected allowed=%v", tt.path, tt.referer, tt.ok)
+		}
+	}
+}
+
+func TestRefererGate_Config(t *testing.T) {
+	if g, err := NewRefererGate(config.FromMap(nil)); g != nil || err != nil {
+		t.Errorf("Expected no Referer gate by default, got %v (%v)", g, err)
+	}
+	for _, rules := range []string{"/dl/=~("} {
+		if _, err := NewRefererGate(config.FromMap(map[string]string{"REFERER_RULES": rules})); err == nil {
+			t.Errorf("%q: expected configuration error", rules)
+		}
+	}
+}
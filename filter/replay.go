@@ -0,0 +1,294 @@
+package filter
+
+import (
+	"bufio"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google-redirector/cluster"
+	"google-redirector/config"
+	"google-redirector/store"
+)
+
+// ReplayGuard refuses requests that reuse a nonce (or signature) seen within
+// REPLAY_WINDOW, so a captured request can't simply be sent again. Nonces
+// are remembered as SHA-256 hashes in an LRU of REPLAY_CACHE_SIZE entries.
+// An evicted nonce could be replayed, unless REPLAY_TIMESTAMP_HEADER is
+// also required, which bounds how old an acceptable request can be.
+type ReplayGuard struct {
+	header    string
+	tsHeader  string
+	window    time.Duration
+	capacity  int
+	stateFile string
+	interval  time.Duration // between saves to stateFile
+	store     *store.Store
+	cluster   *cluster.Node
+
+	mu      sync.Mutex
+	order   *list.List // of *replayEntry, most recent at the front
+	entries map[[sha256.Size]byte]*list.Element
+	dirty   bool
+	pending []store.Nonce // added since the last save, when there is a store
+}
+
+type replayEntry struct {
+	key     [sha256.Size]byte
+	expires time.Time
+}
+
+// NewReplayGuard returns nil unless REPLAY_NONCE_HEADER is set. With
+// REPLAY_STATE_FILE the cache is loaded at start and saved by Save, which
+// Start calls every REPLAY_SAVE_INTERVAL.
+func NewReplayGuard(cfg *config.Config) (*ReplayGuard, error) {
+	header := cfg.String("REPLAY_NONCE_HEADER", "")
+	if header == "" {
+		return nil, nil
+	}
+	g := &ReplayGuard{
+		header:    header,
+		tsHeader:  cfg.String("REPLAY_TIMESTAMP_HEADER", ""),
+		window:    cfg.Duration("REPLAY_WINDOW", 10*time.Minute),
+		capacity:  cfg.Int("REPLAY_CACHE_SIZE", 100000),
+		stateFile: cfg.String("REPLAY_STATE_FILE", ""),
+		interval:  cfg.Duration("REPLAY_SAVE_INTERVAL", 30*time.Second),
+		order:     list.New(),
+		entries:   make(map[[sha256.Size]byte]*list.Element),
+	}
+	if g.window <= 0 || g.capacity <= 0 {
+		return nil, fmt.Errorf("REPLAY_WINDOW and REPLAY_CACHE_SIZE must be positive")
+	}
+	if g.stateFile != "" {
+		if err := g.load(time.Now()); err != nil && !os.IsNotExist(err) {
+			return nil, fmt.Errorf("loading REPLAY_STATE_FILE: %v", err)
+		}
+	}
+	return g, nil
+}
+
+// Start saves the cache to REPLAY_STATE_FILE every REPLAY_SAVE_INTERVAL
+// until ctx is cancelled.
+func (g *ReplayGuard) Start(ctx context.Context) {
+	if g.stateFile == "" || g.interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(g.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				g.Save()
+			}
+		}
+	}()
+}
+
+func (g *ReplayGuard) String() string {
+	s := fmt.Sprintf("%s within %v, %d entries", g.header, g.window, g.capacity)
+	if g.tsHeader != "" {
+		s += ", timestamp " + g.tsHeader
+	}
+	return s
+}
+
+// Check records r's nonce and returns why r is refused, or "" if it is
+// fresh.
+func (g *ReplayGuard) Check(r *http.Request, now time.Time) string {
+	nonce := strings.TrimSpace(r.Header.Get(g.header))
+	if nonce == "" {
+		return "missing nonce"
+	}
+	if g.tsHeader != "" {
+		sec, err := strconv.ParseInt(strings.TrimSpace(r.Header.Get(g.tsHeader)), 10, 64)
+		if err != nil {
+			return "missing or malformed timestamp"
+		}
+		if age := now.Sub(time.Unix(sec, 0)); age > g.window || age < -g.window {
+			return "stale timestamp"
+		}
+	}
+	key := sha256.Sum256([]byte(nonce))
+	if !g.remember(key, now) {
+		return "replayed nonce"
+	}
+	if g.cluster != nil {
+		g.cluster.Publish(cluster.Event{Kind: "nonce", Key: hex.EncodeToString(key[:]), Expires: now.Add(g.window).Unix()})
+	}
+	return ""
+}
+
+// remember adds key, reporting false if it was already there and unexpired.
+func (g *ReplayGuard) remember(key [sha256.Size]byte, now time.Time) bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if el, ok := g.entries[key]; ok {
+		if now.Before(el.Value.(*replayEntry).expires) {
+			return false
+		}
+		g.order.Remove(el)
+		delete(g.entries, key)
+	}
+	g.entries[key] = g.order.PushFront(&replayEntry{key: key, expires: now.Add(g.window)})
+	g.dirty = true
+	if g.store != nil {
+		g.pending = append(g.pending, store.Nonce{Hash: key[:], Expires: now.Add(g.window)})
+	}
+
+	// Entries share one window, so the back of the list expires first
+	for g.order.Len() > g.capacity || g.order.Len() > 0 && !now.Before(g.order.Back().Value.(*replayEntry).expires) {
+		oldest := g.order.Remove(g.order.Back()).(*replayEntry)
+		delete(g.entries, oldest.key)
+	}
+	return true
+}
+
+// UseCluster shares the nonces seen here with the other nodes of c and
+// remembers theirs.
+func (g *ReplayGuard) UseCluster(c *cluster.Node) {
+	g.cluster = c
+	c.Subscribe("nonce", func(e cluster.Event) error {
+		var key [sha256.Size]byte
+		if raw, err := hex.DecodeString(e.Key); err != nil || copy(key[:], raw) != sha256.Size {
+			return nil
+		}
+		g.learn(key, time.Unix(e.Expires, 0))
+		return nil
+	})
+}
+
+// learn adds a nonce seen elsewhere, with its expiry there but no later
+// than REPLAY_WINDOW from now.
+func (g *ReplayGuard) learn(key [sha256.Size]byte, expires time.Time) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	if !now.Before(expires) {
+		return
+	}
+	if latest := now.Add(g.window); expires.After(latest) {
+		expires = latest
+	}
+	if el, ok := g.entries[key]; ok {
+		g.order.Remove(el)
+	}
+	g.entries[key] = g.order.PushFront(&replayEntry{key: key, expires: expires})
+	g.dirty = true
+	if g.store != nil {
+		g.pending = append(g.pending, store.Nonce{Hash: key[:], Expires: expires})
+	}
+	for g.order.Len() > g.capacity {
+		delete(g.entries, g.order.Remove(g.order.Back()).(*replayEntry).key)
+	}
+}
+
+// load reads the "expiry-unix-seconds hex-hash" lines written by Save.
+func (g *ReplayGuard) load(now time.Time) error {
+	f, err := os.Open(g.stateFile)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		expiry, hash, _ := strings.Cut(scanner.Text(), " ")
+		sec, err1 := strconv.ParseInt(expiry, 10, 64)
+		raw, err2 := hex.DecodeString(hash)
+		if err1 != nil || err2 != nil || len(raw) != sha256.Size {
+			return fmt.Errorf("%s:%d: malformed entry", g.stateFile, line)
+		}
+		expires := time.Unix(sec, 0)
+		if !now.Before(expires) || g.order.Len() >= g.capacity {
+			continue
+		}
+		var key [sha256.Size]byte
+		copy(key[:], raw)
+		// Save writes the most recent entries first
+		g.entries[key] = g.order.PushBack(&replayEntry{key: key, expires: expires})
+	}
+	return scanner.Err()
+}
+
+// UseStore loads the nonces remembered in s and has Save add new ones to
+// it on every flush of s.
+func (g *ReplayGuard) UseStore(s *store.Store) error {
+	nonces, err := s.Nonces(time.Now())
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	// Nonces come soonest to expire first, so each goes to the front
+	for _, n := range nonces {
+		var key [sha256.Size]byte
+		if copy(key[:], n.Hash) != sha256.Size {
+			continue
+		}
+		if el, ok := g.entries[key]; ok {
+			g.order.Remove(el)
+		}
+		g.entries[key] = g.order.PushFront(&replayEntry{key: key, expires: n.Expires})
+	}
+	for g.order.Len() > g.capacity {
+		delete(g.entries, g.order.Remove(g.order.Back()).(*replayEntry).key)
+	}
+	g.store = s
+	g.mu.Unlock()
+
+	s.OnFlush(g.Save)
+	return nil
+}
+
+// Save writes the cache to REPLAY_STATE_FILE and the store if it changed
+// since the last save. It is a no-op with neither.
+func (g *ReplayGuard) Save() {
+	g.mu.Lock()
+	if !g.dirty {
+		g.mu.Unlock()
+		return
+	}
+	var b strings.Builder
+	if g.stateFile != "" {
+		for el := g.order.Front(); el != nil; el = el.Next() {
+			e := el.Value.(*replayEntry)
+			fmt.Fprintf(&b, "%d %s\n", e.expires.Unix(), hex.EncodeToString(e.key[:]))
+		}
+	}
+	pending := g.pending
+	g.pending = nil
+	g.dirty = false
+	g.mu.Unlock()
+
+	if g.store != nil {
+		if err := g.store.SaveNonces(pending, time.Now()); err != nil {
+			log.Printf("Saving replay cache failed: %v", err)
+		}
+	}
+	if g.stateFile == "" {
+		return
+	}
+
+	tmp := g.stateFile + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o600); err != nil {
+		log.Printf("Saving replay cache failed: %v", err)
+		return
+	}
+	if err := os.Rename(tmp, g.stateFile); err != nil {
+		log.Printf("Saving replay cache failed: %v", err)
+	}
+}
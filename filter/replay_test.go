@@ -0,0 +1,178 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google-redirector/cluster"
+	"google-redirector/config"
+	"google-redirector/store"
+)
+
+func TestReplayGuard_Check(t *testing.T) {
+	g, err := NewReplayGuard(config.FromMap(map[string]string{
+		"REPLAY_NONCE_HEADER": "X-Nonce",
+		"REPLAY_WINDOW":       "1m",
+		"REPLAY_CACHE_SIZE":   "2",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	check := func(nonce string, at time.Time) string {
+		r := httptest.NewRequest("GET", "/", nil)
+		if nonce != "" {
+			r.Header.Set("X-Nonce", nonce)
+		}
+		return g.Check(r, at)
+	}
+
+	tests := []struct {
+		nonce string
+		at    time.Time
+		want  string
+	}{
+		{"", now, "missing nonce"},
+		{"a", now, ""},
+		{"a", now.Add(30 * time.Second), "replayed nonce"},
+		{"b", now.Add(30 * time.Second), ""},
+		{"a", now.Add(time.Minute), ""}, // expired
+		{"c", now.Add(time.Minute), ""}, // evicts b
+		{"b", now.Add(time.Minute), ""},
+		{"c", now.Add(time.Minute), "replayed nonce"},
+	}
+	for i, tt := range tests {
+		if got := check(tt.nonce, tt.at); got != tt.want {
+			t.Errorf("case %d (%q): expected %q, got %q", i, tt.nonce, tt.want, got)
+		}
+	}
+}
+
+func TestReplayGuard_Timestamp(t *testing.T) {
+	g, _ := NewReplayGuard(config.FromMap(map[string]string{
+		"REPLAY_NONCE_HEADER":     "X-Nonce",
+		"REPLAY_TIMESTAMP_HEADER": "X-Timestamp",
+		"REPLAY_WINDOW":           "1m",
+	}))
+	now := time.Unix(1_700_000_000, 0)
+
+	tests := []struct {
+		timestamp string
+		want      string
+	}{
+		{"", "missing or malformed timestamp"},
+		{"soon", "missing or malformed timestamp"},
+		{strconv.FormatInt(now.Unix()-30, 10), ""},
+		{strconv.FormatInt(now.Unix()+30, 10), ""},
+		{strconv.FormatInt(now.Unix()-120, 10), "stale timestamp"},
+		{strconv.FormatInt(now.Unix()+120, 10), "stale timestamp"},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("X-Nonce", "n"+strconv.Itoa(i))
+		r.Header.Set("X-Timestamp", tt.timestamp)
+		if got := g.Check(r, now); got != tt.want {
+			t.Errorf("case %d (%q): expected %q, got %q", i, tt.timestamp, tt.want, got)
+		}
+	}
+}
+
+func TestReplayGuard_StateFile(t *testing.T) {
+	cfg := config.FromMap(map[string]string{
+		"REPLAY_NONCE_HEADER":  "X-Nonce",
+		"REPLAY_STATE_FILE":    filepath.Join(t.TempDir(), "nonces"),
+		"REPLAY_SAVE_INTERVAL": "0",
+	})
+	g, err := NewReplayGuard(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Nonce", "seen-before-restart")
+	if got := g.Check(r, time.Now()); got != "" {
+		t.Fatalf("Expected a fresh nonce to pass, got %q", got)
+	}
+	g.Save()
+
+	restarted, err := NewReplayGuard(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.Check(r, time.Now()); got != "replayed nonce" {
+		t.Errorf("Expected the nonce to be remembered across restarts, got %q", got)
+	}
+}
+
+func TestReplayGuard_UseStore(t *testing.T) {
+	cfg := config.FromMap(map[string]string{
+		"REPLAY_NONCE_HEADER":  "X-Nonce",
+		"STATE_DB":             filepath.Join(t.TempDir(), "state.db"),
+		"STATE_FLUSH_INTERVAL": "1h",
+	})
+	s, err := store.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, _ := NewReplayGuard(cfg)
+	if err := g.UseStore(s); err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Nonce", "seen-before-restart")
+	g.Check(r, time.Now())
+	s.Close() // flushes through Save
+
+	s, _ = store.New(cfg)
+	defer s.Close()
+	restarted, _ := NewReplayGuard(cfg)
+	if err := restarted.UseStore(s); err != nil {
+		t.Fatal(err)
+	}
+	if got := restarted.Check(r, time.Now()); got != "replayed nonce" {
+		t.Errorf("Expected the nonce to be remembered across restarts, got %q", got)
+	}
+}
+
+func TestReplayGuard_UseCluster(t *testing.T) {
+	cfg := config.FromMap(map[string]string{
+		"REPLAY_NONCE_HEADER": "X-Nonce",
+		"ADMIN_TOKEN":         "0123456789abcdef",
+		"CLUSTER_PEERS":       "http://unused.invalid",
+	})
+	g, _ := NewReplayGuard(cfg)
+	node, _ := cluster.New(cfg)
+	g.UseCluster(node)
+
+	// A nonce used at a peer arrives through the cluster endpoint
+	sum := sha256.Sum256([]byte("used-elsewhere"))
+	body := `[{"kind":"nonce","key":"` + hex.EncodeToString(sum[:]) + `","expires":` + strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10) + `}]`
+	w := httptest.NewRecorder()
+	node.ServeHTTP(w, httptest.NewRequest("POST", "/_admin/cluster", strings.NewReader(body)))
+	if w.Code != 204 {
+		t.Fatalf("Expected the events to be accepted, got %d", w.Code)
+	}
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Nonce", "used-elsewhere")
+	if got := g.Check(r, time.Now()); got != "replayed nonce" {
+		t.Errorf("Expected a nonce used at a peer to be refused, got %q", got)
+	}
+}
+
+func TestReplayGuard_Config(t *testing.T) {
+	if g, err := NewReplayGuard(config.FromMap(nil)); g != nil || err != nil {
+		t.Errorf("Expected no replay protection by default, got %v (%v)", g, err)
+	}
+	if _, err := NewReplayGuard(config.FromMap(map[string]string{
+		"REPLAY_NONCE_HEADER": "X-Nonce",
+		"REPLAY_CACHE_SIZE":   "0",
+	})); err == nil {
+		t.Error("Expected an error for a zero cache size")
+	}
+}
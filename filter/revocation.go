@@ -0,0 +1,301 @@
+package filter
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+
+	"google-redirector/cluster"
+	"google-redirector/config"
+)
+
+// Revocation kinds. Each names one way an implant identifies itself.
+const (
+	RevokeCert   = "cert"   // SHA-256 fingerprint of the client certificate
+	RevokeToken  = "token"  // value of VERIFICATION_HEADER
+	RevokeCookie = "cookie" // value of the REVOCATION_COOKIE cookie
+)
+
+// Revocations cuts off individual implant identities. It is checked on
+// every request and can be changed while the redirector runs, through the
+// admin API or by editing REVOCATION_FILE and sending SIGHUP.
+type Revocations struct {
+	file    string
+	header  string
+	cookie  string
+	cluster *cluster.Node
+
+	mu      sync.RWMutex
+	entries map[string]map[string]bool // kind -> value
+}
+
+// NewRevocations returns nil unless REVOCATION_FILE or ADMIN_TOKEN is set;
+// without either there would be no way to revoke anything. Tokens are read
+// from the header named by VERIFICATION_HEADER.
+func NewRevocations(cfg *config.Config) (*Revocations, error) {
+	v := &Revocations{
+		file:   cfg.String("REVOCATION_FILE", ""),
+		header: cfg.String("VERIFICATION_HEADER", ""),
+		cookie: cfg.String("REVOCATION_COOKIE", ""),
+	}
+	if v.file == "" && cfg.String("ADMIN_TOKEN", "") == "" {
+		return nil, nil
+	}
+	v.entries = newRevocationSet()
+	if v.file != "" {
+		if err := v.reload(); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, fmt.Errorf("loading REVOCATION_FILE: %v", err)
+		}
+		v.reloadOnSIGHUP()
+	}
+	return v, nil
+}
+
+func newRevocationSet() map[string]map[string]bool {
+	return map[string]map[string]bool{RevokeCert: {}, RevokeToken: {}, RevokeCookie: {}}
+}
+
+func (v *Revocations) String() string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	return fmt.Sprintf("%d certs, %d tokens, %d cookies",
+		len(v.entries[RevokeCert]), len(v.entries[RevokeToken]), len(v.entries[RevokeCookie]))
+}
+
+// normalize validates value for kind and returns its canonical form.
+func normalize(kind, value string) (string, error) {
+	value = strings.TrimSpace(value)
+	switch kind {
+	case RevokeCert:
+		value = strings.ToLower(strings.ReplaceAll(value, ":", ""))
+		if b, err := hex.DecodeString(value); err != nil || len(b) != sha256.Size {
+			return "", fmt.Errorf("not a SHA-256 fingerprint: %q", value)
+		}
+	case RevokeToken, RevokeCookie:
+		if value == "" {
+			return "", fmt.Errorf("empty %s", kind)
+		}
+	default:
+		return "", fmt.Errorf("unknown revocation kind %q (expected cert, token or cookie)", kind)
+	}
+	return value, nil
+}
+
+// reload replaces the entries with REVOCATION_FILE, which holds one
+// "kind value" pair per line; # starts a comment.
+func (v *Revocations) reload() error {
+	f, err := os.Open(v.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	entries := newRevocationSet()
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if i := strings.IndexByte(entry, '#'); i >= 0 {
+			entry = entry[:i]
+		}
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		kind, value, _ := strings.Cut(strings.TrimSpace(entry), " ")
+		value, err := normalize(kind, value)
+		if err != nil {
+			return fmt.Errorf("%s:%d: %v", v.file, line, err)
+		}
+		entries[kind][value] = true
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	v.mu.Lock()
+	v.entries = entries
+	v.mu.Unlock()
+	return nil
+}
+
+func (v *Revocations) reloadOnSIGHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			if err := v.reload(); err != nil {
+				log.Printf("Revocation list reload failed, keeping previous list: %v", err)
+			}
+		}
+	}()
+}
+
+// save writes the entries back to REVOCATION_FILE, if there is one, so
+// revocations made through the admin API survive a restart. v.mu must be
+// held.
+func (v *Revocations) save() error {
+	if v.file == "" {
+		return nil
+	}
+	var b strings.Builder
+	b.WriteString("# Managed by the redirector admin API\n")
+	for _, kind := range []string{RevokeCert, RevokeToken, RevokeCookie} {
+		for _, value := range sortedKeys(v.entries[kind]) {
+			fmt.Fprintf(&b, "%s %s\n", kind, value)
+		}
+	}
+	tmp := v.file + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.file)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// errNotSaved wraps failures to write REVOCATION_FILE, after which the
+// change has been undone.
+var errNotSaved = errors.New("revocation list not saved")
+
+// Add revokes value. If REVOCATION_FILE can't be written the revocation is
+// undone, so it never applies without surviving a restart.
+func (v *Revocations) Add(kind, value string) error {
+	return v.change(kind, value, true, true)
+}
+
+// Remove reinstates value, or with an unwritable REVOCATION_FILE keeps it
+// revoked, as Add does.
+func (v *Revocations) Remove(kind, value string) error {
+	return v.change(kind, value, false, true)
+}
+
+// UseCluster shares changes made through Add and Remove with the other
+// nodes of c and applies theirs. REVOCATION_FILE edits stay local.
+func (v *Revocations) UseCluster(c *cluster.Node) {
+	v.cluster = c
+	c.Subscribe("revocation", func(e cluster.Event) error {
+		err := v.change(e.Key, e.Value, !e.Deleted, false)
+		if err != nil && !errors.Is(err, errNotSaved) {
+			log.Printf("Ignoring revocation from cluster peer: %v", err)
+			return nil
+		}
+		return err
+	})
+}
+
+func (v *Revocations) change(kind, value string, revoke, publish bool) error {
+	value, err := normalize(kind, value)
+	if err != nil {
+		return err
+	}
+	v.mu.Lock()
+	was := v.entries[kind][value]
+	set := func(revoked bool) {
+		if revoked {
+			v.entries[kind][value] = true
+		} else {
+			delete(v.entries[kind], value)
+		}
+	}
+	set(revoke)
+	if err = v.save(); err != nil {
+		set(was)
+		err = fmt.Errorf("%w: %v", errNotSaved, err)
+	}
+	v.mu.Unlock()
+
+	if err == nil && publish && v.cluster != nil {
+		v.cluster.Publish(cluster.Event{Kind: "revocation", Key: kind, Value: value, Deleted: !revoke})
+	}
+	return err
+}
+
+// Revoked returns the kind of identity r presented that has been revoked,
+// or "" if none has.
+func (v *Revocations) Revoked(r *http.Request) string {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+
+	if r.TLS != nil && len(r.TLS.PeerCertificates) > 0 && len(v.entries[RevokeCert]) > 0 {
+		sum := sha256.Sum256(r.TLS.PeerCertificates[0].Raw)
+		if v.entries[RevokeCert][hex.EncodeToString(sum[:])] {
+			return RevokeCert
+		}
+	}
+	if v.header != "" {
+		for _, token := range r.Header.Values(v.header) {
+			if v.entries[RevokeToken][strings.TrimSpace(token)] {
+				return RevokeToken
+			}
+		}
+	}
+	if v.cookie != "" {
+		for _, c := range r.Cookies() {
+			if c.Name == v.cookie && v.entries[RevokeCookie][c.Value] {
+				return RevokeCookie
+			}
+		}
+	}
+	return ""
+}
+
+// ServeHTTP is the admin API endpoint: GET lists the entries, POST adds
+// and DELETE removes one given as {"kind": ..., "value": ...}.
+func (v *Revocations) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		v.mu.RLock()
+		list := make(map[string][]string)
+		for kind, values := range v.entries {
+			list[kind] = sortedKeys(values)
+		}
+		v.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+
+	case http.MethodPost, http.MethodDelete:
+		var entry struct {
+			Kind  string `json:"kind"`
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&entry); err != nil {
+			http.Error(w, "invalid JSON body", http.StatusBadRequest)
+			return
+		}
+		change, verb := v.Add, "Revoked"
+		if r.Method == http.MethodDelete {
+			change, verb = v.Remove, "Reinstated"
+		}
+		if err := change(entry.Kind, entry.Value); errors.Is(err, errNotSaved) {
+			log.Printf("Revocation change via admin API failed: %v", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("%s %s %s via admin API", verb, entry.Kind, entry.Value)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
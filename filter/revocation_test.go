@@ -0,0 +1,159 @@
+package filter
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"google-redirector/cluster"
+	"google-redirector/config"
+)
+
+func TestRevocations_Revoked(t *testing.T) {
+	cert := []byte("not really DER, but fingerprinted all the same")
+	sum := sha256.Sum256(cert)
+	fingerprint := hex.EncodeToString(sum[:])
+
+	file := filepath.Join(t.TempDir(), "revoked")
+	os.WriteFile(file, []byte("# burned 2026-10-01\ntoken abc\ncookie implant-7\ncert "+strings.ToUpper(fingerprint)+"\n"), 0o600)
+	v, err := NewRevocations(config.FromMap(map[string]string{
+		"REVOCATION_FILE":     file,
+		"VERIFICATION_HEADER": "X-Session-Id",
+		"REVOCATION_COOKIE":   "sid",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		setup func(r *http.Request)
+		want  string
+	}{
+		{func(r *http.Request) { r.Header.Set("X-Session-Id", "abc") }, RevokeToken},
+		{func(r *http.Request) { r.Header.Set("X-Session-Id", "def") }, ""},
+		{func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "sid", Value: "implant-7"}) }, RevokeCookie},
+		{func(r *http.Request) { r.AddCookie(&http.Cookie{Name: "other", Value: "implant-7"}) }, ""},
+		{func(r *http.Request) {
+			r.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: cert}}}
+		}, RevokeCert},
+	}
+	for i, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		tt.setup(r)
+		if got := v.Revoked(r); got != tt.want {
+			t.Errorf("case %d: expected %q, got %q", i, tt.want, got)
+		}
+	}
+}
+
+func TestRevocations_Config(t *testing.T) {
+	if v, err := NewRevocations(config.FromMap(nil)); v != nil || err != nil {
+		t.Errorf("Expected no revocation list by default, got %v (%v)", v, err)
+	}
+	file := filepath.Join(t.TempDir(), "revoked")
+	os.WriteFile(file, []byte("cert 1234\n"), 0o600)
+	if _, err := NewRevocations(config.FromMap(map[string]string{"REVOCATION_FILE": file})); err == nil {
+		t.Errorf("Expected a malformed fingerprint to be rejected")
+	}
+}
+
+func TestRevocations_API(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "revoked")
+	v, err := NewRevocations(config.FromMap(map[string]string{
+		"REVOCATION_FILE":     file,
+		"VERIFICATION_HEADER": "X-Session-Id",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	call := func(method, body string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		v.ServeHTTP(rec, httptest.NewRequest(method, "/_admin/revocations", strings.NewReader(body)))
+		return rec
+	}
+	beacon := httptest.NewRequest("GET", "/", nil)
+	beacon.Header.Set("X-Session-Id", "abc")
+
+	if rec := call("POST", `{"kind":"token","value":"abc"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected revocation to succeed, got %d %s", rec.Code, rec.Body)
+	}
+	if v.Revoked(beacon) != RevokeToken {
+		t.Errorf("Expected the token to be revoked immediately")
+	}
+	if saved, _ := os.ReadFile(file); !strings.Contains(string(saved), "token abc\n") {
+		t.Errorf("Expected the revocation to be saved, got %q", saved)
+	}
+	if rec := call("GET", ""); !strings.Contains(rec.Body.String(), `"token":["abc"]`) {
+		t.Errorf("Expected the list to include the token, got %s", rec.Body)
+	}
+	if rec := call("POST", `{"kind":"implant","value":"abc"}`); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected unknown kind to be refused, got %d", rec.Code)
+	}
+	if rec := call("DELETE", `{"kind":"token","value":"abc"}`); rec.Code != http.StatusNoContent {
+		t.Fatalf("Expected reinstatement to succeed, got %d %s", rec.Code, rec.Body)
+	}
+	if v.Revoked(beacon) != "" {
+		t.Errorf("Expected the token to be reinstated")
+	}
+}
+
+func TestRevocations_SaveFailure(t *testing.T) {
+	// The directory doesn't exist, so the list can't be written
+	v, err := NewRevocations(config.FromMap(map[string]string{
+		"REVOCATION_FILE":     filepath.Join(t.TempDir(), "missing", "revoked"),
+		"VERIFICATION_HEADER": "X-Session-Id",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	v.ServeHTTP(rec, httptest.NewRequest("POST", "/_admin/revocations", strings.NewReader(`{"kind":"token","value":"abc"}`)))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Expected a save failure to be reported, got %d", rec.Code)
+	}
+	beacon := httptest.NewRequest("GET", "/", nil)
+	beacon.Header.Set("X-Session-Id", "abc")
+	if v.Revoked(beacon) != "" {
+		t.Errorf("Expected an unsaved revocation to be undone")
+	}
+}
+
+func TestRevocations_UseCluster(t *testing.T) {
+	cfg := config.FromMap(map[string]string{
+		"ADMIN_TOKEN":         "0123456789abcdef",
+		"CLUSTER_PEERS":       "http://unused.invalid",
+		"VERIFICATION_HEADER": "X-Session-Id",
+	})
+	local, _ := NewRevocations(cfg)
+	remote, _ := NewRevocations(cfg)
+	remoteNode, _ := cluster.New(cfg)
+	remote.UseCluster(remoteNode)
+	server := httptest.NewServer(remoteNode)
+	defer server.Close()
+
+	localNode, _ := cluster.New(config.FromMap(map[string]string{
+		"ADMIN_TOKEN":   "0123456789abcdef",
+		"CLUSTER_PEERS": server.URL,
+	}))
+	local.UseCluster(localNode)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Session-Id", "implant-7")
+	local.Add(RevokeToken, "implant-7")
+	localNode.Flush()
+	if got := remote.Revoked(r); got != RevokeToken {
+		t.Errorf("Expected the revocation to reach the peer, got %q", got)
+	}
+	local.Remove(RevokeToken, "implant-7")
+	localNode.Flush()
+	if got := remote.Revoked(r); got != "" {
+		t.Errorf("Expected the reinstatement to reach the peer, got %q", got)
+	}
+}
@@ -0,0 +1,70 @@
+package filter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// routeTable holds per-route rules keyed by path prefix, the shape shared by
+// METHOD_RULES, QUERY_RULES, REFERER_RULES and RESPONSE_DELAYS. Each of
+// their entries is "/prefix", a separator and a value (see splitRoute), and
+// entries for the same prefix add to one rule.
+type routeTable[T any] struct {
+	routes []route[T] // longest prefix first, once sorted
+}
+
+type route[T any] struct {
+	prefix string
+	rule   T
+}
+
+// splitRoute splits an entry of the setting name at the first sep. syntax
+// describes a whole entry for the error when there's no prefix or value.
+func splitRoute(name, entry, sep, syntax string) (prefix, value string, err error) {
+	prefix, value, ok := strings.Cut(entry, sep)
+	if !ok || !strings.HasPrefix(prefix, "/") || value == "" {
+		return "", "", fmt.Errorf("invalid %s entry %q (expected %s)", name, entry, syntax)
+	}
+	return prefix, value, nil
+}
+
+// at returns the rule for prefix, adding a zero one the first time. The
+// pointer is only good until the next call.
+func (t *routeTable[T]) at(prefix string) *T {
+	for i := range t.routes {
+		if t.routes[i].prefix == prefix {
+			return &t.routes[i].rule
+		}
+	}
+	t.routes = append(t.routes, route[T]{prefix: prefix})
+	return &t.routes[len(t.routes)-1].rule
+}
+
+// sort puts the routes longest prefix first, so each visits the most
+// specific route first. It is called once every entry has been added.
+func (t *routeTable[T]) sort() {
+	sort.SliceStable(t.routes, func(i, j int) bool { return len(t.routes[i].prefix) > len(t.routes[j].prefix) })
+}
+
+// each calls fn with the rule of every route whose prefix path starts with,
+// longest prefix first, until fn returns false.
+func (t *routeTable[T]) each(path string, fn func(rule *T) bool) {
+	for i := range t.routes {
+		if strings.HasPrefix(path, t.routes[i].prefix) && !fn(&t.routes[i].rule) {
+			return
+		}
+	}
+}
+
+func (t *routeTable[T]) len() int {
+	return len(t.routes)
+}
+
+func (t *routeTable[T]) prefixes() []string {
+	prefixes := make([]string, len(t.routes))
+	for i, r := range t.routes {
+		prefixes[i] = r.prefix
+	}
+	return prefixes
+}
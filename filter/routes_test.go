@@ -0,0 +1,63 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitRoute(t *testing.T) {
+	tests := []struct {
+		entry, sep    string
+		prefix, value string
+		ok            bool
+	}{
+		{"/api/=GET", "=", "/api/", "GET", true},
+		{"/dl/:id=7", ":", "/dl/", "id=7", true},
+		{"/=a=b", "=", "/", "a=b", true},
+		{"api=GET", "=", "", "", false},
+		{"/api=", "=", "", "", false},
+		{"/api", "=", "", "", false},
+	}
+	for _, tt := range tests {
+		prefix, value, err := splitRoute("RULES", tt.entry, tt.sep, "/prefix=value")
+		if (err == nil) != tt.ok || prefix != tt.prefix || value != tt.value {
+			t.Errorf("%q: expected %q, %q (ok=%v), got %q, %q (%v)", tt.entry, tt.prefix, tt.value, tt.ok, prefix, value, err)
+		}
+	}
+}
+
+func TestRouteTable_Each(t *testing.T) {
+	var table routeTable[[]string]
+	for _, entry := range []string{"/=root", "/api/upload=upload", "/api/=api", "/=fallback"} {
+		prefix, value, _ := splitRoute("RULES", entry, "=", "/prefix=value")
+		rule := table.at(prefix)
+		*rule = append(*rule, value)
+	}
+	table.sort()
+	if got := table.prefixes(); !reflect.DeepEqual(got, []string{"/api/upload", "/api/", "/"}) {
+		t.Errorf("Expected one route per prefix, longest first, got %q", got)
+	}
+
+	tests := []struct {
+		path  string
+		limit int
+		want  []string
+	}{
+		{"/api/upload/1", 0, []string{"upload", "api", "root", "fallback"}},
+		{"/api/upload/1", 1, []string{"upload"}},
+		{"/api/tasks", 0, []string{"api", "root", "fallback"}},
+		{"/index.html", 0, []string{"root", "fallback"}},
+	}
+	for _, tt := range tests {
+		var got []string
+		visited := 0
+		table.each(tt.path, func(rule *[]string) bool {
+			got = append(got, *rule...)
+			visited++
+			return visited != tt.limit
+		})
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s (limit %d): expected %q, got %q", tt.path, tt.limit, tt.want, got)
+		}
+	}
+}
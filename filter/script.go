@@ -0,0 +1,249 @@
+package filter
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
+	"google-redirector/clientip"
+	"google-redirector/config"
+	"google-redirector/proxy"
+)
+
+// RouteScript runs a Lua function for every request to decide whether to
+// allow, deny, route or rewrite it, so per-engagement logic doesn't need a
+// rebuild. The script defines route(req), where req has method, path,
+// query, host, ip and headers (lower-case names), and returns either nil
+// (allow), an action string, or a table:
+//
+//	function route(req)
+//	  if req.headers["user-agent"]:find("curl") then return "deny" end
+//	  if req.path:sub(1, 5) == "/api/" then
+//	    return {action = "route", backend = "api.example.com"}
+//	  end
+//	  return {action = "rewrite", path = "/beacon", headers = {["X-Op"] = "blue"}}
+//	end
+//
+// Backends named in route decisions must be in BACKEND_URLS. Scripts run in
+// a sandbox with only the base, string, table and math libraries and no way
+// to load files.
+type RouteScript struct {
+	file     string
+	proto    *lua.FunctionProto
+	timeout  time.Duration
+	failOpen bool
+	pool     *proxy.Pool
+	states   sync.Pool
+}
+
+type routeDecision struct {
+	action  string // allow, deny, route or rewrite
+	backend *proxy.Backend
+	path    string
+	query   *string
+	headers map[string]string
+}
+
+// NewRouteScript returns nil unless ROUTE_SCRIPT names a Lua file. Route
+// decisions pick backends from pool.
+func NewRouteScript(cfg *config.Config, pool *proxy.Pool) (*RouteScript, error) {
+	file := cfg.String("ROUTE_SCRIPT", "")
+	if file == "" {
+		return nil, nil
+	}
+	src, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	chunk, err := parse.Parse(strings.NewReader(string(src)), file)
+	if err != nil {
+		return nil, err
+	}
+	proto, err := lua.Compile(chunk, file)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &RouteScript{
+		file:    file,
+		proto:   proto,
+		timeout: cfg.Duration("ROUTE_SCRIPT_TIMEOUT", 50*time.Millisecond),
+		pool:    pool,
+	}
+	switch mode := cfg.String("ROUTE_SCRIPT_ON_ERROR", "deny"); mode {
+	case "deny":
+	case "allow":
+		s.failOpen = true
+	default:
+		return nil, fmt.Errorf("invalid ROUTE_SCRIPT_ON_ERROR %q (expected deny or allow)", mode)
+	}
+
+	// Surface script errors at startup rather than on the first request
+	L, err := s.newState()
+	if err != nil {
+		return nil, err
+	}
+	s.states.Put(L)
+	return s, nil
+}
+
+func (s *RouteScript) newState() (*lua.LState, error) {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	for _, name := range []string{"dofile", "loadfile", "load", "loadstring"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+
+	L.Push(L.NewFunctionFromProto(s.proto))
+	if err := L.PCall(0, 0, nil); err != nil {
+		L.Close()
+		return nil, err
+	}
+	if L.GetGlobal("route").Type() != lua.LTFunction {
+		L.Close()
+		return nil, fmt.Errorf("%s does not define route(req)", s.file)
+	}
+	return L, nil
+}
+
+// decide runs route(req) on a pooled interpreter; LStates aren't safe for
+// concurrent use, so each call borrows one.
+func (s *RouteScript) decide(r *http.Request) (*routeDecision, error) {
+	L, _ := s.states.Get().(*lua.LState)
+	if L == nil {
+		var err error
+		if L, err = s.newState(); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+	defer cancel()
+	L.SetContext(ctx)
+	err := L.CallByParam(lua.P{Fn: L.GetGlobal("route"), NRet: 1, Protect: true}, s.requestTable(L, r))
+	L.RemoveContext()
+	if err != nil {
+		// A script interrupted mid-run may have left globals half-updated
+		L.Close()
+		return nil, err
+	}
+	ret := L.Get(-1)
+	L.Pop(1)
+	s.states.Put(L)
+	return s.decision(ret)
+}
+
+func (s *RouteScript) requestTable(L *lua.LState, r *http.Request) *lua.LTable {
+	req := L.NewTable()
+	req.RawSetString("method", lua.LString(r.Method))
+	req.RawSetString("path", lua.LString(r.URL.Path))
+	req.RawSetString("query", lua.LString(r.URL.RawQuery))
+	req.RawSetString("host", lua.LString(r.Host))
+	req.RawSetString("ip", lua.LString(clientip.From(r)))
+	headers := L.NewTable()
+	for name, values := range r.Header {
+		headers.RawSetString(strings.ToLower(name), lua.LString(strings.Join(values, ", ")))
+	}
+	req.RawSetString("headers", headers)
+	return req
+}
+
+func (s *RouteScript) decision(ret lua.LValue) (*routeDecision, error) {
+	d := &routeDecision{action: "allow"}
+	switch v := ret.(type) {
+	case *lua.LNilType:
+		return d, nil
+	case lua.LString:
+		d.action = string(v)
+	case *lua.LTable:
+		if action := v.RawGetString("action"); action != lua.LNil {
+			d.action = action.String()
+		}
+		if backend := v.RawGetString("backend"); backend != lua.LNil {
+			b, ok := s.pool.Lookup(backend.String())
+			if !ok {
+				return nil, fmt.Errorf("route to unknown backend %q", backend.String())
+			}
+			d.backend = b
+		}
+		if path := v.RawGetString("path"); path != lua.LNil {
+			d.path = path.String()
+		}
+		if query := v.RawGetString("query"); query != lua.LNil {
+			q := query.String()
+			d.query = &q
+		}
+		if headers, ok := v.RawGetString("headers").(*lua.LTable); ok {
+			d.headers = make(map[string]string)
+			headers.ForEach(func(k, v lua.LValue) { d.headers[k.String()] = v.String() })
+		}
+	default:
+		return nil, fmt.Errorf("route returned a %s", ret.Type())
+	}
+
+	switch d.action {
+	case "allow", "deny", "rewrite":
+	case "route":
+		if d.backend == nil {
+			return nil, fmt.Errorf("route decision without a backend")
+		}
+	default:
+		return nil, fmt.Errorf("unknown action %q", d.action)
+	}
+	return d, nil
+}
+
+func (s *RouteScript) String() string {
+	return fmt.Sprintf("%s (timeout %v)", s.file, s.timeout)
+}
+
+// Apply runs the script for r and returns the request to continue with, or
+// false if it should be refused.
+func (s *RouteScript) Apply(r *http.Request) (*http.Request, bool) {
+	d, err := s.decide(r)
+	if err != nil {
+		log.Printf("Route script failed for %s %s from %s: %v", r.Method, r.URL.Path, clientip.From(r), err)
+		return r, s.failOpen
+	}
+	if d.action == "deny" {
+		log.Printf("Route script denied %s %s from %s", r.Method, r.URL.Path, clientip.From(r))
+		return r, false
+	}
+
+	if d.path != "" {
+		r.URL.Path, r.URL.RawPath = d.path, ""
+	}
+	if d.query != nil {
+		r.URL.RawQuery = *d.query
+	}
+	for name, value := range d.headers {
+		if value == "" {
+			r.Header.Del(name)
+		} else {
+			r.Header.Set(name, value)
+		}
+	}
+	if d.backend != nil {
+		r = proxy.WithBackend(r, d.backend)
+	}
+	return r, true
+}
@@ -0,0 +1,98 @@
+package filter
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google-redirector/config"
+	"google-redirector/proxy"
+)
+
+const testRouteScript = `
+function route(req)
+  if req.headers["user-agent"] == "curl/8.0" then return "deny" end
+  if req.path == "/api" then
+    return {action = "route", backend = "https://b.example.com"}
+  end
+  if req.path == "/old" then
+    return {action = "rewrite", path = "/new", headers = {["X-Op"] = "blue"}}
+  end
+  if req.path == "/spin" then
+    while true do end
+  end
+end
+`
+
+func loadTestRouteScript(t *testing.T, src string) *RouteScript {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "route.lua")
+	os.WriteFile(file, []byte(src), 0600)
+	t.Setenv("ROUTE_SCRIPT", file)
+	t.Setenv("ROUTE_SCRIPT_TIMEOUT", "20ms")
+	t.Setenv("BACKEND_URLS", "https://a.example.com,https://b.example.com")
+	pool, err := proxy.NewPool(config.FromEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewRouteScript(config.FromEnv(), pool)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	return s
+}
+
+func TestRouteScript_Decisions(t *testing.T) {
+	s := loadTestRouteScript(t, testRouteScript)
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("User-Agent", "curl/8.0")
+	if _, ok := s.Apply(req); ok {
+		t.Errorf("Expected curl to be denied")
+	}
+
+	req, ok := s.Apply(httptest.NewRequest("GET", "/api", nil))
+	if !ok || s.pool.PickFor(req).URL.Host != "b.example.com" {
+		t.Errorf("Expected /api to be routed to b.example.com")
+	}
+
+	req, ok = s.Apply(httptest.NewRequest("GET", "/old", nil))
+	if !ok || req.URL.Path != "/new" || req.Header.Get("X-Op") != "blue" {
+		t.Errorf("Expected /old to be rewritten, got %s %v", req.URL.Path, req.Header)
+	}
+
+	if _, ok := s.Apply(httptest.NewRequest("GET", "/other", nil)); !ok {
+		t.Errorf("Expected nil result to allow the request")
+	}
+}
+
+func TestRouteScript_Timeout(t *testing.T) {
+	s := loadTestRouteScript(t, testRouteScript)
+
+	start := time.Now()
+	if _, ok := s.Apply(httptest.NewRequest("GET", "/spin", nil)); ok {
+		t.Errorf("Expected runaway script to fail closed")
+	}
+	if time.Since(start) > time.Second {
+		t.Errorf("Expected script to be interrupted after its timeout")
+	}
+	if _, ok := s.Apply(httptest.NewRequest("GET", "/other", nil)); !ok {
+		t.Errorf("Expected script to keep working after a timeout")
+	}
+}
+
+func TestRouteScript_Invalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "route.lua")
+	os.WriteFile(file, []byte(`function nope() end`), 0600)
+	t.Setenv("ROUTE_SCRIPT", file)
+	if _, err := NewRouteScript(config.FromEnv(), &proxy.Pool{}); err == nil {
+		t.Errorf("Expected script without route() to fail")
+	}
+
+	os.WriteFile(file, []byte(`dofile("/etc/passwd")`), 0600)
+	if _, err := NewRouteScript(config.FromEnv(), &proxy.Pool{}); err == nil {
+		t.Errorf("Expected dofile to be unavailable")
+	}
+}
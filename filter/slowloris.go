@@ -0,0 +1,313 @@
+package filter
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google-redirector/clientip"
+	"google-redirector/cluster"
+	"google-redirector/config"
+	"google-redirector/store"
+)
+
+// SlowlorisGuard defends the listener against clients that open connections
+// and then trickle (or never send) their request. It enforces a deadline for
+// the first byte, caps header counts, and temporarily bans peers that keep
+// getting cut off by those limits or by the server's ReadHeaderTimeout.
+type SlowlorisGuard struct {
+	headerTimeout time.Duration
+	firstByte     time.Duration
+	maxHeaders    int
+	bans          *banList
+}
+
+// NewSlowlorisGuard always returns a guard: ReadHeaderTimeout applies to
+// every deployment, while the other defenses default to on in HARDENED_MODE.
+// clientip.TrustedHops must be set first.
+func NewSlowlorisGuard(cfg *config.Config) *SlowlorisGuard {
+	hardened := cfg.Bool("HARDENED_MODE", false)
+
+	g := &SlowlorisGuard{
+		headerTimeout: cfg.Duration("SERVER_READ_HEADER_TIMEOUT", 10*time.Second),
+	}
+
+	var firstByte time.Duration
+	maxHeaders, threshold := 0, 0
+	if hardened {
+		firstByte, maxHeaders, threshold = 5*time.Second, 100, 5
+	}
+	g.firstByte = cfg.Duration("SLOWLORIS_FIRST_BYTE_TIMEOUT", firstByte)
+	g.maxHeaders = cfg.Int("MAX_HEADER_COUNT", maxHeaders)
+
+	// Behind a proxy every connection comes from the proxy itself, so banning
+	// by peer address would lock out all clients.
+	if threshold = cfg.Int("SLOWLORIS_BAN_THRESHOLD", threshold); threshold > 0 && clientip.TrustedHops == 0 {
+		g.bans = newBanList(threshold,
+			cfg.Duration("SLOWLORIS_BAN_WINDOW", 10*time.Minute),
+			cfg.Duration("SLOWLORIS_BAN_DURATION", 30*time.Minute))
+	}
+	return g
+}
+
+// UseStore loads the bans in force from s and records new ones there. It
+// does nothing when bans are off.
+func (g *SlowlorisGuard) UseStore(s *store.Store) error {
+	if g.bans == nil {
+		return nil
+	}
+	bans, err := s.Bans(time.Now())
+	if err != nil {
+		return err
+	}
+	g.bans.mu.Lock()
+	defer g.bans.mu.Unlock()
+	for ip, until := range bans {
+		g.bans.bans[ip] = until
+	}
+	g.bans.store = s
+	return nil
+}
+
+// UseCluster shares bans with the other nodes of c. It does nothing when
+// bans are off.
+func (g *SlowlorisGuard) UseCluster(c *cluster.Node) {
+	if g.bans == nil {
+		return
+	}
+	g.bans.mu.Lock()
+	g.bans.cluster = c
+	g.bans.mu.Unlock()
+	c.Subscribe("ban", func(e cluster.Event) error {
+		if net.ParseIP(e.Key) != nil {
+			g.bans.ban(e.Key, time.Unix(e.Expires, 0))
+		}
+		return nil
+	})
+}
+
+// TooManyHeaders reports whether r exceeds the header count limit.
+func (g *SlowlorisGuard) TooManyHeaders(r *http.Request) bool {
+	if g.maxHeaders <= 0 {
+		return false
+	}
+	count := 0
+	for _, values := range r.Header {
+		count += len(values)
+	}
+	return count > g.maxHeaders
+}
+
+// Listener wraps ln so banned peers are dropped on accept and new
+// connections are subject to the first-byte deadline.
+func (g *SlowlorisGuard) Listener(ln net.Listener) net.Listener {
+	return &slowlorisListener{Listener: ln, guard: g}
+}
+
+// ConnState is installed as http.Server.ConnState. A connection that closes
+// without ever carrying a request, after living long enough to hit the
+// header timeout, was cut off half-open and counts as a strike.
+func (g *SlowlorisGuard) ConnState(c net.Conn, state http.ConnState) {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	sc, ok := c.(*slowConn)
+	if !ok {
+		return
+	}
+	switch state {
+	case http.StateActive:
+		sc.active.Store(true)
+	case http.StateClosed:
+		if !sc.active.Load() && time.Since(sc.accepted) >= g.headerTimeout {
+			g.strike(sc)
+		}
+	}
+}
+
+// HeaderTimeout is the http.Server ReadHeaderTimeout the guard expects.
+func (g *SlowlorisGuard) HeaderTimeout() time.Duration {
+	return g.headerTimeout
+}
+
+// Active reports whether any defense beyond the header timeout is on.
+func (g *SlowlorisGuard) Active() bool {
+	return g.firstByte > 0 || g.bans != nil
+}
+
+func (g *SlowlorisGuard) String() string {
+	return fmt.Sprintf("first byte %v, header timeout %v, bans %v", g.firstByte, g.headerTimeout, g.bans != nil)
+}
+
+func (g *SlowlorisGuard) strike(sc *slowConn) {
+	if g.bans == nil || sc.struck.Swap(true) {
+		return
+	}
+	if g.bans.strike(sc.ip) {
+		log.Printf("Slowloris: banning %s for %v after repeated half-open requests", sc.ip, g.bans.duration)
+	}
+}
+
+type slowlorisListener struct {
+	net.Listener
+	guard *SlowlorisGuard
+}
+
+func (l *slowlorisListener) Accept() (net.Conn, error) {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		ip, _, _ := net.SplitHostPort(c.RemoteAddr().String())
+		if l.guard.bans != nil && l.guard.bans.banned(ip) {
+			c.Close()
+			continue
+		}
+
+		sc := &slowConn{Conn: c, ip: ip, accepted: time.Now()}
+		if l.guard.firstByte > 0 {
+			sc.timer = time.AfterFunc(l.guard.firstByte, func() {
+				if !sc.gotByte.Load() {
+					l.guard.strike(sc)
+					sc.Close()
+				}
+			})
+		}
+		return sc, nil
+	}
+}
+
+// slowConn records when a connection was accepted and whether it ever
+// delivered data or a complete request.
+type slowConn struct {
+	net.Conn
+	ip       string
+	accepted time.Time
+	timer    *time.Timer
+	gotByte  atomic.Bool
+	active   atomic.Bool
+	struck   atomic.Bool
+}
+
+func (c *slowConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 && !c.gotByte.Swap(true) && c.timer != nil {
+		c.timer.Stop()
+	}
+	return n, err
+}
+
+// banList counts strikes per client within a sliding window and bans clients
+// that reach the threshold for a fixed duration.
+type banList struct {
+	threshold int
+	window    time.Duration
+	duration  time.Duration
+
+	store   *store.Store  // bans are saved there when set
+	cluster *cluster.Node // and shared when set
+
+	mu        sync.Mutex
+	strikes   map[string][]time.Time
+	bans      map[string]time.Time
+	lastPrune time.Time
+}
+
+func newBanList(threshold int, window, duration time.Duration) *banList {
+	return &banList{
+		threshold: threshold,
+		window:    window,
+		duration:  duration,
+		strikes:   make(map[string][]time.Time),
+		bans:      make(map[string]time.Time),
+	}
+}
+
+// strike records an offence and reports whether it triggered a new ban.
+func (b *banList) strike(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if now.Sub(b.lastPrune) >= time.Minute {
+		b.prune(now)
+	}
+	recent := b.strikes[ip][:0]
+	for _, t := range b.strikes[ip] {
+		if now.Sub(t) < b.window {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+
+	if len(recent) < b.threshold {
+		b.strikes[ip] = recent
+		return false
+	}
+	delete(b.strikes, ip)
+	b.bans[ip] = now.Add(b.duration)
+	if b.store != nil {
+		b.store.Ban(ip, b.bans[ip])
+	}
+	if b.cluster != nil {
+		b.cluster.Publish(cluster.Event{Kind: "ban", Key: ip, Expires: b.bans[ip].Unix()})
+	}
+	return true
+}
+
+// prune drops strike lists whose latest strike has left the window and
+// bans that have expired, so clients that never reach the threshold don't
+// accumulate. b.mu must be held.
+func (b *banList) prune(now time.Time) {
+	b.lastPrune = now
+	for ip, strikes := range b.strikes {
+		if len(strikes) == 0 || now.Sub(strikes[len(strikes)-1]) >= b.window {
+			delete(b.strikes, ip)
+		}
+	}
+	for ip, until := range b.bans {
+		if !now.Before(until) {
+			delete(b.bans, ip)
+		}
+	}
+}
+
+// ban applies a ban made elsewhere, keeping the later expiry but no more
+// than the ban duration from now.
+func (b *banList) ban(ip string, until time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	if latest := now.Add(b.duration); until.After(latest) {
+		until = latest
+	}
+	if !until.After(now) || !until.After(b.bans[ip]) {
+		return
+	}
+	b.bans[ip] = until
+	if b.store != nil {
+		b.store.Ban(ip, until)
+	}
+}
+
+func (b *banList) banned(ip string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	until, ok := b.bans[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(b.bans, ip)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,154 @@
+package filter
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"google-redirector/cluster"
+	"google-redirector/config"
+	"google-redirector/store"
+)
+
+func TestSlowloris_FirstByteTimeoutBans(t *testing.T) {
+	guard := &SlowlorisGuard{
+		headerTimeout: time.Second,
+		firstByte:     50 * time.Millisecond,
+		bans:          newBanList(2, time.Minute, time.Minute),
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{
+		Handler:           http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}),
+		ReadHeaderTimeout: guard.headerTimeout,
+		ConnState:         guard.ConnState,
+	}
+	go server.Serve(guard.Listener(ln))
+	defer server.Close()
+
+	// Two idle connections get cut off and earn the peer a ban
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatal("Expected idle connection to be closed")
+		}
+		conn.Close()
+	}
+
+	if !guard.bans.banned("127.0.0.1") {
+		t.Fatal("Expected peer to be banned after repeated half-open connections")
+	}
+}
+
+func TestSlowloris_TooManyHeaders(t *testing.T) {
+	guard := &SlowlorisGuard{maxHeaders: 3}
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Add("A", "1")
+	req.Header.Add("A", "2")
+	req.Header.Add("B", "3")
+	if guard.TooManyHeaders(req) {
+		t.Error("Expected 3 headers to be allowed")
+	}
+	req.Header.Add("C", "4")
+	if !guard.TooManyHeaders(req) {
+		t.Error("Expected 4 headers to be rejected")
+	}
+}
+
+func TestBanList_Expires(t *testing.T) {
+	bans := newBanList(1, time.Minute, 10*time.Millisecond)
+	if !bans.strike("192.0.2.1") || !bans.banned("192.0.2.1") {
+		t.Fatal("Expected single strike to ban with threshold 1")
+	}
+	time.Sleep(20 * time.Millisecond)
+	if bans.banned("192.0.2.1") {
+		t.Error("Expected ban to expire")
+	}
+}
+
+func TestBanList_PrunesStaleStrikes(t *testing.T) {
+	bans := newBanList(3, time.Minute, time.Minute)
+	bans.strike("192.0.2.1")
+	bans.strike("192.0.2.2")
+
+	bans.mu.Lock()
+	bans.prune(time.Now().Add(30 * time.Second))
+	if len(bans.strikes) != 2 {
+		t.Errorf("Expected strikes within the window to be kept, %d left", len(bans.strikes))
+	}
+	bans.prune(time.Now().Add(time.Minute))
+	if len(bans.strikes) != 0 {
+		t.Errorf("Expected strikes older than the window to be pruned, %d left", len(bans.strikes))
+	}
+	bans.mu.Unlock()
+}
+
+func TestSlowloris_UseStore(t *testing.T) {
+	cfg := config.FromMap(map[string]string{
+		"SLOWLORIS_BAN_THRESHOLD": "1",
+		"STATE_DB":                filepath.Join(t.TempDir(), "state.db"),
+	})
+	s, err := store.New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guard := NewSlowlorisGuard(cfg)
+	if err := guard.UseStore(s); err != nil {
+		t.Fatal(err)
+	}
+	guard.bans.strike("192.0.2.1")
+	s.Close()
+
+	s, _ = store.New(cfg)
+	defer s.Close()
+	restarted := NewSlowlorisGuard(cfg)
+	if err := restarted.UseStore(s); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.bans.banned("192.0.2.1") {
+		t.Error("Expected the ban to survive a restart")
+	}
+}
+
+func TestSlowloris_UseCluster(t *testing.T) {
+	cfg := config.FromMap(map[string]string{
+		"SLOWLORIS_BAN_THRESHOLD": "1",
+		"SLOWLORIS_BAN_DURATION":  "1m",
+		"ADMIN_TOKEN":             "0123456789abcdef",
+		"CLUSTER_PEERS":           "http://unused.invalid",
+	})
+	guard := NewSlowlorisGuard(cfg)
+	node, _ := cluster.New(cfg)
+	guard.UseCluster(node)
+
+	// A peer's ban is capped at the local duration, and keys that aren't
+	// addresses are ignored
+	year := strconv.FormatInt(time.Now().Add(365*24*time.Hour).Unix(), 10)
+	body := `[{"kind":"ban","key":"192.0.2.1","expires":` + year + `},{"kind":"ban","key":"not an address","expires":` + year + `}]`
+	w := httptest.NewRecorder()
+	node.ServeHTTP(w, httptest.NewRequest("POST", "/_admin/cluster", strings.NewReader(body)))
+	if w.Code != 204 {
+		t.Fatalf("Expected the events to be accepted, got %d", w.Code)
+	}
+	guard.bans.mu.Lock()
+	defer guard.bans.mu.Unlock()
+	if until := guard.bans.bans["192.0.2.1"]; until.After(time.Now().Add(time.Minute)) || until.IsZero() {
+		t.Errorf("Expected the ban to last at most SLOWLORIS_BAN_DURATION, got %v", until)
+	}
+	if len(guard.bans.bans) != 1 {
+		t.Errorf("Expected only the address to be banned, got %v", guard.bans.bans)
+	}
+}
@@ -0,0 +1,303 @@
+// Package fakebackend runs in-process stand-ins for team servers so tests
+// can drive the redirector end to end: plain HTTP, TLS, and a WebSocket echo
+// server, all recording what reached them.
+package fakebackend
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Server is a fake backend. Besides the default handler, which answers
+// "<method> <path>" with 200, it serves:
+//
+//	/stream?chunks=N&interval=D  N flushed chunks ("chunk 1\n", ...), D apart
+//	/slow?delay=D                answers after D unless the request is cancelled
+//
+// and, on the WebSocket server, echoes every message back.
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	requests  []*http.Request
+	status    atomic.Int32
+	cancelled atomic.Int32
+}
+
+// NewHTTP starts a plain HTTP backend that stops when the test ends.
+func NewHTTP(t testing.TB) *Server {
+	s := &Server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// NewTLS starts an HTTPS backend with a self-signed certificate.
+func NewTLS(t testing.TB) *Server {
+	s := &Server{}
+	s.Server = httptest.NewTLSServer(http.HandlerFunc(s.serveHTTP))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// NewWebSocket starts an HTTP backend that accepts WebSocket upgrades and
+// echoes each message. It agrees to the first subprotocol offered.
+func NewWebSocket(t testing.TB) *Server {
+	s := &Server{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			s.serveHTTP(w, r)
+			return
+		}
+		s.record(r)
+		s.serveEcho(w, r)
+	}))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// SetStatus makes every later response use code (0 restores normal
+// answers), which is how tests simulate a failing backend.
+func (s *Server) SetStatus(code int) {
+	s.status.Store(int32(code))
+}
+
+// Requests returns copies of the requests received so far, bodies omitted.
+func (s *Server) Requests() []*http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]*http.Request(nil), s.requests...)
+}
+
+// Last returns the most recent request, or nil.
+func (s *Server) Last() *http.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.requests) == 0 {
+		return nil
+	}
+	return s.requests[len(s.requests)-1]
+}
+
+// Cancelled counts /slow requests that were abandoned before they finished.
+func (s *Server) Cancelled() int {
+	return int(s.cancelled.Load())
+}
+
+func (s *Server) record(r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clone := r.Clone(r.Context())
+	clone.Body = http.NoBody
+	s.requests = append(s.requests, clone)
+}
+
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
+	s.record(r)
+	if code := int(s.status.Load()); code != 0 {
+		w.WriteHeader(code)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/stream":
+		chunks, _ := strconv.Atoi(r.URL.Query().Get("chunks"))
+		interval, _ := time.ParseDuration(r.URL.Query().Get("interval"))
+		flusher, _ := w.(http.Flusher)
+		for i := 1; i <= chunks; i++ {
+			if i > 1 {
+				time.Sleep(interval)
+			}
+			fmt.Fprintf(w, "chunk %d\n", i)
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+	case "/slow":
+		delay, _ := time.ParseDuration(r.URL.Query().Get("delay"))
+		select {
+		case <-time.After(delay):
+			io.WriteString(w, "done")
+		case <-r.Context().Done():
+			s.cancelled.Add(1)
+		}
+	default:
+		io.Copy(io.Discard, r.Body)
+		fmt.Fprintf(w, "%s %s", r.Method, r.URL.Path)
+	}
+}
+
+func (s *Server) serveEcho(w http.ResponseWriter, r *http.Request) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if key == "" {
+		http.Error(w, "missing Sec-WebSocket-Key", http.StatusBadRequest)
+		return
+	}
+	conn, buf, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + Accept(key) + "\r\n"
+	if offered := r.Header.Get("Sec-WebSocket-Protocol"); offered != "" {
+		proto, _, _ := strings.Cut(offered, ",")
+		resp += "Sec-WebSocket-Protocol: " + strings.TrimSpace(proto) + "\r\n"
+	}
+	if _, err := io.WriteString(conn, resp+"\r\n"); err != nil {
+		return
+	}
+
+	for {
+		opcode, payload, err := ReadFrame(buf.Reader)
+		if err != nil {
+			return
+		}
+		switch opcode {
+		case OpClose:
+			WriteFrame(conn, OpClose, payload, false)
+			return
+		case OpPing:
+			WriteFrame(conn, OpPong, payload, false)
+		case OpPong:
+		default:
+			WriteFrame(conn, opcode, payload, false)
+		}
+	}
+}
+
+// WebSocket opcodes used by the helpers.
+const (
+	OpText   = 0x1
+	OpBinary = 0x2
+	OpClose  = 0x8
+	OpPing   = 0x9
+	OpPong   = 0xA
+)
+
+// Accept computes Sec-WebSocket-Accept for key.
+func Accept(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+// WriteFrame writes a single unfragmented frame. Frames sent by a client
+// must be masked.
+func WriteFrame(w io.Writer, opcode byte, payload []byte, masked bool) error {
+	frame := []byte{0x80 | opcode}
+	maskBit := byte(0)
+	if masked {
+		maskBit = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, maskBit|byte(n))
+	case n <= 0xFFFF:
+		frame = append(frame, maskBit|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, maskBit|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if masked {
+		key := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+		frame = append(frame, key[:]...)
+		for i, b := range payload {
+			frame = append(frame, b^key[i%4])
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+// ReadFrame reads one frame and returns its opcode and unmasked payload.
+// Fragmented messages are returned a frame at a time.
+func ReadFrame(r io.Reader) (byte, []byte, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return 0, nil, err
+	}
+	n := uint64(head[1] & 0x7F)
+	switch n {
+	case 126:
+		var ext [2]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err := io.ReadFull(r, ext[:]); err != nil {
+			return 0, nil, err
+		}
+		n = binary.BigEndian.Uint64(ext[:])
+	}
+	if n > 1<<20 {
+		return 0, nil, errors.New("frame too large for fakebackend")
+	}
+	var key [4]byte
+	masked := head[1]&0x80 != 0
+	if masked {
+		if _, err := io.ReadFull(r, key[:]); err != nil {
+			return 0, nil, err
+		}
+	}
+	payload := make([]byte, n)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	if masked {
+		for i := range payload {
+			payload[i] ^= key[i%4]
+		}
+	}
+	return head[0] & 0x0F, payload, nil
+}
+
+// DialWebSocket opens a WebSocket to path on addr (host:port), sending extra
+// headers with the upgrade. It returns the connection, a reader positioned
+// after the handshake, and the handshake response.
+func DialWebSocket(addr, path string, header http.Header) (net.Conn, *bufio.Reader, *http.Response, error) {
+	conn, err := net.DialTimeout("tcp", addr, 5*time.Second)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	req, _ := http.NewRequest("GET", "http://"+addr+path, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, nil, err
+	}
+	return conn, br, resp, nil
+}
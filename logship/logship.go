@@ -0,0 +1,345 @@
+// Package logship rotates the redirector's log file and uploads the rotated
+// segments to object storage.
+package logship
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"google-redirector/config"
+	"google-redirector/proxy"
+)
+
+// Shipper writes the process log to a local file, rotates it by size and
+// age, and uploads each rotated segment (gzipped, optionally AES-GCM
+// encrypted) to object storage. Cloud Run instances are torn down without
+// warning, so segments only leave the disk once the upload succeeded and
+// the live file is shipped on shutdown.
+type Shipper struct {
+	path     string
+	maxSize  int64
+	interval time.Duration
+	uploader logUploader
+	aead     cipher.AEAD
+	host     string
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	shipMu sync.Mutex
+	wake   chan struct{}
+}
+
+// logUploader stores one object under name.
+type logUploader interface {
+	upload(ctx context.Context, name string, data []byte) error
+}
+
+// New returns nil when LOG_FILE is unset. Without LOG_SHIP_URL the file is
+// still rotated but never uploaded.
+func New(cfg *config.Config) (*Shipper, error) {
+	file := cfg.String("LOG_FILE", "")
+	if file == "" {
+		return nil, nil
+	}
+	maxSize, err := cfg.ByteSize("LOG_ROTATE_SIZE", "10M")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Shipper{
+		path:     file,
+		maxSize:  maxSize,
+		interval: cfg.Duration("LOG_ROTATE_INTERVAL", 15*time.Minute),
+		wake:     make(chan struct{}, 1),
+	}
+	s.host, _ = os.Hostname()
+
+	if target := cfg.String("LOG_SHIP_URL", ""); target != "" {
+		if s.uploader, err = newLogUploader(cfg, target); err != nil {
+			return nil, err
+		}
+	}
+	if key := cfg.String("LOG_SHIP_KEY", ""); key != "" {
+		raw, err := base64.StdEncoding.DecodeString(key)
+		if err != nil || len(raw) != 32 {
+			return nil, fmt.Errorf("LOG_SHIP_KEY must be 32 base64-encoded bytes")
+		}
+		block, _ := aes.NewCipher(raw)
+		s.aead, _ = cipher.NewGCM(block)
+	}
+
+	if err := s.open(); err != nil {
+		return nil, err
+	}
+	go s.rotateLoop()
+	go s.shipLoop()
+	return s, nil
+}
+
+func (s *Shipper) open() error {
+	f, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	s.f, s.size = f, info.Size()
+	return nil
+}
+
+// Write implements io.Writer for log.SetOutput. It must not log itself:
+// errors go straight to stderr to avoid re-entering the logger.
+func (s *Shipper) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n, err := s.f.Write(p)
+	s.size += int64(n)
+	if s.size >= s.maxSize {
+		s.rotateLocked()
+	}
+	return n, err
+}
+
+func (s *Shipper) rotate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.size > 0 {
+		s.rotateLocked()
+	}
+}
+
+func (s *Shipper) rotateLocked() {
+	s.f.Close()
+	rotated := fmt.Sprintf("%s.%s", s.path, time.Now().UTC().Format("20060102T150405.000000000Z"))
+	if err := os.Rename(s.path, rotated); err != nil {
+		fmt.Fprintf(os.Stderr, "log rotation failed: %v\n", err)
+	}
+	if err := s.open(); err != nil {
+		fmt.Fprintf(os.Stderr, "reopening log file failed: %v\n", err)
+	}
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Shipper) rotateLoop() {
+	for range time.Tick(s.interval) {
+		s.rotate()
+	}
+}
+
+func (s *Shipper) shipLoop() {
+	for range s.wake {
+		s.shipRotated(context.Background())
+	}
+}
+
+// shipRotated uploads every rotated segment still on disk, oldest first.
+// Failed segments stay behind and are retried after the next rotation.
+func (s *Shipper) shipRotated(ctx context.Context) {
+	if s.uploader == nil {
+		return
+	}
+	s.shipMu.Lock()
+	defer s.shipMu.Unlock()
+
+	files, _ := filepath.Glob(s.path + ".*")
+	sort.Strings(files)
+	for _, file := range files {
+		if err := s.ship(ctx, file); err != nil {
+			log.Printf("Log shipping failed for %s: %v", file, err)
+			return
+		}
+		os.Remove(file)
+	}
+}
+
+func (s *Shipper) ship(ctx context.Context, file string) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	payload := buf.Bytes()
+
+	stamp := strings.TrimPrefix(file, s.path+".")
+	name := fmt.Sprintf("%s-%s.log.gz", s.host, stamp)
+	if s.aead != nil {
+		nonce := make([]byte, s.aead.NonceSize())
+		if _, err := rand.Read(nonce); err != nil {
+			return err
+		}
+		name += ".enc"
+		payload = s.aead.Seal(nonce, nonce, payload, []byte(name))
+	}
+	return s.uploader.upload(ctx, name, payload)
+}
+
+// Close rotates the live file and ships everything before the instance goes
+// away.
+func (s *Shipper) Close(ctx context.Context) {
+	s.rotate()
+	s.shipRotated(ctx)
+}
+
+// newLogUploader picks a backend from the destination URL:
+//
+//	s3://bucket/prefix
+//	gs://bucket/prefix
+//	https://account.blob.core.windows.net/container/prefix?<SAS token>
+func newLogUploader(cfg *config.Config, raw string) (logUploader, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid LOG_SHIP_URL: %v", err)
+	}
+	client := &http.Client{Timeout: 2 * time.Minute}
+	prefix := strings.Trim(u.Path, "/")
+
+	switch {
+	case u.Scheme == "s3":
+		signer := &proxy.Signer{
+			AccessKey:    cfg.String("AWS_ACCESS_KEY_ID", ""),
+			SecretKey:    cfg.String("AWS_SECRET_ACCESS_KEY", ""),
+			SessionToken: cfg.String("AWS_SESSION_TOKEN", ""),
+			Region:       cfg.String("LOG_SHIP_REGION", cfg.String("AWS_REGION", "us-east-1")),
+			Service:      "s3",
+		}
+		if signer.AccessKey == "" || signer.SecretKey == "" {
+			return nil, fmt.Errorf("AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required for s3:// log shipping")
+		}
+		return &s3Uploader{client: client, signer: signer, bucket: u.Host, prefix: prefix}, nil
+	case u.Scheme == "gs":
+		return &gcsUploader{client: client, bucket: u.Host, prefix: prefix, token: cfg.String("GCS_ACCESS_TOKEN", "")}, nil
+	case u.Scheme == "https" && strings.HasSuffix(u.Host, ".blob.core.windows.net"):
+		return &azureUploader{client: client, base: u}, nil
+	}
+	return nil, fmt.Errorf("unsupported LOG_SHIP_URL %q (expected s3://, gs:// or an Azure Blob SAS URL)", raw)
+}
+
+func putObject(ctx context.Context, client *http.Client, req *http.Request) error {
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("upload returned %d: %s", resp.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+type s3Uploader struct {
+	client *http.Client
+	signer *proxy.Signer
+	bucket string
+	prefix string
+}
+
+func (u *s3Uploader) upload(ctx context.Context, name string, data []byte) error {
+	target := fmt.Sprintf("https://%s.s3.%s.amazonaws.com/%s", u.bucket, u.signer.Region, path.Join(u.prefix, name))
+	req, err := http.NewRequest("PUT", target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	if err := u.signer.Sign(req, time.Now()); err != nil {
+		return err
+	}
+	return putObject(ctx, u.client, req)
+}
+
+// gcsUploader authenticates with GCS_ACCESS_TOKEN if set, otherwise with the
+// instance service account from the metadata server (as on Cloud Run).
+type gcsUploader struct {
+	client *http.Client
+	bucket string
+	prefix string
+	token  string
+}
+
+func (u *gcsUploader) upload(ctx context.Context, name string, data []byte) error {
+	token := u.token
+	if token == "" {
+		var err error
+		if token, err = u.metadataToken(ctx); err != nil {
+			return fmt.Errorf("fetching metadata token: %v", err)
+		}
+	}
+
+	target := fmt.Sprintf("https://storage.googleapis.com/%s/%s", u.bucket, path.Join(u.prefix, name))
+	req, err := http.NewRequest("PUT", target, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	return putObject(ctx, u.client, req)
+}
+
+func (u *gcsUploader) metadataToken(ctx context.Context) (string, error) {
+	req, _ := http.NewRequestWithContext(ctx, "GET",
+		"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	req.Header.Set("Metadata-Flavor", "Google")
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("metadata server returned %d", resp.StatusCode)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return "", err
+	}
+	return tok.AccessToken, nil
+}
+
+// azureUploader writes block blobs using the SAS token in the container URL.
+type azureUploader struct {
+	client *http.Client
+	base   *url.URL
+}
+
+func (u *azureUploader) upload(ctx context.Context, name string, data []byte) error {
+	target := *u.base
+	target.Path = path.Join(u.base.Path, name)
+	req, err := http.NewRequest("PUT", target.String(), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("x-ms-blob-type", "BlockBlob")
+	return putObject(ctx, u.client, req)
+}
@@ -0,0 +1,74 @@
+package logship
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+type memoryUploader struct {
+	objects map[string][]byte
+}
+
+func (m *memoryUploader) upload(_ context.Context, name string, data []byte) error {
+	m.objects[name] = data
+	return nil
+}
+
+func TestLogShipper_RotatesAndShipsEncrypted(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+	block, _ := aes.NewCipher(key)
+	aead, _ := cipher.NewGCM(block)
+
+	uploader := &memoryUploader{objects: make(map[string][]byte)}
+	s := &Shipper{
+		path:     filepath.Join(t.TempDir(), "redirector.log"),
+		maxSize:  1 << 20,
+		uploader: uploader,
+		aead:     aead,
+		host:     "instance-1",
+		wake:     make(chan struct{}, 1),
+	}
+	if err := s.open(); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Write([]byte("GET /beacon -> https://backend/beacon\n"))
+	s.Close(context.Background())
+
+	if len(uploader.objects) != 1 {
+		t.Fatalf("Expected 1 uploaded object, got %d", len(uploader.objects))
+	}
+	for name, data := range uploader.objects {
+		if !strings.HasPrefix(name, "instance-1-") || !strings.HasSuffix(name, ".log.gz.enc") {
+			t.Errorf("Unexpected object name %q", name)
+		}
+		plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], []byte(name))
+		if err != nil {
+			t.Fatalf("Decrypt failed: %v", err)
+		}
+		zr, err := gzip.NewReader(bytes.NewReader(plain))
+		if err != nil {
+			t.Fatal(err)
+		}
+		text, _ := io.ReadAll(zr)
+		if !strings.Contains(string(text), "GET /beacon") {
+			t.Errorf("Unexpected log contents %q", text)
+		}
+	}
+
+	leftovers, _ := filepath.Glob(s.path + ".*")
+	if len(leftovers) != 0 {
+		t.Errorf("Expected shipped segments to be removed, found %v", leftovers)
+	}
+	if info, err := os.Stat(s.path); err != nil || info.Size() != 0 {
+		t.Errorf("Expected a fresh live log file, got %v (err %v)", info, err)
+	}
+}
@@ -0,0 +1,279 @@
+package monitor
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google-redirector/config"
+)
+
+// Alert rule names.
+const (
+	ruleErrorRate   = "error_rate"   // backend errors / proxied requests
+	ruleBlockRate   = "block_rate"   // refused / all requests
+	ruleBackendDown = "backend_down" // longest current backend outage
+)
+
+// Alerts evaluates threshold rules against the metrics every interval and
+// posts to ALERT_WEBHOOK_URL when a rule starts or stops firing. Rates are
+// measured over the sliding ALERT_WINDOW and are not evaluated until it has
+// seen ALERT_MIN_REQUESTS requests, so a single failure on an idle
+// redirector doesn't page anyone. One-off events are posted at most once
+// per key and ALERT_WINDOW, through a queue of eventQueueSize.
+type Alerts struct {
+	metrics     *Metrics
+	webhook     string
+	rules       []alertRule
+	window      time.Duration
+	interval    time.Duration
+	minRequests int64
+	instance    string
+	client      *http.Client
+
+	mu      sync.Mutex
+	history []timedSnapshot
+	firing  map[string]bool
+
+	events     chan []byte // bodies waiting for the sender started by Start
+	eventMu    sync.Mutex
+	lastEvent  map[string]time.Time // key -> when last posted
+	lastPruned time.Time
+}
+
+// eventQueueSize bounds the events waiting to be posted; more are dropped,
+// since they arrive only as fast as whoever triggers them sends requests.
+const eventQueueSize = 64
+
+type alertRule struct {
+	name      string
+	threshold float64 // a fraction, or seconds for backend_down
+}
+
+type timedSnapshot struct {
+	at time.Time
+	snapshot
+}
+
+// NewAlerts returns nil unless ALERT_WEBHOOK_URL is set.
+func NewAlerts(cfg *config.Config, m *Metrics) (*Alerts, error) {
+	webhook := cfg.String("ALERT_WEBHOOK_URL", "")
+	if webhook == "" {
+		return nil, nil
+	}
+	a := &Alerts{
+		metrics:     m,
+		webhook:     webhook,
+		window:      cfg.Duration("ALERT_WINDOW", 5*time.Minute),
+		interval:    cfg.Duration("ALERT_INTERVAL", 30*time.Second),
+		minRequests: int64(cfg.Int("ALERT_MIN_REQUESTS", 20)),
+		instance:    cfg.String("K_REVISION", ""),
+		client:      &http.Client{Timeout: 10 * time.Second},
+		firing:      make(map[string]bool),
+		events:      make(chan []byte, eventQueueSize),
+		lastEvent:   make(map[string]time.Time),
+	}
+	if a.instance == "" {
+		a.instance, _ = os.Hostname()
+	}
+	a.history = []timedSnapshot{{time.Now(), m.snapshot()}}
+	if a.interval <= 0 || a.window < a.interval {
+		return nil, fmt.Errorf("ALERT_INTERVAL must be positive and no longer than ALERT_WINDOW")
+	}
+	for _, entry := range cfg.List("ALERT_RULES", "error_rate>0.25,backend_down>1m") {
+		rule, err := parseAlertRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		a.rules = append(a.rules, rule)
+	}
+	return a, nil
+}
+
+func parseAlertRule(entry string) (alertRule, error) {
+	name, value, ok := strings.Cut(entry, ">")
+	rule := alertRule{name: strings.TrimSpace(name)}
+	value = strings.TrimSpace(value)
+	if !ok {
+		return rule, fmt.Errorf("invalid ALERT_RULES entry %q (expected name>threshold)", entry)
+	}
+	var err error
+	switch rule.name {
+	case ruleErrorRate, ruleBlockRate:
+		if pct, isPct := strings.CutSuffix(value, "%"); isPct {
+			rule.threshold, err = strconv.ParseFloat(pct, 64)
+			rule.threshold /= 100
+		} else {
+			rule.threshold, err = strconv.ParseFloat(value, 64)
+		}
+		if err == nil && (rule.threshold < 0 || rule.threshold >= 1) {
+			err = fmt.Errorf("out of range")
+		}
+	case ruleBackendDown:
+		var d time.Duration
+		d, err = time.ParseDuration(value)
+		rule.threshold = d.Seconds()
+	default:
+		return rule, fmt.Errorf("unknown alert rule %q (expected error_rate, block_rate or backend_down)", rule.name)
+	}
+	if err != nil {
+		return rule, fmt.Errorf("invalid threshold %q for alert rule %s", value, rule.name)
+	}
+	return rule, nil
+}
+
+func (a *Alerts) String() string {
+	names := make([]string, len(a.rules))
+	for i, rule := range a.rules {
+		names[i] = rule.name
+	}
+	return fmt.Sprintf("%s every %v over %v", strings.Join(names, ", "), a.interval, a.window)
+}
+
+// Start evaluates the rules and posts events in the background until ctx is
+// cancelled.
+func (a *Alerts) Start(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case body := <-a.events:
+				a.post(body)
+			}
+		}
+	}()
+	go func() {
+		ticker := time.NewTicker(a.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				a.evaluate(now)
+			}
+		}
+	}()
+}
+
+// evaluate records the current counters and updates every rule's state.
+func (a *Alerts) evaluate(now time.Time) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.history = append(a.history, timedSnapshot{now, a.metrics.snapshot()})
+	for len(a.history) > 1 && now.Sub(a.history[1].at) >= a.window {
+		a.history = a.history[1:]
+	}
+	oldest, latest := a.history[0], a.history[len(a.history)-1]
+	requests := latest.requests - oldest.requests
+	blocked := latest.blocked - oldest.blocked
+	errors := latest.errors - oldest.errors
+
+	for _, rule := range a.rules {
+		var value float64
+		var measured bool
+		switch rule.name {
+		case ruleErrorRate:
+			if measured = requests >= a.minRequests && requests > 0; measured {
+				value = float64(errors) / float64(requests)
+			}
+		case ruleBlockRate:
+			if total := requests + blocked; total >= a.minRequests && total > 0 {
+				value, measured = float64(blocked)/float64(total), true
+			}
+		case ruleBackendDown:
+			for _, d := range a.metrics.pool.Downtime() {
+				if d.Seconds() > value {
+					value = d.Seconds()
+				}
+			}
+			measured = true
+		}
+		if !measured {
+			continue
+		}
+		if firing := value > rule.threshold; firing != a.firing[rule.name] {
+			a.firing[rule.name] = firing
+			go a.notify(rule, firing, value, now)
+		}
+	}
+}
+
+// notify posts one state change. The body works as-is with Slack and
+// Mattermost style incoming webhooks thanks to the "text" field.
+func (a *Alerts) notify(rule alertRule, firing bool, value float64, at time.Time) {
+	state := "resolved"
+	if firing {
+		state = "firing"
+	}
+	body, _ := json.Marshal(map[string]any{
+		"alert":     rule.name,
+		"state":     state,
+		"value":     value,
+		"threshold": rule.threshold,
+		"instance":  a.instance,
+		"time":      at.UTC().Format(time.RFC3339),
+		"text":      fmt.Sprintf("[%s] redirector %s: %s %.3g (threshold %.3g)", state, a.instance, rule.name, value, rule.threshold),
+	})
+	log.Printf("Alert %s %s (%.3g, threshold %.3g)", rule.name, state, value, rule.threshold)
+	a.post(body)
+}
+
+// Event queues a one-off alert that has no resolved state, such as a
+// tripped canary. Events with the same name and key are only posted once
+// per ALERT_WINDOW, so a client hammering a canary URL raises one alert.
+func (a *Alerts) Event(name, key, detail string) {
+	now := time.Now()
+	a.eventMu.Lock()
+	if now.Sub(a.lastPruned) >= a.window {
+		for k, at := range a.lastEvent {
+			if now.Sub(at) >= a.window {
+				delete(a.lastEvent, k)
+			}
+		}
+		a.lastPruned = now
+	}
+	k := name + " " + key
+	if at, ok := a.lastEvent[k]; ok && now.Sub(at) < a.window {
+		a.eventMu.Unlock()
+		return
+	}
+	a.lastEvent[k] = now
+	a.eventMu.Unlock()
+
+	body, _ := json.Marshal(map[string]any{
+		"alert":    name,
+		"state":    "event",
+		"detail":   detail,
+		"instance": a.instance,
+		"time":     now.UTC().Format(time.RFC3339),
+		"text":     fmt.Sprintf("[event] redirector %s: %s: %s", a.instance, name, detail),
+	})
+	select {
+	case a.events <- body:
+	default:
+		log.Printf("Alert queue full, dropping %s event", name)
+	}
+}
+
+func (a *Alerts) post(body []byte) {
+	resp, err := a.client.Post(a.webhook, "application/json", bytes.NewReader(body))
+	if err != nil {
+		log.Printf("Alert webhook failed: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		log.Printf("Alert webhook answered %s", resp.Status)
+	}
+}
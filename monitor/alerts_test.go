@@ -0,0 +1,162 @@
+package monitor
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google-redirector/config"
+	"google-redirector/proxy"
+)
+
+func newTestMetrics(t *testing.T) *Metrics {
+	t.Helper()
+	pool, err := proxy.NewPool(config.FromMap(map[string]string{"BACKEND_URLS": "http://127.0.0.1:1"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewMetrics(pool)
+}
+
+// webhook collects the alert states posted to it.
+func webhook(t *testing.T) (string, <-chan map[string]any) {
+	t.Helper()
+	posted := make(chan map[string]any, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]any
+		json.NewDecoder(r.Body).Decode(&body)
+		posted <- body
+	}))
+	t.Cleanup(server.Close)
+	return server.URL, posted
+}
+
+func expectAlert(t *testing.T, posted <-chan map[string]any, name, state string) {
+	t.Helper()
+	select {
+	case body := <-posted:
+		if body["alert"] != name || body["state"] != state {
+			t.Errorf("Expected %s %s, got %v", name, state, body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("Expected %s %s webhook", name, state)
+	}
+}
+
+func TestAlerts_ErrorRate(t *testing.T) {
+	m := newTestMetrics(t)
+	url, posted := webhook(t)
+	a, err := NewAlerts(config.FromMap(map[string]string{
+		"ALERT_WEBHOOK_URL":  url,
+		"ALERT_RULES":        "error_rate>20%",
+		"ALERT_WINDOW":       "1m",
+		"ALERT_INTERVAL":     "10s",
+		"ALERT_MIN_REQUESTS": "10",
+	}), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := m.Plugin()
+	serve := func(n int, status int) {
+		for i := 0; i < n; i++ {
+			m.Request()
+			plugin.OnResponse(&http.Response{StatusCode: status})
+		}
+	}
+	now := time.Now()
+
+	// Too few requests to judge
+	serve(5, http.StatusBadGateway)
+	a.evaluate(now.Add(10 * time.Second))
+	select {
+	case body := <-posted:
+		t.Fatalf("Expected no alert below ALERT_MIN_REQUESTS, got %v", body)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	serve(10, http.StatusOK)
+	a.evaluate(now.Add(20 * time.Second))
+	expectAlert(t, posted, "error_rate", "firing")
+
+	// Once the failures slide out of the window the alert resolves
+	serve(20, http.StatusOK)
+	a.evaluate(now.Add(80 * time.Second))
+	a.evaluate(now.Add(90 * time.Second))
+	expectAlert(t, posted, "error_rate", "resolved")
+}
+
+func TestAlerts_BlockRateAndDowntime(t *testing.T) {
+	m := newTestMetrics(t)
+	url, posted := webhook(t)
+	a, err := NewAlerts(config.FromMap(map[string]string{
+		"ALERT_WEBHOOK_URL":  url,
+		"ALERT_RULES":        "block_rate>0.5",
+		"ALERT_MIN_REQUESTS": "1",
+	}), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plugin := m.Plugin()
+	m.Request()
+	for i := 0; i < 3; i++ {
+		m.Request()
+		plugin.OnBlock(nil, "missing verification header")
+	}
+	a.evaluate(time.Now().Add(30 * time.Second))
+	expectAlert(t, posted, "block_rate", "firing")
+
+	a, err = NewAlerts(config.FromMap(map[string]string{
+		"ALERT_WEBHOOK_URL": url,
+		"ALERT_RULES":       "backend_down>0s",
+	}), m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := m.pool.Lookup("127.0.0.1:1")
+	for i := 0; i < 3; i++ {
+		m.pool.Observe(b, time.Millisecond, true)
+	}
+	time.Sleep(10 * time.Millisecond)
+	a.evaluate(time.Now())
+	expectAlert(t, posted, "backend_down", "firing")
+}
+
+func TestAlerts_Config(t *testing.T) {
+	m := newTestMetrics(t)
+	if a, err := NewAlerts(config.FromMap(nil), m); a != nil || err != nil {
+		t.Errorf("Expected alerting to be disabled by default, got %v (%v)", a, err)
+	}
+	for _, rules := range []string{"error_rate", "latency>1s", "error_rate>2", "backend_down>soon"} {
+		settings := map[string]string{"ALERT_WEBHOOK_URL": "http://127.0.0.1:1", "ALERT_RULES": rules}
+		if _, err := NewAlerts(config.FromMap(settings), m); err == nil {
+			t.Errorf("%q: expected configuration error", rules)
+		}
+	}
+}
+
+func TestAlerts_Event(t *testing.T) {
+	url, posted := webhook(t)
+	a, err := NewAlerts(config.FromMap(map[string]string{"ALERT_WEBHOOK_URL": url}), newTestMetrics(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	a.Start(ctx)
+
+	a.Event("canary", "cid 203.0.113.7", "cid from 203.0.113.7")
+	expectAlert(t, posted, "canary", "event")
+
+	// Repeats from the same client are posted once per window
+	a.Event("canary", "cid 203.0.113.7", "cid from 203.0.113.7")
+	a.Event("canary", "cid 198.51.100.2", "cid from 198.51.100.2")
+	expectAlert(t, posted, "canary", "event")
+	select {
+	case body := <-posted:
+		t.Errorf("Expected a repeated canary hit not to be posted, got %v", body)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,100 @@
+// Package monitor counts what the redirector does and raises alerts on it,
+// for deployments without an external monitoring stack. The counters are
+// also served in the Prometheus text format through the admin API, for
+// deployments that have one.
+package monitor
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"sync/atomic"
+
+	"google-redirector/plugins"
+	"google-redirector/proxy"
+)
+
+// Metrics holds the redirector's request counters.
+type Metrics struct {
+	pool *proxy.Pool
+
+	handled     atomic.Int64 // every request, refused or not
+	blocked     atomic.Int64 // requests refused
+	errors      atomic.Int64 // backend 5xx responses
+	proxyErrors atomic.Int64 // backend unreachable or failed mid-request
+}
+
+// NewMetrics returns empty counters; backend health is read from pool.
+func NewMetrics(pool *proxy.Pool) *Metrics {
+	return &Metrics{pool: pool}
+}
+
+// Request counts a request as the redirector starts handling it, before
+// any check can refuse it, so each request is counted exactly once.
+func (m *Metrics) Request() {
+	m.handled.Add(1)
+}
+
+// Plugin counts backend responses and blocks through the plugin hooks.
+// Requests that passed are those handled and not blocked.
+func (m *Metrics) Plugin() *plugins.Plugin {
+	return &plugins.Plugin{
+		Name: "monitor",
+		OnResponse: func(resp *http.Response) error {
+			if resp.StatusCode >= 500 {
+				m.errors.Add(1)
+			}
+			return nil
+		},
+		OnBlock: func(r *http.Request, reason string) {
+			m.blocked.Add(1)
+		},
+	}
+}
+
+// ProxyError counts a request the backend never answered.
+func (m *Metrics) ProxyError() {
+	m.proxyErrors.Add(1)
+}
+
+// snapshot is the counters at one point in time.
+type snapshot struct {
+	requests, blocked, errors int64
+}
+
+func (m *Metrics) snapshot() snapshot {
+	// blocked first, so a block racing the loads can't make passed negative
+	blocked := m.blocked.Load()
+	return snapshot{
+		requests: m.handled.Load() - blocked,
+		blocked:  blocked,
+		errors:   m.errors.Load() + m.proxyErrors.Load(),
+	}
+}
+
+// ServeHTTP writes the counters in the Prometheus text exposition format.
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s := m.snapshot()
+	writeMetric(w, "redirector_requests_total", "counter", "Requests that passed the redirector's checks.", s.requests)
+	writeMetric(w, "redirector_blocked_total", "counter", "Requests refused by the redirector.", s.blocked)
+	writeMetric(w, "redirector_backend_errors_total", "counter", "Backend responses with a 5xx status.", m.errors.Load())
+	writeMetric(w, "redirector_proxy_errors_total", "counter", "Requests the backend never answered.", m.proxyErrors.Load())
+
+	down := m.pool.Downtime()
+	hosts := make([]string, 0, len(down))
+	for host := range down {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	fmt.Fprintf(w, "# HELP redirector_backend_down_seconds How long each unhealthy backend has been down.\n")
+	fmt.Fprintf(w, "# TYPE redirector_backend_down_seconds gauge\n")
+	for _, host := range hosts {
+		fmt.Fprintf(w, "redirector_backend_down_seconds{backend=%q} %g\n", host, down[host].Seconds())
+	}
+}
+
+func writeMetric(w io.Writer, name, kind, help string, value int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+}
@@ -0,0 +1,39 @@
+package monitor
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics_ServeHTTP(t *testing.T) {
+	m := newTestMetrics(t)
+	plugin := m.Plugin()
+	for i := 0; i < 3; i++ {
+		m.Request()
+	}
+	plugin.OnResponse(&http.Response{StatusCode: http.StatusServiceUnavailable})
+	plugin.OnBlock(nil, "route script")
+	m.ProxyError()
+	b, _ := m.pool.Lookup("127.0.0.1:1")
+	for i := 0; i < 3; i++ {
+		m.pool.Observe(b, time.Millisecond, true)
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest("GET", "/_admin/metrics", nil))
+	for _, want := range []string{
+		"redirector_requests_total 2\n",
+		"redirector_blocked_total 1\n",
+		"redirector_backend_errors_total 1\n",
+		"redirector_proxy_errors_total 1\n",
+		`redirector_backend_down_seconds{backend="127.0.0.1:1"} `,
+		"# TYPE redirector_requests_total counter\n",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("Expected %q in metrics, got:\n%s", want, rec.Body)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Package plugins holds the redirector's compiled-in extensions. Programs
+// embedding the redirector can Register their own from init.
+package plugins
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"google-redirector/config"
+)
+
+// Plugin is a compiled-in extension. A plugin lives in its own file in this
+// package (or in the embedding program) and registers itself from init;
+// PLUGINS then selects which of the registered plugins run, and in what
+// order. Any hook may be left nil.
+type Plugin struct {
+	Name string
+
+	// OnRequest runs for every request that passed the redirector's own
+	// checks, before it is proxied. Returning false means the plugin has
+	// written the response itself and processing stops.
+	OnRequest func(w http.ResponseWriter, r *http.Request) bool
+	// OnResponse can inspect or rewrite each backend response.
+	OnResponse func(resp *http.Response) error
+	// OnBlock is told about every request the redirector refuses.
+	OnBlock func(r *http.Request, reason string)
+	// OnTunnelOpen runs before a WebSocket or TCP tunnel is opened to
+	// target; returning an error refuses the tunnel.
+	OnTunnelOpen func(r *http.Request, target string) error
+}
+
+var registry = make(map[string]*Plugin)
+
+// Register makes p available to PLUGINS. It is meant to be called from
+// init and panics on duplicate names.
+func Register(p *Plugin) {
+	if _, dup := registry[p.Name]; dup {
+		panic("plugin registered twice: " + p.Name)
+	}
+	registry[p.Name] = p
+}
+
+// Chain runs the enabled plugins' hooks in PLUGINS order. The nil chain runs
+// nothing.
+type Chain []*Plugin
+
+// FromConfig builds the chain named by PLUGINS.
+func FromConfig(cfg *config.Config) (Chain, error) {
+	var chain Chain
+	for _, name := range cfg.List("PLUGINS", "") {
+		p, ok := registry[name]
+		if !ok {
+			known := make([]string, 0, len(registry))
+			for n := range registry {
+				known = append(known, n)
+			}
+			sort.Strings(known)
+			return nil, fmt.Errorf("unknown plugin %q (available: %s)", name, strings.Join(known, ", "))
+		}
+		chain = append(chain, p)
+	}
+	return chain, nil
+}
+
+func (c Chain) String() string {
+	names := make([]string, len(c))
+	for i, p := range c {
+		names[i] = p.Name
+	}
+	return strings.Join(names, ", ")
+}
+
+// Request runs each plugin's OnRequest hook and reports whether the request
+// should still be proxied.
+func (c Chain) Request(w http.ResponseWriter, r *http.Request) bool {
+	for _, p := range c {
+		if p.OnRequest != nil && !p.OnRequest(w, r) {
+			return false
+		}
+	}
+	return true
+}
+
+// Response is installed as the reverse proxy's ModifyResponse.
+func (c Chain) Response(resp *http.Response) error {
+	for _, p := range c {
+		if p.OnResponse != nil {
+			if err := p.OnResponse(resp); err != nil {
+				return fmt.Errorf("plugin %s: %v", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Block reports a refused request to every plugin.
+func (c Chain) Block(r *http.Request, reason string) {
+	for _, p := range c {
+		if p.OnBlock != nil {
+			p.OnBlock(r, reason)
+		}
+	}
+}
+
+// TunnelOpen asks every plugin whether a tunnel to target may be opened.
+func (c Chain) TunnelOpen(r *http.Request, target string) error {
+	for _, p := range c {
+		if p.OnTunnelOpen != nil {
+			if err := p.OnTunnelOpen(r, target); err != nil {
+				return fmt.Errorf("plugin %s: %v", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// strip-server-headers is a small built-in plugin, and an example of the
+// shape: it removes headers that fingerprint the backend's software.
+func init() {
+	Register(&Plugin{
+		Name: "strip-server-headers",
+		OnResponse: func(resp *http.Response) error {
+			for _, h := range []string{"Server", "X-Powered-By", "X-AspNet-Version", "Via"} {
+				resp.Header.Del(h)
+			}
+			return nil
+		},
+	})
+}
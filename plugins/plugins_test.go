@@ -0,0 +1,69 @@
+package plugins
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google-redirector/config"
+)
+
+func TestPluginsFromConfig(t *testing.T) {
+	t.Setenv("PLUGINS", "strip-server-headers")
+	chain, err := FromConfig(config.FromEnv())
+	if err != nil || len(chain) != 1 {
+		t.Fatalf("Expected built-in plugin to load, got %v (%v)", chain, err)
+	}
+
+	resp := &http.Response{Header: http.Header{"Server": {"nginx/1.18.0"}, "Content-Type": {"text/html"}}}
+	if err := chain.Response(resp); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if resp.Header.Get("Server") != "" || resp.Header.Get("Content-Type") == "" {
+		t.Errorf("Expected only Server to be stripped, got %v", resp.Header)
+	}
+
+	t.Setenv("PLUGINS", "nope")
+	if _, err := FromConfig(config.FromEnv()); err == nil {
+		t.Errorf("Expected unknown plugin to fail")
+	}
+}
+
+func TestPluginChain_Hooks(t *testing.T) {
+	var calls []string
+	chain := Chain{
+		{Name: "a", OnRequest: func(w http.ResponseWriter, r *http.Request) bool {
+			calls = append(calls, "a")
+			return true
+		}},
+		{Name: "b", OnRequest: func(w http.ResponseWriter, r *http.Request) bool {
+			calls = append(calls, "b")
+			w.WriteHeader(http.StatusTeapot)
+			return false
+		}},
+		{Name: "c", OnRequest: func(w http.ResponseWriter, r *http.Request) bool {
+			calls = append(calls, "c")
+			return true
+		}, OnTunnelOpen: func(r *http.Request, target string) error {
+			return errors.New("no tunnels to " + target)
+		}},
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/", nil)
+	if chain.Request(rec, req) {
+		t.Errorf("Expected request to be handled by plugin b")
+	}
+	if len(calls) != 2 || rec.Code != http.StatusTeapot {
+		t.Errorf("Expected a and b to run and c to be skipped, got %v (%d)", calls, rec.Code)
+	}
+	if err := chain.TunnelOpen(req, "10.0.0.1:22"); err == nil {
+		t.Errorf("Expected tunnel to be refused")
+	}
+
+	var empty Chain
+	if !empty.Request(rec, req) || empty.TunnelOpen(req, "x") != nil {
+		t.Errorf("Expected empty chain to allow everything")
+	}
+}
@@ -0,0 +1,354 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google-redirector/config"
+)
+
+// Backend is one upstream team server along with its live measurements.
+type Backend struct {
+	URL      *url.URL
+	director func(*http.Request)
+
+	mu           sync.Mutex
+	latency      float64 // EWMA of response time, in seconds
+	errRate      float64 // EWMA of the failure rate, 0..1
+	failures     int     // consecutive failures
+	healthy      bool
+	healthySince time.Time // zero for backends that have never been down
+	downSince    time.Time
+	measured     bool
+
+	probing atomic.Bool // a background probe is in flight
+}
+
+// observe folds one request outcome into the backend's EWMAs. Three
+// consecutive failures mark it unhealthy until a request or probe succeeds.
+func (b *Backend) observe(d time.Duration, failed bool, alpha float64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	failure := 0.0
+	if failed {
+		failure = 1
+		b.failures++
+	} else {
+		b.failures = 0
+		if !b.healthy {
+			b.healthy, b.healthySince = true, time.Now()
+		}
+	}
+	if b.failures >= 3 && b.healthy {
+		b.healthy, b.downSince = false, time.Now()
+	}
+
+	if !b.measured {
+		b.latency, b.errRate, b.measured = d.Seconds(), failure, true
+		return
+	}
+	if !failed {
+		b.latency = alpha*d.Seconds() + (1-alpha)*b.latency
+	}
+	b.errRate = alpha*failure + (1-alpha)*b.errRate
+}
+
+// score is lower for better backends: latency inflated by the error rate.
+// Unmeasured backends score zero so they are tried first.
+func (b *Backend) score() (float64, bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.latency * (1 + 10*b.errRate), b.healthy
+}
+
+// stableFor reports whether b has been healthy for at least d.
+func (b *Backend) stableFor(d time.Duration) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.healthy && time.Since(b.healthySince) >= d
+}
+
+// downFor reports how long b has been unhealthy, or 0 if it is healthy.
+func (b *Backend) downFor() time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.healthy {
+		return 0
+	}
+	return time.Since(b.downSince)
+}
+
+// Pool picks which backend serves each request. With several
+// backends configured it continuously measures latency and errors, both
+// from live traffic and from background probes, and either prefers the
+// fastest healthy one ("latency") or the first healthy one in list order
+// ("priority").
+type Pool struct {
+	backends      []*Backend
+	byHost        map[string]*Backend
+	alpha         float64
+	probeInterval time.Duration
+	probePath     string
+	priority      bool
+	failbackDelay time.Duration
+
+	mu     sync.Mutex
+	active *Backend
+}
+
+// NewPool reads BACKEND_URLS (comma-separated), falling back to the single
+// BACKEND_URL.
+func NewPool(cfg *config.Config) (*Pool, error) {
+	raw := cfg.List("BACKEND_URLS", "")
+	if len(raw) == 0 {
+		raw = []string{cfg.String("BACKEND_URL", "https://your-backend-server.com")}
+	}
+
+	p := &Pool{
+		byHost:        make(map[string]*Backend),
+		alpha:         0.3,
+		probeInterval: cfg.Duration("BACKEND_PROBE_INTERVAL", 10*time.Second),
+		probePath:     cfg.String("BACKEND_PROBE_PATH", "/"),
+		failbackDelay: cfg.Duration("BACKEND_FAILBACK_DELAY", 30*time.Second),
+	}
+	switch mode := cfg.String("BACKEND_SELECTION", "latency"); mode {
+	case "latency":
+	case "priority":
+		p.priority = true
+	default:
+		return nil, fmt.Errorf("invalid BACKEND_SELECTION %q (expected latency or priority)", mode)
+	}
+	for _, s := range raw {
+		u, err := url.Parse(s)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("invalid backend URL %q", s)
+		}
+		if _, dup := p.byHost[u.Host]; dup {
+			return nil, fmt.Errorf("backend host %s listed twice", u.Host)
+		}
+		b := &Backend{
+			URL:      u,
+			director: httputil.NewSingleHostReverseProxy(u).Director,
+			healthy:  true,
+		}
+		p.backends = append(p.backends, b)
+		p.byHost[u.Host] = b
+	}
+	return p, nil
+}
+
+// pick returns the backend for the next request. In latency mode that is the
+// healthy backend with the best score, or the best unhealthy one if every
+// backend is down.
+func (p *Pool) pick() *Backend {
+	if len(p.backends) == 1 {
+		return p.backends[0]
+	}
+	if p.priority {
+		return p.pickPriority()
+	}
+
+	var best, fallback *Backend
+	var bestScore, fallbackScore float64
+	for _, b := range p.backends {
+		score, healthy := b.score()
+		if healthy && (best == nil || score < bestScore) {
+			best, bestScore = b, score
+		}
+		if fallback == nil || score < fallbackScore {
+			fallback, fallbackScore = b, score
+		}
+	}
+	if best != nil {
+		return best
+	}
+	return fallback
+}
+
+// pickPriority returns the first healthy backend in list order. A backend
+// that recovered only takes traffic back once it has stayed healthy for
+// failbackDelay, so a flapping primary doesn't bounce sessions around.
+func (p *Pool) pickPriority() *Backend {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	var chosen *Backend
+	for _, b := range p.backends {
+		if b == p.active {
+			if _, healthy := b.score(); healthy {
+				chosen = b
+				break
+			}
+			continue
+		}
+		if b.stableFor(p.failbackDelay) {
+			chosen = b
+			break
+		}
+	}
+	if chosen == nil {
+		// Nothing is stable: take any healthy backend, else the primary
+		chosen = p.backends[0]
+		for _, b := range p.backends {
+			if _, healthy := b.score(); healthy {
+				chosen = b
+				break
+			}
+		}
+	}
+
+	if chosen != p.active {
+		if p.active != nil {
+			log.Printf("Backend failover: %s -> %s", p.active.URL.Host, chosen.URL.Host)
+		}
+		p.active = chosen
+	}
+	return chosen
+}
+
+// routeKey pins a request to one backend, overriding the pool's selection.
+type routeKey struct{}
+
+// WithBackend pins r to b.
+func WithBackend(r *http.Request, b *Backend) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), routeKey{}, b))
+}
+
+// PickFor returns the backend r was pinned to, if any, else pick().
+func (p *Pool) PickFor(r *http.Request) *Backend {
+	if b, ok := r.Context().Value(routeKey{}).(*Backend); ok {
+		return b
+	}
+	return p.pick()
+}
+
+// Lookup finds a pool backend by host or by URL.
+func (p *Pool) Lookup(name string) (*Backend, bool) {
+	if u, err := url.Parse(name); err == nil && u.Host != "" {
+		name = u.Host
+	}
+	b, ok := p.byHost[name]
+	return b, ok
+}
+
+// Director routes an outbound proxy request to the chosen backend.
+func (p *Pool) Director(req *http.Request) {
+	p.PickFor(req).director(req)
+}
+
+// Observe records the outcome of a request handled outside the pool's
+// transport, such as a WebSocket dial.
+func (p *Pool) Observe(b *Backend, d time.Duration, failed bool) {
+	b.observe(d, failed, p.alpha)
+}
+
+// Downtime returns how long each unhealthy backend, by host, has been down.
+func (p *Pool) Downtime() map[string]time.Duration {
+	down := make(map[string]time.Duration)
+	for _, b := range p.backends {
+		if d := b.downFor(); d > 0 {
+			down[b.URL.Host] = d
+		}
+	}
+	return down
+}
+
+func (p *Pool) String() string {
+	urls := make([]string, len(p.backends))
+	for i, b := range p.backends {
+		urls[i] = b.URL.String()
+	}
+	return strings.Join(urls, ", ")
+}
+
+// failed reports whether a backend round trip counts against the backend's
+// health: a transport error or a gateway status. Other errors come from the
+// team server itself, which is up.
+func failed(resp *http.Response, err error) bool {
+	return err != nil || resp.StatusCode == http.StatusBadGateway ||
+		resp.StatusCode == http.StatusServiceUnavailable || resp.StatusCode == http.StatusGatewayTimeout
+}
+
+// Probe measures every backend once in the background at probeInterval,
+// judging responses as live traffic is. A backend whose previous probe is
+// still running is skipped rather than probed again. Probing stops when ctx
+// is cancelled.
+func (p *Pool) Probe(ctx context.Context, transport http.RoundTripper) {
+	if len(p.backends) < 2 || p.probeInterval <= 0 {
+		return
+	}
+	client := &http.Client{Transport: transport, Timeout: 10 * time.Second}
+	go func() {
+		ticker := time.NewTicker(p.probeInterval)
+		defer ticker.Stop()
+		for {
+			for _, b := range p.backends {
+				if b.probing.CompareAndSwap(false, true) {
+					go p.probeOne(ctx, client, b)
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (p *Pool) probeOne(ctx context.Context, client *http.Client, b *Backend) {
+	defer b.probing.Store(false)
+	target := *b.URL
+	target.Path = strings.TrimSuffix(target.Path, "/") + "/" + strings.TrimPrefix(p.probePath, "/")
+
+	reqCtx, cancel := context.WithTimeout(ctx, client.Timeout)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(reqCtx, "HEAD", target.String(), nil)
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	d := time.Since(start)
+	if resp != nil {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+	if ctx.Err() != nil {
+		return // stopped, not the backend's doing
+	}
+	b.observe(d, failed(resp, err), p.alpha)
+	if err != nil {
+		log.Printf("Backend probe %s failed: %v", b.URL.Host, err)
+	}
+}
+
+// Transport wraps next to record the outcome of every proxied request
+// against the backend it was sent to. Requests the client gave up on are
+// not recorded, since their errors say nothing about the backend.
+func (p *Pool) Transport(next http.RoundTripper) http.RoundTripper {
+	return &poolTransport{pool: p, next: next}
+}
+
+type poolTransport struct {
+	pool *Pool
+	next http.RoundTripper
+}
+
+func (t *poolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b, ok := t.pool.byHost[req.URL.Host]
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if ok && req.Context().Err() == nil {
+		b.observe(time.Since(start), failed(resp, err), t.pool.alpha)
+	}
+	return resp, err
+}
@@ -0,0 +1,159 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"testing"
+	"time"
+
+	"google-redirector/config"
+)
+
+func TestBackendPool_PrefersFastestHealthy(t *testing.T) {
+	t.Setenv("BACKEND_URLS", "https://a.example.com, https://b.example.com")
+	pool, err := NewPool(config.FromEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b := pool.backends[0], pool.backends[1]
+
+	a.observe(200*time.Millisecond, false, pool.alpha)
+	b.observe(50*time.Millisecond, false, pool.alpha)
+	if got := pool.pick(); got != b {
+		t.Errorf("Expected faster backend b, got %s", got.URL.Host)
+	}
+
+	for i := 0; i < 3; i++ {
+		b.observe(time.Second, true, pool.alpha)
+	}
+	if got := pool.pick(); got != a {
+		t.Errorf("Expected failover to a after b went unhealthy, got %s", got.URL.Host)
+	}
+
+	b.observe(10*time.Millisecond, false, pool.alpha)
+	if _, healthy := b.score(); !healthy {
+		t.Error("Expected success to restore b's health")
+	}
+}
+
+func TestBackendPool_ProxiesAndMeasures(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.URL.Path))
+	}))
+	defer server.Close()
+
+	t.Setenv("BACKEND_URLS", server.URL+"/base")
+	pool, err := NewPool(config.FromEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxy := &httputil.ReverseProxy{
+		Director:  pool.Director,
+		Transport: &poolTransport{pool: pool, next: http.DefaultTransport},
+	}
+
+	w := httptest.NewRecorder()
+	proxy.ServeHTTP(w, httptest.NewRequest("GET", "/beacon", nil))
+	if w.Body.String() != "/base/beacon" {
+		t.Errorf("Expected path to be joined onto backend base, got %q", w.Body.String())
+	}
+	if !pool.backends[0].measured {
+		t.Error("Expected proxied request to be measured")
+	}
+}
+
+func TestBackendPool_IgnoresCancelledRequests(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+	defer close(release)
+
+	t.Setenv("BACKEND_URLS", server.URL+",https://unused.example.com")
+	pool, _ := NewPool(config.FromEnv())
+	transport := pool.Transport(http.DefaultTransport)
+
+	// Clients hanging up on a slow download aren't the backend failing
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/download", nil)
+		if _, err := transport.RoundTrip(req); err == nil {
+			t.Fatal("Expected the cancelled request to fail")
+		}
+		cancel()
+	}
+	if _, healthy := pool.backends[0].score(); !healthy || pool.backends[0].measured {
+		t.Error("Expected cancelled requests to leave the backend healthy and unmeasured")
+	}
+}
+
+func TestBackendPool_PriorityFailback(t *testing.T) {
+	t.Setenv("BACKEND_URLS", "https://primary.example.com,https://secondary.example.com")
+	t.Setenv("BACKEND_SELECTION", "priority")
+	t.Setenv("BACKEND_FAILBACK_DELAY", "50ms")
+	pool, err := NewPool(config.FromEnv())
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, secondary := pool.backends[0], pool.backends[1]
+
+	// Priority ignores latency
+	primary.observe(time.Second, false, pool.alpha)
+	secondary.observe(time.Millisecond, false, pool.alpha)
+	if got := pool.pick(); got != primary {
+		t.Fatalf("Expected primary, got %s", got.URL.Host)
+	}
+
+	for i := 0; i < 3; i++ {
+		primary.observe(time.Second, true, pool.alpha)
+	}
+	if got := pool.pick(); got != secondary {
+		t.Fatalf("Expected failover to secondary, got %s", got.URL.Host)
+	}
+
+	// Recovered, but not yet stable: stay on secondary
+	primary.observe(time.Millisecond, false, pool.alpha)
+	if got := pool.pick(); got != secondary {
+		t.Errorf("Expected hysteresis to keep secondary, got %s", got.URL.Host)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if got := pool.pick(); got != primary {
+		t.Errorf("Expected failback to primary, got %s", got.URL.Host)
+	}
+}
+
+func TestBackendPool_ProbeOne(t *testing.T) {
+	status := http.StatusInternalServerError
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+	t.Setenv("BACKEND_URLS", server.URL+",https://unused.example.com")
+	pool, _ := NewPool(config.FromEnv())
+	b := pool.backends[0]
+	client := &http.Client{Timeout: time.Second}
+
+	// An application error still means the team server is up
+	for i := 0; i < 3; i++ {
+		b.probing.Store(true)
+		pool.probeOne(context.Background(), client, b)
+	}
+	if _, healthy := b.score(); !healthy {
+		t.Error("Expected probes answered with 500 to keep the backend healthy")
+	}
+	if b.probing.Load() {
+		t.Error("Expected the probe to be marked finished")
+	}
+
+	status = http.StatusBadGateway
+	for i := 0; i < 3; i++ {
+		pool.probeOne(context.Background(), client, b)
+	}
+	if _, healthy := b.score(); healthy {
+		t.Error("Expected probes answered with 502 to mark the backend unhealthy")
+	}
+}
@@ -0,0 +1,174 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"google-redirector/clientip"
+	"google-redirector/config"
+)
+
+// Backpressure absorbs 429/503 responses that carry Retry-After by
+// holding the request locally and retrying, so implants that treat any
+// non-200 as fatal never see the backend's backpressure. Waiting requests
+// occupy slots in a bounded queue with a per-client cap; when no slot is
+// free the backend's response is passed through unchanged.
+type Backpressure struct {
+	next       http.RoundTripper
+	maxWait    time.Duration
+	maxRetries int
+	maxBody    int64
+	queueSize  int
+	perClient  int
+
+	mu      sync.Mutex
+	queued  int
+	clients map[string]int
+}
+
+// NewBackpressure wraps next when BACKPRESSURE_RETRY is enabled. The second
+// result is nil when it is not.
+func NewBackpressure(cfg *config.Config, next http.RoundTripper) (http.RoundTripper, *Backpressure, error) {
+	if !cfg.Bool("BACKPRESSURE_RETRY", false) {
+		return next, nil, nil
+	}
+	maxBody, err := cfg.ByteSize("BACKPRESSURE_MAX_BODY", "1M")
+	if err != nil {
+		return nil, nil, err
+	}
+	t := &Backpressure{
+		next:       next,
+		maxWait:    cfg.Duration("BACKPRESSURE_MAX_WAIT", 30*time.Second),
+		maxRetries: cfg.Int("BACKPRESSURE_MAX_RETRIES", 3),
+		maxBody:    maxBody,
+		queueSize:  cfg.Int("BACKPRESSURE_QUEUE_SIZE", 64),
+		perClient:  cfg.Int("BACKPRESSURE_PER_CLIENT", 4),
+		clients:    make(map[string]int),
+	}
+	return t, t, nil
+}
+
+func (t *Backpressure) String() string {
+	return fmt.Sprintf("queue %d, %d per client, max wait %v", t.queueSize, t.perClient, t.maxWait)
+}
+
+func (t *Backpressure) RoundTrip(req *http.Request) (*http.Response, error) {
+	body, replayable, err := t.bufferBody(req)
+	if err != nil {
+		return nil, err
+	}
+
+	client := clientip.FromContext(req.Context())
+	for attempt := 0; ; attempt++ {
+		if replayable {
+			req = req.Clone(req.Context())
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || !replayable || attempt >= t.maxRetries {
+			return resp, err
+		}
+		if resp.StatusCode != http.StatusTooManyRequests && resp.StatusCode != http.StatusServiceUnavailable {
+			return resp, nil
+		}
+		wait, ok := retryAfter(resp.Header.Get("Retry-After"), time.Now())
+		if !ok || wait > t.maxWait {
+			return resp, nil
+		}
+		if !t.enqueue(client) {
+			log.Printf("Backpressure queue full, passing %d through to %s", resp.StatusCode, client)
+			return resp, nil
+		}
+
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		log.Printf("Backend returned %d, retrying %s %s for %s in %v", resp.StatusCode, req.Method, req.URL.Path, client, wait)
+
+		err = sleepContext(req.Context(), wait)
+		t.dequeue(client)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// bufferBody reads up to maxBody bytes of the request body so it can be
+// replayed. Larger bodies are stitched back together and sent once.
+func (t *Backpressure) bufferBody(req *http.Request) ([]byte, bool, error) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return nil, true, nil
+	}
+	if req.ContentLength > t.maxBody {
+		return nil, false, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, t.maxBody+1))
+	if err != nil {
+		return nil, false, err
+	}
+	if int64(len(body)) > t.maxBody {
+		req.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), req.Body), req.Body}
+		return nil, false, nil
+	}
+	req.Body.Close()
+	return body, true, nil
+}
+
+func (t *Backpressure) enqueue(client string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.queued >= t.queueSize || t.clients[client] >= t.perClient {
+		return false
+	}
+	t.queued++
+	t.clients[client]++
+	return true
+}
+
+func (t *Backpressure) dequeue(client string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.queued--
+	if t.clients[client]--; t.clients[client] <= 0 {
+		delete(t.clients, client)
+	}
+}
+
+// retryAfter parses a Retry-After value given as either delay-seconds or an
+// HTTP-date.
+func retryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(value); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if d := at.Sub(now); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+func sleepContext(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,93 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBackpressure_RetriesWithBody(t *testing.T) {
+	var calls atomic.Int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if calls.Add(1) == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	}))
+	defer backend.Close()
+
+	bp := &Backpressure{
+		next:       http.DefaultTransport,
+		maxWait:    time.Second,
+		maxRetries: 3,
+		maxBody:    1024,
+		queueSize:  1,
+		perClient:  1,
+		clients:    make(map[string]int),
+	}
+
+	req, _ := http.NewRequest("POST", backend.URL, strings.NewReader("beacon"))
+	resp, err := bp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "beacon" {
+		t.Errorf("Expected retried 200 with original body, got %d %q", resp.StatusCode, body)
+	}
+	if calls.Load() != 2 {
+		t.Errorf("Expected 2 backend calls, got %d", calls.Load())
+	}
+	if bp.queued != 0 || len(bp.clients) != 0 {
+		t.Errorf("Expected queue to drain, got %d queued", bp.queued)
+	}
+}
+
+func TestBackpressure_PassesThroughWhenQueueFull(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Retry-After", "0")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer backend.Close()
+
+	bp := &Backpressure{
+		next:       http.DefaultTransport,
+		maxWait:    time.Second,
+		maxRetries: 3,
+		maxBody:    1024,
+		queueSize:  0,
+		clients:    make(map[string]int),
+	}
+
+	req, _ := http.NewRequest("GET", backend.URL, nil)
+	resp, err := bp.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("Expected 429 to pass through, got %d", resp.StatusCode)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	if d, ok := retryAfter("5", now); !ok || d != 5*time.Second {
+		t.Errorf("Expected 5s, got %v %v", d, ok)
+	}
+	if d, ok := retryAfter("Mon, 01 Jan 2024 00:00:10 GMT", now); !ok || d != 10*time.Second {
+		t.Errorf("Expected 10s, got %v %v", d, ok)
+	}
+	if _, ok := retryAfter("soon", now); ok {
+		t.Error("Expected invalid Retry-After to be rejected")
+	}
+}
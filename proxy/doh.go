@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"google-redirector/clientip"
+	"google-redirector/config"
+)
+
+const dnsMessageType = "application/dns-message"
+
+// DoH answers RFC 8484 DNS-over-HTTPS queries on a fixed path, so
+// DNS-based C2 can use the same fronted HTTPS endpoint. Queries are checked
+// for RFC 8484 framing, then sent to a DoH resolver URL, a plain DNS server
+// (UDP, retried over TCP when truncated), or through to the backend.
+type DoH struct {
+	path     string
+	upstream string // "backend", an https:// DoH URL, or host:port
+	client   *http.Client
+	dialer   *net.Dialer
+}
+
+// NewDoH returns nil unless DOH_UPSTREAM is set.
+func NewDoH(cfg *config.Config, dialer *net.Dialer) (*DoH, error) {
+	upstream := cfg.String("DOH_UPSTREAM", "")
+	if upstream == "" {
+		return nil, nil
+	}
+	d := &DoH{
+		path:     cfg.String("DOH_PATH", "/dns-query"),
+		upstream: upstream,
+		dialer:   dialer,
+	}
+	switch {
+	case upstream == "backend":
+	case strings.HasPrefix(upstream, "https://"):
+		if _, err := url.Parse(upstream); err != nil {
+			return nil, fmt.Errorf("invalid DOH_UPSTREAM: %v", err)
+		}
+		d.client = &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+		}
+	default:
+		if _, _, err := net.SplitHostPort(upstream); err != nil {
+			return nil, fmt.Errorf("invalid DOH_UPSTREAM %q (expected backend, an https:// URL or host:port)", upstream)
+		}
+	}
+	return d, nil
+}
+
+// dohError carries the status RFC 8484 asks for on a malformed query.
+type dohError struct {
+	status int
+	msg    string
+}
+
+func (e *dohError) Error() string { return e.msg }
+
+// dohMessage extracts the wire-format DNS query from a GET (?dns=, base64url
+// without padding) or POST (application/dns-message body) request.
+func dohMessage(r *http.Request) ([]byte, error) {
+	var msg []byte
+	switch r.Method {
+	case "GET":
+		param := r.URL.Query().Get("dns")
+		if param == "" {
+			return nil, &dohError{http.StatusBadRequest, "missing dns parameter"}
+		}
+		var err error
+		if msg, err = base64.RawURLEncoding.DecodeString(param); err != nil {
+			return nil, &dohError{http.StatusBadRequest, "dns parameter is not base64url"}
+		}
+	case "POST":
+		if r.Header.Get("Content-Type") != dnsMessageType {
+			return nil, &dohError{http.StatusUnsupportedMediaType, "unsupported content type"}
+		}
+		var err error
+		if msg, err = io.ReadAll(io.LimitReader(r.Body, 65536)); err != nil {
+			return nil, &dohError{http.StatusBadRequest, "reading query failed"}
+		}
+	default:
+		return nil, &dohError{http.StatusMethodNotAllowed, "method not allowed"}
+	}
+	if len(msg) > 65535 {
+		return nil, &dohError{http.StatusRequestEntityTooLarge, "query too large"}
+	}
+	if len(msg) < 12 {
+		return nil, &dohError{http.StatusBadRequest, "query shorter than a DNS header"}
+	}
+	return msg, nil
+}
+
+func (d *DoH) String() string {
+	return d.path + " -> " + d.upstream
+}
+
+// Handles reports whether r is addressed to the relay's path.
+func (d *DoH) Handles(r *http.Request) bool {
+	return r.URL.Path == d.path
+}
+
+// Serve answers the query in r. backend handles it when DOH_UPSTREAM is
+// "backend".
+func (d *DoH) Serve(w http.ResponseWriter, r *http.Request, backend http.Handler) {
+	msg, err := dohMessage(r)
+	if err != nil {
+		e := err.(*dohError)
+		http.Error(w, e.msg, e.status)
+		return
+	}
+
+	if d.upstream == "backend" {
+		if r.Method == "POST" {
+			r.Body = io.NopCloser(bytes.NewReader(msg))
+		}
+		backend.ServeHTTP(w, r)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	resp, err := d.resolve(ctx, msg)
+	if err != nil {
+		log.Printf("DoH query from %s failed: %v", clientip.From(r), err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", dnsMessageType)
+	if ttl, ok := minTTL(resp); ok {
+		w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", ttl))
+	}
+	w.Write(resp)
+}
+
+func (d *DoH) resolve(ctx context.Context, msg []byte) ([]byte, error) {
+	if d.client != nil {
+		req, err := http.NewRequestWithContext(ctx, "POST", d.upstream, bytes.NewReader(msg))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", dnsMessageType)
+		req.Header.Set("Accept", dnsMessageType)
+		resp, err := d.client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, fmt.Errorf("resolver returned %d", resp.StatusCode)
+		}
+		return io.ReadAll(io.LimitReader(resp.Body, 65535))
+	}
+
+	resp, err := d.exchange(ctx, "udp", msg)
+	if err == nil && len(resp) > 2 && resp[2]&0x02 != 0 {
+		// Truncated: ask again over TCP
+		resp, err = d.exchange(ctx, "tcp", msg)
+	}
+	return resp, err
+}
+
+// exchange sends one query to a plain DNS server. TCP messages carry a
+// two-byte length prefix.
+func (d *DoH) exchange(ctx context.Context, network string, msg []byte) ([]byte, error) {
+	conn, err := d.dialer.DialContext(ctx, network, d.upstream)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	id := binary.BigEndian.Uint16(msg)
+	if network == "tcp" {
+		msg = append(binary.BigEndian.AppendUint16(nil, uint16(len(msg))), msg...)
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	for {
+		var resp []byte
+		if network == "tcp" {
+			var size [2]byte
+			if _, err := io.ReadFull(conn, size[:]); err != nil {
+				return nil, err
+			}
+			resp = make([]byte, binary.BigEndian.Uint16(size[:]))
+			if _, err := io.ReadFull(conn, resp); err != nil {
+				return nil, err
+			}
+		} else {
+			buf := make([]byte, 65535)
+			n, err := conn.Read(buf)
+			if err != nil {
+				return nil, err
+			}
+			resp = buf[:n]
+		}
+		// Ignore stray datagrams that don't answer this query
+		if len(resp) >= 12 && binary.BigEndian.Uint16(resp) == id {
+			return resp, nil
+		}
+		if network == "tcp" {
+			return nil, fmt.Errorf("response ID mismatch")
+		}
+	}
+}
+
+// minTTL returns the smallest TTL in the answer and authority sections, used
+// as the HTTP freshness lifetime as RFC 8484 section 5.1 recommends.
+func minTTL(msg []byte) (uint32, bool) {
+	if len(msg) < 12 {
+		return 0, false
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) + int(binary.BigEndian.Uint16(msg[8:]))
+
+	off := 12
+	for i := 0; i < qdcount; i++ {
+		if off = skipName(msg, off); off < 0 || off+4 > len(msg) {
+			return 0, false
+		}
+		off += 4
+	}
+	var ttl uint32
+	found := false
+	for i := 0; i < rrcount; i++ {
+		if off = skipName(msg, off); off < 0 || off+10 > len(msg) {
+			return 0, false
+		}
+		if t := binary.BigEndian.Uint32(msg[off+4:]); !found || t < ttl {
+			ttl, found = t, true
+		}
+		off += 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	}
+	return ttl, found
+}
+
+// skipName returns the offset just past the (possibly compressed) domain
+// name at off, or -1 if it runs off the end of msg.
+func skipName(msg []byte, off int) int {
+	for off < len(msg) {
+		switch l := int(msg[off]); {
+		case l == 0:
+			return off + 1
+		case l&0xc0 == 0xc0:
+			return off + 2
+		default:
+			off += 1 + l
+		}
+	}
+	return -1
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// testDNSQuery is an A query for example.com with ID 0x1234.
+var testDNSQuery = []byte{
+	0x12, 0x34, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	7, 'e', 'x', 'a', 'm', 'p', 'l', 'e', 3, 'c', 'o', 'm', 0,
+	0x00, 0x01, 0x00, 0x01,
+}
+
+// testDNSAnswer turns q into a response with one A record pointing back at
+// the question name, with the given TTL.
+func testDNSAnswer(q []byte, ttl uint32) []byte {
+	resp := append([]byte(nil), q...)
+	resp[2] |= 0x80
+	resp[7] = 1
+	resp = append(resp, 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01)
+	resp = binary.BigEndian.AppendUint32(resp, ttl)
+	return append(resp, 0x00, 0x04, 93, 184, 216, 34)
+}
+
+func TestDoHMessage(t *testing.T) {
+	get := httptest.NewRequest("GET", "/dns-query?dns="+base64.RawURLEncoding.EncodeToString(testDNSQuery), nil)
+	if msg, err := dohMessage(get); err != nil || !bytes.Equal(msg, testDNSQuery) {
+		t.Errorf("Expected GET query to decode, got %x (%v)", msg, err)
+	}
+
+	post := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(testDNSQuery))
+	post.Header.Set("Content-Type", dnsMessageType)
+	if msg, err := dohMessage(post); err != nil || !bytes.Equal(msg, testDNSQuery) {
+		t.Errorf("Expected POST query to decode, got %x (%v)", msg, err)
+	}
+
+	tests := []struct {
+		req    *http.Request
+		status int
+	}{
+		{httptest.NewRequest("PUT", "/dns-query", nil), http.StatusMethodNotAllowed},
+		{httptest.NewRequest("GET", "/dns-query", nil), http.StatusBadRequest},
+		{httptest.NewRequest("GET", "/dns-query?dns=AAA=", nil), http.StatusBadRequest},
+		{httptest.NewRequest("POST", "/dns-query", bytes.NewReader(testDNSQuery)), http.StatusUnsupportedMediaType},
+	}
+	for _, tt := range tests {
+		_, err := dohMessage(tt.req)
+		if e, ok := err.(*dohError); !ok || e.status != tt.status {
+			t.Errorf("%s %s: expected status %d, got %v", tt.req.Method, tt.req.URL, tt.status, err)
+		}
+	}
+}
+
+func TestMinTTL(t *testing.T) {
+	if ttl, ok := minTTL(testDNSAnswer(testDNSQuery, 300)); !ok || ttl != 300 {
+		t.Errorf("Expected TTL 300, got %d (%v)", ttl, ok)
+	}
+	if _, ok := minTTL(testDNSQuery); ok {
+		t.Errorf("Expected no TTL for a message without records")
+	}
+	if _, ok := minTTL(testDNSAnswer(testDNSQuery, 300)[:40]); ok {
+		t.Errorf("Expected truncated message to be rejected")
+	}
+}
+
+func TestDoHRelay_PlainDNS(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := pc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			pc.WriteTo(testDNSAnswer(buf[:n], 60), addr)
+		}
+	}()
+
+	d := &DoH{upstream: pc.LocalAddr().String(), dialer: &net.Dialer{Timeout: time.Second}}
+	req := httptest.NewRequest("POST", "/dns-query", bytes.NewReader(testDNSQuery))
+	req.Header.Set("Content-Type", dnsMessageType)
+	rec := httptest.NewRecorder()
+	d.Serve(rec, req, nil)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected 200, got %d: %s", rec.Code, rec.Body)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != dnsMessageType {
+		t.Errorf("Expected %s, got %s", dnsMessageType, ct)
+	}
+	if cc := rec.Header().Get("Cache-Control"); cc != "max-age=60" {
+		t.Errorf("Expected max-age=60, got %q", cc)
+	}
+	body, _ := io.ReadAll(rec.Body)
+	if !bytes.Equal(body, testDNSAnswer(testDNSQuery, 60)) {
+		t.Errorf("Expected resolver answer relayed unchanged, got %x", body)
+	}
+}
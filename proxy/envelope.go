@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"google-redirector/clientip"
+	"google-redirector/config"
+)
+
+// Envelope attaches an encrypted description of each request's client to
+// the request the backend receives, so the team server gets the real client
+// address and connection details without having to trust X-Forwarded-For,
+// which anything in front of it can forge. The header value is
+// base64url(nonce || AES-256-GCM ciphertext) of a JSON envelopeData under
+// CLIENT_ENVELOPE_KEY, so it can be neither read nor altered without the
+// key. The request the backend receives is the additional data (see
+// envelopeAAD), so an envelope copied onto another request fails to open.
+//
+// There is no JA3 field: Go's TLS stack doesn't expose the ClientHello's
+// extension order, and behind Cloud Run TLS ends at Google's front end
+// anyway. The negotiated TLS parameters are included when the redirector
+// terminates TLS itself.
+type Envelope struct {
+	header string
+	aead   cipher.AEAD
+
+	// Network, when set, describes the autonomous system a client address
+	// belongs to, or returns nil if it is unknown.
+	Network func(ip string) *ClientNetwork
+}
+
+// ClientNetwork is what an IP-to-ASN database knows about an address.
+type ClientNetwork struct {
+	ASN     uint32 `json:"asn"`
+	Country string `json:"country,omitempty"`
+	Org     string `json:"org,omitempty"`
+}
+
+type envelopeData struct {
+	Version  int            `json:"v"`
+	IP       string         `json:"ip"`
+	Network  *ClientNetwork `json:"network,omitempty"`
+	Method   string         `json:"method"`
+	Host     string         `json:"host"`
+	Path     string         `json:"path"`
+	TLS      *envelopeTLS   `json:"tls,omitempty"`
+	Received int64          `json:"received,omitempty"` // Unix milliseconds
+	Sent     int64          `json:"sent"`
+}
+
+type envelopeTLS struct {
+	Version     string `json:"version"`
+	CipherSuite string `json:"cipher_suite"`
+	ServerName  string `json:"sni,omitempty"`
+	ALPN        string `json:"alpn,omitempty"`
+}
+
+// NewEnvelope returns nil unless CLIENT_ENVELOPE_KEY (32 bytes, hex or
+// base64) is set.
+func NewEnvelope(cfg *config.Config) (*Envelope, error) {
+	encoded := cfg.String("CLIENT_ENVELOPE_KEY", "")
+	if encoded == "" {
+		return nil, nil
+	}
+	key, err := hex.DecodeString(encoded)
+	if err != nil {
+		key, err = base64.StdEncoding.DecodeString(encoded)
+	}
+	if err != nil || len(key) != 32 {
+		return nil, fmt.Errorf("CLIENT_ENVELOPE_KEY must be 32 bytes, hex or base64 encoded")
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &Envelope{
+		header: cfg.String("CLIENT_ENVELOPE_HEADER", "X-Client-Envelope"),
+		aead:   aead,
+	}, nil
+}
+
+func (e *Envelope) String() string {
+	return e.header + ", AES-256-GCM"
+}
+
+type receivedKey struct{}
+
+// Received records when r arrived, for Seal to report.
+func Received(r *http.Request, at time.Time) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), receivedKey{}, at))
+}
+
+// envelopeAAD is the additional data an envelope is sealed with: the
+// method, Host and request target of out, the request sent to the backend,
+// joined by newlines.
+func envelopeAAD(out *http.Request) []byte {
+	host := out.Host
+	if host == "" {
+		host = out.URL.Host
+	}
+	return []byte(out.Method + "\n" + host + "\n" + out.URL.RequestURI())
+}
+
+// Seal sets the envelope header of out, the request sent to the backend,
+// replacing any copy the client sent. It describes the client of r, the
+// request as the client sent it, and must run once out's method, Host and
+// target are final.
+func (e *Envelope) Seal(out, r *http.Request) {
+	ip := clientip.FromContext(r.Context())
+	if ip == "" {
+		ip = clientip.From(r)
+	}
+	data := envelopeData{
+		Version: 2,
+		IP:      ip,
+		Method:  r.Method,
+		Host:    r.Host,
+		Path:    r.URL.RequestURI(),
+		Sent:    time.Now().UnixMilli(),
+	}
+	if e.Network != nil {
+		data.Network = e.Network(ip)
+	}
+	if at, ok := r.Context().Value(receivedKey{}).(time.Time); ok {
+		data.Received = at.UnixMilli()
+	}
+	if r.TLS != nil {
+		data.TLS = &envelopeTLS{
+			Version:     tls.VersionName(r.TLS.Version),
+			CipherSuite: tls.CipherSuiteName(r.TLS.CipherSuite),
+			ServerName:  r.TLS.ServerName,
+			ALPN:        r.TLS.NegotiatedProtocol,
+		}
+	}
+
+	plaintext, _ := json.Marshal(data)
+	nonce := make([]byte, e.aead.NonceSize(), e.aead.NonceSize()+len(plaintext)+e.aead.Overhead())
+	rand.Read(nonce)
+	out.Header.Set(e.header, base64.RawURLEncoding.EncodeToString(e.aead.Seal(nonce, nonce, plaintext, envelopeAAD(out))))
+}
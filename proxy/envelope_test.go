@@ -0,0 +1,114 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google-redirector/clientip"
+	"google-redirector/config"
+)
+
+const testEnvelopeKey = "000102030405060708090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f"
+
+// openEnvelope decrypts the envelope of out, the request the backend
+// received, the way the team server would.
+func openEnvelope(t *testing.T, e *Envelope, out *http.Request) envelopeData {
+	t.Helper()
+	value := out.Header.Get(e.header)
+	raw, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil || len(raw) < e.aead.NonceSize() {
+		t.Fatalf("Expected a base64url envelope, got %q", value)
+	}
+	plaintext, err := e.aead.Open(nil, raw[:e.aead.NonceSize()], raw[e.aead.NonceSize():], []byte(out.Method+"\n"+out.Host+"\n"+out.URL.RequestURI()))
+	if err != nil {
+		t.Fatalf("Expected the envelope to decrypt: %v", err)
+	}
+	var data envelopeData
+	if err := json.Unmarshal(plaintext, &data); err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestEnvelope_Seal(t *testing.T) {
+	e, err := NewEnvelope(config.FromMap(map[string]string{"CLIENT_ENVELOPE_KEY": testEnvelopeKey}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Network = func(ip string) *ClientNetwork {
+		return &ClientNetwork{ASN: 64500, Country: "NL", Org: "EXAMPLE-" + ip}
+	}
+
+	r := httptest.NewRequest("POST", "https://cdn.example.com/api/v1?x=1", nil)
+	r.RemoteAddr = "198.51.100.7:4444"
+	r.Header.Set("X-Client-Envelope", "forged")
+	r.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, CipherSuite: tls.TLS_AES_128_GCM_SHA256, ServerName: "cdn.example.com", NegotiatedProtocol: "h2"}
+	received := time.UnixMilli(1_700_000_000_123)
+	r = Received(clientip.With(r), received)
+
+	e.Seal(r, r)
+	data := openEnvelope(t, e, r)
+	if data.IP != "198.51.100.7" || data.Method != "POST" || data.Host != "cdn.example.com" || data.Path != "/api/v1?x=1" {
+		t.Errorf("Expected the request's client and target, got %+v", data)
+	}
+	if data.Network == nil || data.Network.ASN != 64500 || data.Network.Org != "EXAMPLE-198.51.100.7" {
+		t.Errorf("Expected the client's network, got %+v", data.Network)
+	}
+	if data.TLS == nil || data.TLS.Version != "TLS 1.3" || data.TLS.CipherSuite != "TLS_AES_128_GCM_SHA256" || data.TLS.ALPN != "h2" {
+		t.Errorf("Expected the TLS parameters, got %+v", data.TLS)
+	}
+	if data.Received != received.UnixMilli() || data.Sent < data.Received {
+		t.Errorf("Expected received %d and a later sent time, got %d and %d", received.UnixMilli(), data.Received, data.Sent)
+	}
+
+	// Each seal uses a fresh nonce, and tampering breaks authentication
+	first := r.Header.Get("X-Client-Envelope")
+	e.Seal(r, r)
+	if r.Header.Get("X-Client-Envelope") == first {
+		t.Error("Expected a different envelope each time")
+	}
+
+	// The backend's request is the additional data, and the client's is
+	// what the envelope describes
+	out := httptest.NewRequest("POST", "http://10.0.0.5:8080/c2/v1?x=1", nil)
+	e.Seal(out, r)
+	if data := openEnvelope(t, e, out); data.Host != "cdn.example.com" || data.Path != "/api/v1?x=1" {
+		t.Errorf("Expected the client's target in the envelope, got %+v", data)
+	}
+	out.Header.Set("X-Client-Envelope", first)
+	raw, _ := base64.RawURLEncoding.DecodeString(first)
+	if _, err := e.aead.Open(nil, raw[:e.aead.NonceSize()], raw[e.aead.NonceSize():], []byte("POST\n10.0.0.5:8080\n/c2/v1?x=1")); err == nil {
+		t.Error("Expected an envelope moved to another request to fail authentication")
+	}
+	raw[len(raw)-1] ^= 1
+	if _, err := e.aead.Open(nil, raw[:e.aead.NonceSize()], raw[e.aead.NonceSize():], []byte("POST\ncdn.example.com\n/api/v1?x=1")); err == nil {
+		t.Error("Expected a tampered envelope to fail authentication")
+	}
+}
+
+func TestEnvelope_Config(t *testing.T) {
+	if e, err := NewEnvelope(config.FromMap(nil)); e != nil || err != nil {
+		t.Errorf("Expected no envelope by default, got %v (%v)", e, err)
+	}
+	b64 := base64.StdEncoding.EncodeToString([]byte(strings.Repeat("k", 32)))
+	e, err := NewEnvelope(config.FromMap(map[string]string{"CLIENT_ENVELOPE_KEY": b64, "CLIENT_ENVELOPE_HEADER": "X-Ctx"}))
+	if err != nil {
+		t.Fatalf("Expected a base64 key to be accepted: %v", err)
+	}
+	r := httptest.NewRequest("GET", "/", nil)
+	e.Seal(r, r)
+	if r.Header.Get("X-Ctx") == "" {
+		t.Error("Expected CLIENT_ENVELOPE_HEADER to be used")
+	}
+	for _, key := range []string{"0011", "not a key", base64.StdEncoding.EncodeToString([]byte("short"))} {
+		if _, err := NewEnvelope(config.FromMap(map[string]string{"CLIENT_ENVELOPE_KEY": key})); err == nil {
+			t.Errorf("Expected an error for key %q", key)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	mathrand "math/rand"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"google-redirector/config"
+)
+
+// Obfuscator blurs the size and timing of traffic on the backend leg, so an
+// observer between the redirector and the team server learns less from
+// packet lengths and inter-arrival times. Messages are padded up to the next
+// of a fixed set of bucket sizes, and each one is held back by a random
+// delay. Padding is carried where the backend ignores it: a junk header on
+// HTTP requests and unsolicited pong frames on WebSockets.
+type Obfuscator struct {
+	buckets   []int
+	header    string
+	jitterMin time.Duration
+	jitterMax time.Duration
+}
+
+// NewObfuscator returns nil unless PAD_BUCKETS or BACKEND_JITTER_MAX is set.
+func NewObfuscator(cfg *config.Config) (*Obfuscator, error) {
+	o := &Obfuscator{
+		header:    cfg.String("PAD_HEADER", "X-Pad"),
+		jitterMin: cfg.Duration("BACKEND_JITTER_MIN", 0),
+		jitterMax: cfg.Duration("BACKEND_JITTER_MAX", 0),
+	}
+	for _, v := range cfg.List("PAD_BUCKETS", "") {
+		n, err := config.ParseByteSize("PAD_BUCKETS", v)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return nil, fmt.Errorf("invalid PAD_BUCKETS size %q", v)
+		}
+		o.buckets = append(o.buckets, int(n))
+	}
+	sort.Ints(o.buckets)
+
+	if len(o.buckets) == 0 && o.jitterMax == 0 {
+		return nil, nil
+	}
+	if o.jitterMin < 0 || o.jitterMax < o.jitterMin {
+		return nil, fmt.Errorf("BACKEND_JITTER_MIN must be between 0 and BACKEND_JITTER_MAX")
+	}
+	return o, nil
+}
+
+func (o *Obfuscator) String() string {
+	var parts []string
+	if len(o.buckets) > 0 {
+		parts = append(parts, fmt.Sprintf("%d size buckets up to %d bytes", len(o.buckets), o.buckets[len(o.buckets)-1]))
+	}
+	if o.jitterMax > 0 {
+		parts = append(parts, fmt.Sprintf("jitter %v-%v", o.jitterMin, o.jitterMax))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Pads reports whether PAD_BUCKETS is configured.
+func (o *Obfuscator) Pads() bool {
+	return len(o.buckets) > 0
+}
+
+// Padding returns how many bytes to add to a message of n bytes to reach a
+// bucket, given that padding costs at least overhead bytes once added.
+// Messages past the largest bucket are rounded up to a multiple of it.
+func (o *Obfuscator) Padding(n, overhead int) int {
+	if len(o.buckets) == 0 {
+		return 0
+	}
+	target := n
+	for {
+		target = o.bucket(target)
+		if pad := target - n; pad == 0 || pad >= overhead {
+			return pad
+		}
+		target++
+	}
+}
+
+func (o *Obfuscator) bucket(n int) int {
+	for _, b := range o.buckets {
+		if n <= b {
+			return b
+		}
+	}
+	largest := o.buckets[len(o.buckets)-1]
+	return (n + largest - 1) / largest * largest
+}
+
+// Jitter returns a random delay between BACKEND_JITTER_MIN and
+// BACKEND_JITTER_MAX.
+func (o *Obfuscator) Jitter() time.Duration {
+	if o.jitterMax <= o.jitterMin {
+		return o.jitterMin
+	}
+	return o.jitterMin + time.Duration(mathrand.Int63n(int64(o.jitterMax-o.jitterMin)))
+}
+
+// Wait sleeps for Jitter, returning early with ctx's error if it ends first.
+func (o *Obfuscator) Wait(ctx context.Context) error {
+	d := o.Jitter()
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// PadRequest sets the padding header so req's estimated size on the wire
+// lands on a bucket. Bodies of unknown length count as empty.
+func (o *Obfuscator) PadRequest(req *http.Request) {
+	overhead := len(o.header) + len(": \r\n") + 1
+	if pad := o.Padding(requestSize(req), overhead); pad > 0 {
+		req.Header.Set(o.header, randomText(pad-overhead+1))
+	}
+}
+
+// requestSize estimates the HTTP/1.1 encoding of req (request line, headers
+// and body), not counting the few headers net/http adds on its own.
+func requestSize(req *http.Request) int {
+	n := len(req.Method) + len(req.URL.RequestURI()) + len("  HTTP/1.1\r\n")
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	n += len("Host: \r\n") + len(host)
+	for name, values := range req.Header {
+		for _, v := range values {
+			n += len(name) + len(": \r\n") + len(v)
+		}
+	}
+	n += len("\r\n")
+	if req.ContentLength > 0 {
+		n += int(req.ContentLength)
+	}
+	return n
+}
+
+// randomText returns n bytes of random header-safe text.
+func randomText(n int) string {
+	raw := make([]byte, n*3/4+3)
+	rand.Read(raw)
+	return base64.RawURLEncoding.EncodeToString(raw)[:n]
+}
+
+// Transport pads and delays every request before handing it to next.
+func (o *Obfuscator) Transport(next http.RoundTripper) http.RoundTripper {
+	return &obfuscatingTransport{obfs: o, next: next}
+}
+
+type obfuscatingTransport struct {
+	obfs *Obfuscator
+	next http.RoundTripper
+}
+
+func (t *obfuscatingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.obfs.Pads() {
+		req = req.Clone(req.Context())
+		t.obfs.PadRequest(req)
+	}
+	if err := t.obfs.Wait(req.Context()); err != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, err
+	}
+	return t.next.RoundTrip(req)
+}
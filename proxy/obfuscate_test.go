@@ -0,0 +1,94 @@
+package proxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google-redirector/config"
+)
+
+func TestObfuscator_Padding(t *testing.T) {
+	o, err := NewObfuscator(config.FromMap(map[string]string{"PAD_BUCKETS": "1K,256,4K"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct{ n, overhead, want int }{
+		{100, 6, 156},
+		{256, 6, 0},
+		{253, 6, 1024 - 253},
+		{1000, 6, 24},
+		{5000, 6, 8192 - 5000},
+	}
+	for _, tt := range tests {
+		if got := o.Padding(tt.n, tt.overhead); got != tt.want {
+			t.Errorf("Padding(%d, %d): expected %d, got %d", tt.n, tt.overhead, tt.want, got)
+		}
+	}
+}
+
+func TestObfuscator_Config(t *testing.T) {
+	if o, err := NewObfuscator(config.FromMap(nil)); o != nil || err != nil {
+		t.Errorf("Expected obfuscation to be disabled by default, got %v (%v)", o, err)
+	}
+	for _, settings := range []map[string]string{
+		{"PAD_BUCKETS": "512,big"},
+		{"PAD_BUCKETS": "0"},
+		{"BACKEND_JITTER_MIN": "50ms", "BACKEND_JITTER_MAX": "10ms"},
+	} {
+		if _, err := NewObfuscator(config.FromMap(settings)); err == nil {
+			t.Errorf("%v: expected configuration error", settings)
+		}
+	}
+}
+
+func TestObfuscator_PadRequest(t *testing.T) {
+	o, err := NewObfuscator(config.FromMap(map[string]string{"PAD_BUCKETS": "512,2K"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, body := range []string{"", "hello", strings.Repeat("x", 600)} {
+		req := httptest.NewRequest("POST", "http://backend.test/submit?id=1", strings.NewReader(body))
+		req.Header.Set("Cookie", "session=abc")
+		o.PadRequest(req)
+		if n := requestSize(req); n != 512 && n != 2048 {
+			t.Errorf("%d-byte body: expected request padded to a bucket, got %d bytes", len(body), n)
+		}
+		if req.Header.Get("X-Pad") == "" {
+			t.Errorf("%d-byte body: expected padding header", len(body))
+		}
+	}
+}
+
+func TestObfuscator_Transport(t *testing.T) {
+	var got *http.Request
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r
+	}))
+	defer backend.Close()
+
+	o, err := NewObfuscator(config.FromMap(map[string]string{
+		"PAD_BUCKETS":        "1K",
+		"BACKEND_JITTER_MIN": "50ms",
+		"BACKEND_JITTER_MAX": "60ms",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := &http.Client{Transport: o.Transport(http.DefaultTransport)}
+
+	start := time.Now()
+	resp, err := client.Get(backend.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("Expected the request to be delayed by the jitter, took %v", elapsed)
+	}
+	if got == nil || len(got.Header.Get("X-Pad")) < 100 {
+		t.Errorf("Expected the padding header to reach the backend")
+	}
+}
@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"google-redirector/config"
+)
+
+// WarmPool keeps a few connections to each backend already dialed (and for
+// HTTPS backends already past the TLS handshake) so the first request after
+// an idle period, or on a cold-started instance, skips DNS, TCP and TLS
+// setup. It plugs into http.Transport as DialContext/DialTLSContext; the
+// transport's own keep-alive pool is used first and this only covers the
+// cases where that is empty.
+type WarmPool struct {
+	size   int
+	maxAge time.Duration
+	dialer *net.Dialer
+	tls    *tls.Config
+	wake   chan struct{} // a connection was taken
+
+	mu      sync.Mutex
+	targets []warmTarget
+	conns   map[warmTarget][]warmConn
+}
+
+type warmTarget struct {
+	addr   string
+	useTLS bool
+}
+
+type warmConn struct {
+	conn    net.Conn
+	created time.Time
+}
+
+// NewWarmPool returns nil unless BACKEND_PREWARM_CONNS is positive.
+func NewWarmPool(cfg *config.Config, pool *Pool, dialer *net.Dialer, tlsConfig *tls.Config) *WarmPool {
+	size := cfg.Int("BACKEND_PREWARM_CONNS", 0)
+	if size <= 0 {
+		return nil
+	}
+
+	w := &WarmPool{
+		size:   size,
+		maxAge: cfg.Duration("BACKEND_PREWARM_MAX_AGE", time.Minute),
+		dialer: dialer,
+		tls:    tlsConfig,
+		wake:   make(chan struct{}, 1),
+		conns:  make(map[warmTarget][]warmConn),
+	}
+	for _, b := range pool.backends {
+		w.targets = append(w.targets, warmTargetFor(b.URL))
+	}
+	return w
+}
+
+// Start keeps the pool topped up in the background until ctx is cancelled,
+// then closes the connections still waiting in it.
+func (w *WarmPool) Start(ctx context.Context) {
+	go w.refillLoop(ctx)
+}
+
+func warmTargetFor(u *url.URL) warmTarget {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return warmTarget{addr: net.JoinHostPort(u.Hostname(), port), useTLS: u.Scheme == "https"}
+}
+
+// Dial and DialTLS hand out a warm connection when one is available and
+// still alive, and dial a fresh one otherwise.
+func (w *WarmPool) Dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	if c := w.take(warmTarget{addr: addr}); c != nil {
+		return c, nil
+	}
+	return w.dialer.DialContext(ctx, network, addr)
+}
+
+func (w *WarmPool) DialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	target := warmTarget{addr: addr, useTLS: true}
+	if c := w.take(target); c != nil {
+		return c, nil
+	}
+	return w.connect(ctx, target)
+}
+
+func (w *WarmPool) connect(ctx context.Context, target warmTarget) (net.Conn, error) {
+	conn, err := w.dialer.DialContext(ctx, "tcp", target.addr)
+	if err != nil || !target.useTLS {
+		return conn, err
+	}
+
+	cfg := w.tls.Clone()
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(target.addr)
+	}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func (w *WarmPool) take(target warmTarget) net.Conn {
+	for {
+		w.mu.Lock()
+		conns := w.conns[target]
+		if len(conns) == 0 {
+			w.mu.Unlock()
+			return nil
+		}
+		c := conns[len(conns)-1]
+		w.conns[target] = conns[:len(conns)-1]
+		w.mu.Unlock()
+		select {
+		case w.wake <- struct{}{}:
+		default:
+		}
+
+		if time.Since(c.created) < w.maxAge && alive(c.conn) {
+			return c.conn
+		}
+		c.conn.Close()
+	}
+}
+
+// alive checks that the peer hasn't closed an idle connection, with a read
+// whose deadline has all but passed: timing out means the connection is open
+// with nothing pending, and for TLS it also processes post-handshake
+// messages such as session tickets. Nothing is read from a connection that
+// is still usable. A connection that does have bytes pending is not, since
+// no request has been sent on it yet: an HTTP/1.1 server only speaks first
+// to send a final error before closing.
+func alive(conn net.Conn) bool {
+	conn.SetReadDeadline(time.Now().Add(time.Millisecond))
+	n, err := conn.Read(make([]byte, 1))
+	conn.SetReadDeadline(time.Time{})
+	return n == 0 && errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+// refillInterval is how often the pool is topped up and aged out: a quarter
+// of maxAge, so connections are retired close to it, and at once whenever
+// one is taken.
+func (w *WarmPool) refillInterval() time.Duration {
+	if d := w.maxAge / 4; d > time.Second {
+		return d
+	}
+	return time.Second
+}
+
+// refillLoop tops every backend up to size warm connections and retires
+// ones older than maxAge, before backends' idle timeouts get to them.
+func (w *WarmPool) refillLoop(ctx context.Context) {
+	ticker := time.NewTicker(w.refillInterval())
+	defer ticker.Stop()
+	for {
+		for _, target := range w.targets {
+			w.refill(ctx, target)
+		}
+		select {
+		case <-ctx.Done():
+			w.drain()
+			return
+		case <-ticker.C:
+		case <-w.wake:
+		}
+	}
+}
+
+func (w *WarmPool) refill(ctx context.Context, target warmTarget) {
+	w.mu.Lock()
+	fresh := w.conns[target][:0]
+	for _, c := range w.conns[target] {
+		if time.Since(c.created) < w.maxAge {
+			fresh = append(fresh, c)
+		} else {
+			c.conn.Close()
+		}
+	}
+	w.conns[target] = fresh
+	missing := w.size - len(fresh)
+	w.mu.Unlock()
+
+	for i := 0; i < missing; i++ {
+		dialCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
+		conn, err := w.connect(dialCtx, target)
+		cancel()
+		if ctx.Err() != nil {
+			if conn != nil {
+				conn.Close()
+			}
+			return
+		}
+		if err != nil {
+			log.Printf("Pre-warming connection to %s failed: %v", target.addr, err)
+			return
+		}
+		w.mu.Lock()
+		w.conns[target] = append(w.conns[target], warmConn{conn: conn, created: time.Now()})
+		w.mu.Unlock()
+	}
+}
+
+// drain closes and forgets every warm connection.
+func (w *WarmPool) drain() {
+	w.mu.Lock()
+	conns := w.conns
+	w.conns = make(map[warmTarget][]warmConn)
+	w.mu.Unlock()
+	for _, list := range conns {
+		for _, c := range list {
+			c.conn.Close()
+		}
+	}
+}
+
+func (w *WarmPool) String() string {
+	return fmt.Sprintf("%d per backend (max age %v)", w.size, w.maxAge)
+}
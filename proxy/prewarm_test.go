@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWarmPool_ReusesPreDialedConnections(t *testing.T) {
+	var handshakes atomic.Int32
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	server.TLS = &tls.Config{VerifyConnection: func(tls.ConnectionState) error {
+		handshakes.Add(1)
+		return nil
+	}}
+	server.StartTLS()
+	defer server.Close()
+
+	u, _ := url.Parse(server.URL)
+	w := &WarmPool{
+		size:   1,
+		maxAge: time.Minute,
+		dialer: NewDialer(time.Second, nil),
+		tls:    &tls.Config{InsecureSkipVerify: true},
+		conns:  make(map[warmTarget][]warmConn),
+	}
+	target := warmTargetFor(u)
+	w.refill(context.Background(), target)
+	if handshakes.Load() != 1 || len(w.conns[target]) != 1 {
+		t.Fatalf("Expected one warm connection, got %d (handshakes %d)", len(w.conns[target]), handshakes.Load())
+	}
+
+	client := &http.Client{Transport: &http.Transport{DialTLSContext: w.DialTLS}}
+	resp, err := client.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	if handshakes.Load() != 1 {
+		t.Errorf("Expected request to use the warm connection, saw %d handshakes", handshakes.Load())
+	}
+	if len(w.conns[target]) != 0 {
+		t.Error("Expected warm connection to be taken from the pool")
+	}
+}
+
+func TestWarmPool_DiscardsClosedConnections(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	u, _ := url.Parse(server.URL)
+
+	w := &WarmPool{
+		size:   1,
+		maxAge: time.Minute,
+		dialer: NewDialer(time.Second, nil),
+		conns:  make(map[warmTarget][]warmConn),
+	}
+	target := warmTargetFor(u)
+	w.refill(context.Background(), target)
+	server.CloseClientConnections()
+	server.Close()
+	time.Sleep(10 * time.Millisecond)
+
+	if c := w.take(target); c != nil {
+		t.Error("Expected a connection closed by the server to be discarded")
+	}
+	if _, err := w.Dial(context.Background(), "tcp", target.addr); err == nil {
+		t.Error("Expected fresh dial to a stopped server to fail")
+	}
+}
+
+func TestWarmPool_DiscardsConnectionsWithPendingData(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			// A server giving up on an idle connection
+			c.Write([]byte("HTTP/1.1 408 Request Timeout\r\n\r\n"))
+		}
+	}()
+
+	w := &WarmPool{
+		size:   1,
+		maxAge: time.Minute,
+		dialer: NewDialer(time.Second, nil),
+		conns:  make(map[warmTarget][]warmConn),
+	}
+	target := warmTarget{addr: ln.Addr().String()}
+	w.refill(context.Background(), target)
+	time.Sleep(10 * time.Millisecond)
+	if c := w.take(target); c != nil {
+		t.Error("Expected a connection the server already answered on to be discarded")
+	}
+}
+
+func TestWarmPool_ClosesConnectionsWhenStopped(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	w := &WarmPool{
+		size:    2,
+		maxAge:  time.Minute,
+		dialer:  NewDialer(time.Second, nil),
+		wake:    make(chan struct{}, 1),
+		conns:   make(map[warmTarget][]warmConn),
+		targets: []warmTarget{warmTargetFor(u)},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		w.refillLoop(ctx)
+		close(done)
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		w.mu.Lock()
+		n := len(w.conns[w.targets[0]])
+		w.mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+	}
+	w.mu.Lock()
+	warm := append([]warmConn(nil), w.conns[w.targets[0]]...)
+	w.mu.Unlock()
+	if len(warm) != 2 {
+		t.Fatalf("Expected two warm connections, got %d", len(warm))
+	}
+
+	cancel()
+	<-done
+	if len(w.conns) != 0 {
+		t.Error("Expected the pool to be emptied once stopped")
+	}
+	for _, c := range warm {
+		if _, err := c.conn.Write([]byte("GET / HTTP/1.1\r\n\r\n")); err == nil {
+			t.Error("Expected warm connections to be closed once stopped")
+		}
+	}
+}
+
+func TestWarmPool_RefillInterval(t *testing.T) {
+	if got := (&WarmPool{maxAge: time.Minute}).refillInterval(); got != 15*time.Second {
+		t.Errorf("Expected a quarter of the max age, got %v", got)
+	}
+	if got := (&WarmPool{maxAge: time.Second}).refillInterval(); got != time.Second {
+		t.Errorf("Expected at least a second, got %v", got)
+	}
+}
@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Vectors from the AWS SigV4 test suite (get-vanilla, post-vanilla,
+// get-vanilla-query-order-key-case), and get-vanilla with a path holding
+// sub-delims, which go on the wire unescaped.
+func TestSigV4_Sign(t *testing.T) {
+	signer := &Signer{
+		AccessKey: "AKIDEXAMPLE",
+		SecretKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+		Region:    "us-east-1",
+		Service:   "service",
+	}
+	now := time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC)
+
+	tests := []struct {
+		method    string
+		target    string
+		signature string
+	}{
+		{"GET", "https://example.amazonaws.com/", "5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"},
+		{"POST", "https://example.amazonaws.com/", "5da7c1a2acd57cee7505fc6676e4e544621c30862966e37dddb68e92efbe5d6b"},
+		{"GET", "https://example.amazonaws.com/?Param2=value2&Param1=value1", "b97d918cfa904a5beff61c982a1b6f458b799221646efd99d3219ec94cdf2500"},
+		{"GET", "https://example.amazonaws.com/a:b@c", "57f6e9b66f9382f699e8dea99ecde528229e72799f5b72b7dc6116a550076aed"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, nil)
+		if err := signer.Sign(req, now); err != nil {
+			t.Fatalf("%s %s: sign failed: %v", tt.method, tt.target, err)
+		}
+
+		want := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, " +
+			"SignedHeaders=host;x-amz-date, Signature=" + tt.signature
+		if got := req.Header.Get("Authorization"); got != want {
+			t.Errorf("%s %s:\n got %s\nwant %s", tt.method, tt.target, got, want)
+		}
+	}
+}
+
+func TestSigV4_SessionTokenAndBody(t *testing.T) {
+	signer := &Signer{
+		AccessKey:    "AKIDEXAMPLE",
+		SecretKey:    "secret",
+		SessionToken: "token",
+		Region:       "eu-west-1",
+		Service:      "execute-api",
+	}
+
+	req := httptest.NewRequest("POST", "https://abc.execute-api.eu-west-1.amazonaws.com/prod/x", strings.NewReader("payload"))
+	req.Host = "redirector.run.app"
+	if err := signer.Sign(req, time.Now()); err != nil {
+		t.Fatalf("sign failed: %v", err)
+	}
+
+	if req.Host != "abc.execute-api.eu-west-1.amazonaws.com" {
+		t.Errorf("Expected Host to be rewritten to backend, got %s", req.Host)
+	}
+	if req.Header.Get("X-Amz-Security-Token") != "token" {
+		t.Errorf("Expected session token header to be set")
+	}
+	if !strings.Contains(req.Header.Get("Authorization"), "SignedHeaders=host;x-amz-date;x-amz-security-token,") {
+		t.Errorf("Expected session token to be signed, got %s", req.Header.Get("Authorization"))
+	}
+
+	body := make([]byte, 16)
+	n, _ := req.Body.Read(body)
+	if string(body[:n]) != "payload" {
+		t.Errorf("Expected body to be preserved, got %q", body[:n])
+	}
+}
+
+func TestSigV4_CanonicalQuery(t *testing.T) {
+	u, _ := url.Parse("https://example.com/?id2=b&id=a&id=A&a%20b=c")
+	if got, want := canonicalQuery(u), "a%20b=c&id=A&id=a&id2=b"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestSigV4_MaxBody(t *testing.T) {
+	signer := &Signer{AccessKey: "a", SecretKey: "s", Region: "us-east-1", Service: "lambda", MaxBody: 4}
+	if err := signer.Sign(httptest.NewRequest("POST", "https://example.com/", strings.NewReader("1234")), time.Now()); err != nil {
+		t.Errorf("Expected a body at the limit to be signed, got %v", err)
+	}
+	if err := signer.Sign(httptest.NewRequest("POST", "https://example.com/", strings.NewReader("12345")), time.Now()); err == nil {
+		t.Error("Expected a body over the limit to be refused")
+	}
+}
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"strings"
+	"syscall"
+	"time"
+
+	"google-redirector/config"
+)
+
+// blockedPrefixes are destinations the redirector refuses to dial when SSRF
+// protection is on: loopback, link-local (including the 169.254.169.254
+// metadata endpoint), RFC1918/ULA private space, shared address space
+// (where many cloud VPCs and Alibaba's 100.100.100.200 metadata endpoint
+// live), IETF protocol assignments, NAT64 (which maps straight onto IPv4
+// internals) and multicast and broadcast.
+var blockedPrefixes = []struct {
+	prefix netip.Prefix
+	reason string
+}{
+	{netip.MustParsePrefix("0.0.0.0/8"), "unspecified"},
+	{netip.MustParsePrefix("127.0.0.0/8"), "loopback"},
+	{netip.MustParsePrefix("10.0.0.0/8"), "private"},
+	{netip.MustParsePrefix("172.16.0.0/12"), "private"},
+	{netip.MustParsePrefix("192.168.0.0/16"), "private"},
+	{netip.MustParsePrefix("169.254.0.0/16"), "link-local"},
+	{netip.MustParsePrefix("100.64.0.0/10"), "shared"},
+	{netip.MustParsePrefix("192.0.0.0/24"), "protocol assignment"},
+	{netip.MustParsePrefix("224.0.0.0/4"), "multicast"},
+	{netip.MustParsePrefix("255.255.255.255/32"), "broadcast"},
+	{netip.MustParsePrefix("::/128"), "unspecified"},
+	{netip.MustParsePrefix("::1/128"), "loopback"},
+	{netip.MustParsePrefix("fe80::/10"), "link-local"},
+	{netip.MustParsePrefix("fc00::/7"), "private"},
+	{netip.MustParsePrefix("64:ff9b::/96"), "NAT64"},
+	{netip.MustParsePrefix("ff00::/8"), "multicast"},
+}
+
+// DialGuard rejects backend connections to internal addresses. Checks run
+// against the resolved IP at dial time, so DNS rebinding a public hostname
+// onto an internal address is caught as well.
+type DialGuard struct {
+	allowed []netip.Prefix
+}
+
+// NewDialGuard returns nil when SSRF protection is disabled. Protection
+// defaults to on when HARDENED_MODE is set.
+func NewDialGuard(cfg *config.Config) (*DialGuard, error) {
+	if !cfg.Bool("SSRF_PROTECTION", cfg.Bool("HARDENED_MODE", false)) {
+		return nil, nil
+	}
+
+	g := &DialGuard{}
+	for _, entry := range cfg.List("SSRF_ALLOW_CIDRS", "") {
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid SSRF_ALLOW_CIDRS entry %q: %v", entry, err)
+			}
+			g.allowed = append(g.allowed, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SSRF_ALLOW_CIDRS entry %q: %v", entry, err)
+		}
+		g.allowed = append(g.allowed, prefix.Masked())
+	}
+	return g, nil
+}
+
+// check returns an error if ip is an internal destination that has not been
+// explicitly allowed.
+func (g *DialGuard) check(ip netip.Addr) error {
+	ip = ip.Unmap()
+	for _, p := range g.allowed {
+		if p.Contains(ip) {
+			return nil
+		}
+	}
+	for _, b := range blockedPrefixes {
+		if b.prefix.Contains(ip) {
+			return fmt.Errorf("refusing to dial %s address %s", b.reason, ip)
+		}
+	}
+	return nil
+}
+
+// control is installed as net.Dialer.Control and sees the address after DNS
+// resolution, immediately before connect.
+func (g *DialGuard) control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return fmt.Errorf("refusing to dial unparseable address %q", address)
+	}
+	return g.check(addrPort.Addr())
+}
+
+func (g *DialGuard) String() string {
+	return fmt.Sprintf("%d allowed ranges", len(g.allowed))
+}
+
+// NewDialer returns the dialer used for every backend connection, applying
+// guard when it is non-nil.
+func NewDialer(timeout time.Duration, guard *DialGuard) *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if guard != nil {
+		d.Control = guard.control
+	}
+	return d
+}
@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestDialGuard_Check(t *testing.T) {
+	guard := &DialGuard{allowed: []netip.Prefix{netip.MustParsePrefix("10.1.0.0/16")}}
+
+	tests := []struct {
+		addr    string
+		blocked bool
+	}{
+		{"8.8.8.8", false},
+		{"2001:4860:4860::8888", false},
+		{"127.0.0.1", true},
+		{"::1", true},
+		{"169.254.169.254", true},
+		{"::ffff:169.254.169.254", true},
+		{"fd00:ec2::254", true},
+		{"100.100.100.200", true},
+		{"100.64.0.1", true},
+		{"100.127.255.254", true},
+		{"100.128.0.1", false},
+		{"192.0.0.170", true},
+		{"192.0.2.1", false},
+		{"64:ff9b::a9fe:a9fe", true},
+		{"64:ff9b::808:808", true},
+		{"224.0.0.1", true},
+		{"239.255.255.250", true},
+		{"255.255.255.255", true},
+		{"ff02::1", true},
+		{"::ffff:100.64.0.1", true},
+		{"192.168.1.10", true},
+		{"172.31.255.1", true},
+		{"10.2.0.1", true},
+		{"10.1.2.3", false},
+	}
+
+	for _, tt := range tests {
+		err := guard.check(netip.MustParseAddr(tt.addr))
+		if (err != nil) != tt.blocked {
+			t.Errorf("%s: expected blocked=%v, got err=%v", tt.addr, tt.blocked, err)
+		}
+	}
+}
+
+func TestDialGuard_Dialer(t *testing.T) {
+	dialer := NewDialer(0, &DialGuard{})
+	_, err := dialer.Dial("tcp", "127.0.0.1:1")
+	if err == nil || !strings.Contains(err.Error(), "refusing to dial loopback") {
+		t.Fatalf("Expected dial to loopback to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,359 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"google-redirector/config"
+)
+
+// tokenBucket is a byte-rate limiter. Callers take tokens immediately and
+// sleep off any deficit, which keeps the copy loops simple: read a chunk no
+// larger than the burst, then wait before passing it on.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst int64) *tokenBucket {
+	if burst <= 0 {
+		burst = rate
+	}
+	return &tokenBucket{
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// reserve takes n tokens and returns how long the caller must wait before
+// the bytes may be sent.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) setRate(rate float64) {
+	b.mu.Lock()
+	b.rate = rate
+	b.mu.Unlock()
+}
+
+// Throttle hands out limiters combining a fresh per-connection bucket, a
+// bucket shared by every connection from the same client IP and a share of
+// the global egress cap. Each HTTP request and each WebSocket tunnel counts
+// as one connection; bytes in both directions draw from the same buckets.
+type Throttle struct {
+	connRate int64
+	ipRate   int64
+	burst    int64
+	egress   *egressCap
+
+	mu        sync.Mutex
+	ips       map[string]*ipBucket
+	lastSweep time.Time
+}
+
+// ipBucket outlives the connections using it, so back-to-back requests from
+// one client keep drawing from the same tokens instead of each starting with
+// a full burst. It is dropped once it has been idle long enough to have
+// refilled, when a fresh bucket would be no different.
+type ipBucket struct {
+	bucket    *tokenBucket
+	refs      int
+	idleSince time.Time
+}
+
+// NewThrottle returns nil when none of THROTTLE_CONN_RATE,
+// THROTTLE_IP_RATE or EGRESS_RATE is set.
+func NewThrottle(cfg *config.Config) (*Throttle, error) {
+	t := &Throttle{ips: make(map[string]*ipBucket)}
+	var err error
+	if t.connRate, err = cfg.ByteSize("THROTTLE_CONN_RATE", "0"); err != nil {
+		return nil, err
+	}
+	if t.ipRate, err = cfg.ByteSize("THROTTLE_IP_RATE", "0"); err != nil {
+		return nil, err
+	}
+	if t.burst, err = cfg.ByteSize("THROTTLE_BURST", "0"); err != nil {
+		return nil, err
+	}
+	egressRate, err := cfg.ByteSize("EGRESS_RATE", "0")
+	if err != nil {
+		return nil, err
+	}
+	if egressRate > 0 {
+		t.egress = newEgressCap(egressRate, t.burst)
+	}
+	if t.connRate == 0 && t.ipRate == 0 && t.egress == nil {
+		return nil, nil
+	}
+	return t, nil
+}
+
+// Limiter returns the buckets that apply to a new connection from ip. The
+// caller must call Release when the connection ends. Waits for tokens end
+// early with ctx's error once ctx is done.
+func (t *Throttle) Limiter(ctx context.Context, ip string) *Limiter {
+	l := &Limiter{ctx: ctx, chunk: 32 * 1024, release: func() {}}
+	if t.connRate > 0 {
+		l.buckets = append(l.buckets, newTokenBucket(t.connRate, t.burst))
+	}
+	if t.ipRate > 0 {
+		t.mu.Lock()
+		t.sweep(time.Now())
+		entry, ok := t.ips[ip]
+		if !ok {
+			entry = &ipBucket{bucket: newTokenBucket(t.ipRate, t.burst)}
+			t.ips[ip] = entry
+		}
+		entry.refs++
+		t.mu.Unlock()
+
+		l.buckets = append(l.buckets, entry.bucket)
+		l.release = func() {
+			t.mu.Lock()
+			if entry.refs--; entry.refs == 0 {
+				entry.idleSince = time.Now()
+			}
+			t.mu.Unlock()
+		}
+	}
+	if t.egress != nil {
+		share := t.egress.join()
+		l.share = share
+		l.buckets = append(l.buckets, t.egress.bucket, share.bucket)
+		ipRelease := l.release
+		l.release = func() {
+			ipRelease()
+			t.egress.leave(share)
+		}
+	}
+	for _, b := range l.buckets {
+		if int(b.burst) < l.chunk {
+			l.chunk = int(b.burst)
+		}
+	}
+	return l
+}
+
+// ipIdle is how long an unused per-IP bucket takes to refill completely.
+func (t *Throttle) ipIdle() time.Duration {
+	burst := t.burst
+	if burst <= 0 {
+		burst = t.ipRate
+	}
+	idle := time.Duration(float64(burst) / float64(t.ipRate) * float64(time.Second))
+	if idle < time.Second {
+		idle = time.Second
+	}
+	return idle
+}
+
+// sweep drops the per-IP buckets idle for longer than ipIdle, at most once
+// per ipIdle. t.mu must be held.
+func (t *Throttle) sweep(now time.Time) {
+	idle := t.ipIdle()
+	if now.Sub(t.lastSweep) < idle {
+		return
+	}
+	t.lastSweep = now
+	for ip, entry := range t.ips {
+		if entry.refs == 0 && now.Sub(entry.idleSince) >= idle {
+			delete(t.ips, ip)
+		}
+	}
+}
+
+// Limiter applies a set of buckets to readers and writers.
+type Limiter struct {
+	ctx     context.Context
+	buckets []*tokenBucket
+	share   *fairShare
+	chunk   int
+	release func()
+}
+
+// Release returns the limiter's shares of the per-IP and egress buckets.
+// The per-IP bucket keeps its remaining tokens for the client's next
+// connection.
+func (l *Limiter) Release() { l.release() }
+
+// wait takes n bytes' worth of tokens and waits off any deficit, unless the
+// limiter's context ends first.
+func (l *Limiter) wait(n int) error {
+	if l.share != nil {
+		l.share.rebalance()
+	}
+	var delay time.Duration
+	for _, b := range l.buckets {
+		if d := b.reserve(n); d > delay {
+			delay = d
+		}
+	}
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-l.ctx.Done():
+		return l.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+func (l *Limiter) Reader(r io.Reader) io.Reader {
+	return &throttledReader{r: r, l: l}
+}
+
+func (l *Limiter) ReadCloser(rc io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{l.Reader(rc), rc}
+}
+
+func (l *Limiter) ResponseWriter(w http.ResponseWriter) http.ResponseWriter {
+	return &throttledResponseWriter{ResponseWriter: w, l: l}
+}
+
+type throttledReader struct {
+	r io.Reader
+	l *Limiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.l.chunk {
+		p = p[:t.l.chunk]
+	}
+	n, err := t.r.Read(p)
+	if n > 0 {
+		if werr := t.l.wait(n); werr != nil {
+			return 0, werr // the bytes were never let through
+		}
+	}
+	return n, err
+}
+
+type throttledResponseWriter struct {
+	http.ResponseWriter
+	l *Limiter
+}
+
+func (t *throttledResponseWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p
+		if len(chunk) > t.l.chunk {
+			chunk = chunk[:t.l.chunk]
+		}
+		if err := t.l.wait(len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := t.ResponseWriter.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer so
+// streamed responses are still flushed.
+func (t *throttledResponseWriter) Unwrap() http.ResponseWriter {
+	return t.ResponseWriter
+}
+
+// egressCap is an aggregate byte-rate limit for the whole redirector. On
+// top of the shared bucket, each connection gets a fair-share bucket whose
+// rate is the cap divided by the number of connections that moved data in
+// the last second, so one bulk transfer can't starve interactive sessions.
+type egressCap struct {
+	rate   int64
+	burst  int64
+	bucket *tokenBucket
+
+	mu    sync.Mutex
+	conns map[*fairShare]struct{}
+}
+
+type fairShare struct {
+	cap      *egressCap
+	bucket   *tokenBucket
+	lastUsed time.Time
+}
+
+func newEgressCap(rate, burst int64) *egressCap {
+	return &egressCap{
+		rate:   rate,
+		burst:  burst,
+		bucket: newTokenBucket(rate, burst),
+		conns:  make(map[*fairShare]struct{}),
+	}
+}
+
+func (e *egressCap) join() *fairShare {
+	s := &fairShare{cap: e, bucket: newTokenBucket(e.rate, e.burst)}
+	e.mu.Lock()
+	e.conns[s] = struct{}{}
+	e.mu.Unlock()
+	return s
+}
+
+func (e *egressCap) leave(s *fairShare) {
+	e.mu.Lock()
+	delete(e.conns, s)
+	e.mu.Unlock()
+}
+
+// rebalance marks s as busy and resizes its bucket to an equal split of the
+// cap among busy connections.
+func (s *fairShare) rebalance() {
+	e := s.cap
+	now := time.Now()
+
+	e.mu.Lock()
+	s.lastUsed = now
+	busy := 0
+	for c := range e.conns {
+		if now.Sub(c.lastUsed) < time.Second {
+			busy++
+		}
+	}
+	e.mu.Unlock()
+
+	s.bucket.setRate(float64(e.rate) / float64(busy))
+}
+
+func (t *Throttle) String() string {
+	s := fmt.Sprintf("per connection %d B/s, per IP %d B/s", t.connRate, t.ipRate)
+	if t.egress != nil {
+		s += fmt.Sprintf(", egress capped at %d B/s shared fairly across active connections", t.egress.rate)
+	}
+	return s
+}
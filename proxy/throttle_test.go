@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestThrottle_LimitsReadRate(t *testing.T) {
+	th := &Throttle{connRate: 1000, burst: 100, ips: make(map[string]*ipBucket)}
+	lim := th.Limiter(context.Background(), "192.0.2.1")
+	defer lim.Release()
+
+	start := time.Now()
+	n, err := io.Copy(io.Discard, lim.Reader(bytes.NewReader(make([]byte, 300))))
+	elapsed := time.Since(start)
+
+	if err != nil || n != 300 {
+		t.Fatalf("Expected 300 bytes copied, got %d (err %v)", n, err)
+	}
+	// The first 100 bytes ride the burst; the remaining 200 take ~200ms
+	if elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Expected ~200ms of throttling, took %v", elapsed)
+	}
+}
+
+func TestThrottle_SharesIPBucket(t *testing.T) {
+	th := &Throttle{ipRate: 1000, ips: make(map[string]*ipBucket)}
+
+	a := th.Limiter(context.Background(), "192.0.2.1")
+	b := th.Limiter(context.Background(), "192.0.2.1")
+	c := th.Limiter(context.Background(), "192.0.2.2")
+	if a.buckets[0] != b.buckets[0] || a.buckets[0] == c.buckets[0] {
+		t.Fatal("Expected connections from the same IP to share a bucket")
+	}
+
+	a.Release()
+	b.Release()
+	c.Release()
+	if len(th.ips) != 2 {
+		t.Errorf("Expected released IP buckets to be kept, %d left", len(th.ips))
+	}
+}
+
+func TestThrottle_KeepsIPBucketBetweenRequests(t *testing.T) {
+	th := &Throttle{ipRate: 1000, ips: make(map[string]*ipBucket)}
+
+	// A request that drains the burst, then one right after it
+	first := th.Limiter(context.Background(), "192.0.2.1")
+	first.buckets[0].reserve(1000)
+	first.Release()
+	second := th.Limiter(context.Background(), "192.0.2.1")
+	defer second.Release()
+	if d := second.buckets[0].reserve(500); d < 400*time.Millisecond {
+		t.Errorf("Expected the next request to wait for the drained bucket, waits %v", d)
+	}
+
+	// Idle buckets are dropped once they would have refilled
+	th.Limiter(context.Background(), "192.0.2.2").Release()
+	th.sweep(time.Now().Add(2 * time.Second))
+	if _, ok := th.ips["192.0.2.2"]; ok {
+		t.Error("Expected an idle IP bucket to be evicted")
+	}
+	if _, ok := th.ips["192.0.2.1"]; !ok {
+		t.Error("Expected an IP bucket in use to be kept")
+	}
+}
+
+func TestEgressCap_FairShare(t *testing.T) {
+	th := &Throttle{egress: newEgressCap(1000, 0), ips: make(map[string]*ipBucket)}
+
+	a := th.Limiter(context.Background(), "192.0.2.1")
+	b := th.Limiter(context.Background(), "192.0.2.2")
+	defer a.Release()
+	defer b.Release()
+
+	a.wait(1)
+	b.wait(1)
+	if rate := b.share.bucket.rate; rate != 500 {
+		t.Errorf("Expected two busy connections to get 500 B/s each, got %v", rate)
+	}
+
+	b.Release()
+	a.wait(1)
+	if rate := a.share.bucket.rate; rate != 1000 {
+		t.Errorf("Expected the remaining connection to get the whole cap, got %v", rate)
+	}
+}
+
+func TestThrottle_WaitEndsWithContext(t *testing.T) {
+	th := &Throttle{connRate: 100, burst: 100, ips: make(map[string]*ipBucket)}
+	ctx, cancel := context.WithCancel(context.Background())
+	lim := th.Limiter(ctx, "192.0.2.1")
+	defer lim.Release()
+	r := lim.Reader(bytes.NewReader(make([]byte, 10_000)))
+
+	// The first burst is free; the next chunk would wait a second
+	io.CopyN(io.Discard, r, 100)
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	_, err := io.CopyN(io.Discard, r, 100)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the wait to end with the context, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected the wait to stop when cancelled, took %v", elapsed)
+	}
+}
@@ -0,0 +1,100 @@
+package redirector
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// clientPins is the set of SHA-256 client certificate fingerprints allowed to
+// complete an mTLS handshake. The set is swapped atomically on reload so
+// handshakes in flight never see a half-loaded file.
+type clientPins struct {
+	file string
+	pins atomic.Pointer[map[string]struct{}]
+}
+
+// loadClientPins reads fingerprints from file: one hex SHA-256 per line,
+// colons and case ignored, '#' starting a comment.
+func loadClientPins(file string) (*clientPins, error) {
+	p := &clientPins{file: file}
+	if err := p.reload(); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *clientPins) reload() error {
+	f, err := os.Open(p.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	pins := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		entry := scanner.Text()
+		if i := strings.IndexByte(entry, '#'); i >= 0 {
+			entry = entry[:i]
+		}
+		entry = strings.ToLower(strings.ReplaceAll(strings.TrimSpace(entry), ":", ""))
+		if entry == "" {
+			continue
+		}
+		if b, err := hex.DecodeString(entry); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("%s:%d: not a SHA-256 fingerprint", p.file, line)
+		}
+		pins[entry] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	p.pins.Store(&pins)
+	log.Printf("Loaded %d client certificate pins from %s", len(pins), p.file)
+	return nil
+}
+
+// reloadOnSIGHUP re-reads the pin file whenever the process receives SIGHUP.
+// A file that fails to parse leaves the previous set in place.
+func (p *clientPins) reloadOnSIGHUP() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	go func() {
+		for range sig {
+			if err := p.reload(); err != nil {
+				log.Printf("Client pin reload failed, keeping previous pins: %v", err)
+			}
+		}
+	}()
+}
+
+func (p *clientPins) allowed(cert []byte) bool {
+	sum := sha256.Sum256(cert)
+	_, ok := (*p.pins.Load())[hex.EncodeToString(sum[:])]
+	return ok
+}
+
+// verifyConnection is installed as tls.Config.VerifyConnection and runs
+// after any CA verification, so pins narrow rather than replace it. Unlike
+// VerifyPeerCertificate it also runs when a session is resumed, so a client
+// whose pin was removed can't get back in on an old session ticket.
+func (p *clientPins) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("no client certificate presented")
+	}
+	if !p.allowed(cs.PeerCertificates[0].Raw) {
+		return errors.New("client certificate is not pinned")
+	}
+	return nil
+}
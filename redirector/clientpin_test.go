@@ -0,0 +1,134 @@
+package redirector
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func peer(raw []byte) tls.ConnectionState {
+	return tls.ConnectionState{PeerCertificates: []*x509.Certificate{{Raw: raw}}}
+}
+
+func TestClientPins_Reload(t *testing.T) {
+	certA := []byte("certificate A")
+	certB := []byte("certificate B")
+	sumA := sha256.Sum256(certA)
+	sumB := sha256.Sum256(certB)
+
+	// Colon-separated upper-case form, as printed by openssl
+	var colon []string
+	for _, b := range sumA {
+		colon = append(colon, strings.ToUpper(hex.EncodeToString([]byte{b})))
+	}
+
+	file := filepath.Join(t.TempDir(), "pins.txt")
+	os.WriteFile(file, []byte("# implants\n"+strings.Join(colon, ":")+"\n"), 0600)
+
+	pins, err := loadClientPins(file)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if err := pins.verifyConnection(peer(certA)); err != nil {
+		t.Errorf("Expected pinned certificate to be accepted: %v", err)
+	}
+	if err := pins.verifyConnection(peer(certB)); err == nil {
+		t.Error("Expected unpinned certificate to be rejected")
+	}
+
+	os.WriteFile(file, []byte(hex.EncodeToString(sumB[:])+"\n"), 0600)
+	if err := pins.reload(); err != nil {
+		t.Fatalf("Reload failed: %v", err)
+	}
+	if pins.allowed(certA) || !pins.allowed(certB) {
+		t.Error("Expected reload to replace the pin set")
+	}
+
+	os.WriteFile(file, []byte("not-a-fingerprint\n"), 0600)
+	if err := pins.reload(); err == nil {
+		t.Error("Expected invalid pin file to be rejected")
+	}
+	if !pins.allowed(certB) {
+		t.Error("Expected failed reload to keep previous pins")
+	}
+}
+
+func TestClientPins_Resumption(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(cert.Certificate[0])
+	file := filepath.Join(t.TempDir(), "pins.txt")
+	os.WriteFile(file, []byte(hex.EncodeToString(sum[:])+"\n"), 0600)
+	pins, err := loadClientPins(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := &tls.Config{
+		Certificates:     []tls.Certificate{cert},
+		ClientAuth:       tls.RequireAnyClientCert,
+		VerifyConnection: pins.verifyConnection,
+	}
+	client := &tls.Config{
+		Certificates:       []tls.Certificate{cert},
+		InsecureSkipVerify: true,
+		ClientSessionCache: tls.NewLRUClientSessionCache(1),
+	}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// handshake reports whether the client resumed, and the server's error
+	handshake := func() (bool, error) {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		s, err := ln.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		errc := make(chan error, 1)
+		go func() {
+			defer s.Close()
+			conn := tls.Server(s, server)
+			if err := conn.Handshake(); err != nil {
+				errc <- err
+				return
+			}
+			// Give the client something to read so it also takes the ticket
+			_, err := conn.Write([]byte("x"))
+			errc <- err
+		}()
+		conn := tls.Client(c, client)
+		conn.Read(make([]byte, 1))
+		return conn.ConnectionState().DidResume, <-errc
+	}
+
+	if _, err := handshake(); err != nil {
+		t.Fatalf("Expected a pinned client to connect: %v", err)
+	}
+	if resumed, err := handshake(); err != nil || !resumed {
+		t.Fatalf("Expected the session to be resumed (resumed %v, err %v)", resumed, err)
+	}
+
+	os.WriteFile(file, []byte("# nobody\n"), 0600)
+	if err := pins.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := handshake(); err == nil {
+		t.Error("Expected a resumed session to be refused once its pin is removed")
+	}
+}
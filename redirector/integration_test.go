@@ -0,0 +1,306 @@
+package redirector
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"google-redirector/config"
+	"google-redirector/internal/fakebackend"
+)
+
+// newTestRedirector serves a redirector configured with settings from an
+// httptest server, which supports hijacking for WebSocket upgrades.
+func newTestRedirector(t *testing.T, settings map[string]string) *httptest.Server {
+	t.Helper()
+	h, err := New(config.FromMap(settings)).Handler()
+	if err != nil {
+		t.Fatalf("Unexpected configuration error: %v", err)
+	}
+	server := httptest.NewServer(h)
+	t.Cleanup(server.Close)
+	return server
+}
+
+// startRedirector runs ListenAndServe on a free local port until the test
+// ends and returns the address once it accepts connections.
+func startRedirector(t *testing.T, settings map[string]string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	settings["LISTEN_ADDR"] = addr
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		New(config.FromMap(settings)).ListenAndServe(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return addr
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Redirector never started listening on %s", addr)
+	return ""
+}
+
+func get(t *testing.T, url string, header http.Header) (int, string) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", url, nil)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET %s failed: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func TestIntegration_HeaderGating(t *testing.T) {
+	backend := fakebackend.NewHTTP(t)
+	rd := newTestRedirector(t, map[string]string{
+		"BACKEND_URLS":        backend.URL,
+		"VERIFICATION_HEADER": "X-Session-Id",
+	})
+
+	if code, body := get(t, rd.URL+"/beacon", nil); code != http.StatusBadGateway || body != "Bad Gateway" {
+		t.Errorf("Expected unverified request to get the decoy, got %d %q", code, body)
+	}
+	if n := len(backend.Requests()); n != 0 {
+		t.Errorf("Expected unverified request never to reach the backend, saw %d", n)
+	}
+
+	header := http.Header{"X-Session-Id": {"abc"}, "X-Implant": {"7"}}
+	if code, body := get(t, rd.URL+"/beacon", header); code != http.StatusOK || body != "GET /beacon" {
+		t.Errorf("Expected verified request to be proxied, got %d %q", code, body)
+	}
+	if last := backend.Last(); last == nil || last.Header.Get("X-Implant") != "7" {
+		t.Errorf("Expected request headers to reach the backend")
+	}
+}
+
+func TestIntegration_TLSBackend(t *testing.T) {
+	backend := fakebackend.NewTLS(t)
+	rd := newTestRedirector(t, map[string]string{"BACKEND_URLS": backend.URL})
+
+	if code, body := get(t, rd.URL+"/tasks", nil); code != http.StatusOK || body != "GET /tasks" {
+		t.Errorf("Expected request to be proxied to the TLS backend, got %d %q", code, body)
+	}
+}
+
+func TestIntegration_WebSocketEcho(t *testing.T) {
+	backend := fakebackend.NewWebSocket(t)
+	rd := newTestRedirector(t, map[string]string{"BACKEND_URLS": backend.URL})
+
+	conn, br, resp, err := fakebackend.DialWebSocket(rd.Listener.Addr().String(), "/ws",
+		http.Header{"Sec-Websocket-Protocol": {"chat"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != fakebackend.Accept("dGhlIHNhbXBsZSBub25jZQ==") {
+		t.Errorf("Expected a valid Sec-WebSocket-Accept, got %q", got)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Protocol"); got != "chat" {
+		t.Errorf("Expected subprotocol chat, got %q", got)
+	}
+
+	for _, msg := range []string{"hello", strings.Repeat("x", 70000)} {
+		fakebackend.WriteFrame(conn, fakebackend.OpText, []byte(msg), true)
+		opcode, payload, err := fakebackend.ReadFrame(br)
+		if err != nil || opcode != fakebackend.OpText || string(payload) != msg {
+			t.Fatalf("Expected %d-byte echo, got opcode %d, %d bytes (%v)", len(msg), opcode, len(payload), err)
+		}
+	}
+}
+
+func TestIntegration_WebSocketBackendDown(t *testing.T) {
+	backend := fakebackend.NewWebSocket(t)
+	backendURL := backend.URL
+	backend.Close()
+	rd := newTestRedirector(t, map[string]string{"BACKEND_URLS": backendURL})
+
+	_, _, resp, err := fakebackend.DialWebSocket(rd.Listener.Addr().String(), "/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected 502 when the backend is unreachable, got %d", resp.StatusCode)
+	}
+}
+
+func TestIntegration_Streaming(t *testing.T) {
+	backend := fakebackend.NewHTTP(t)
+	rd := newTestRedirector(t, map[string]string{"BACKEND_URLS": backend.URL})
+
+	start := time.Now()
+	resp, err := http.Get(rd.URL + "/stream?chunks=3&interval=300ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	br := bufio.NewReader(resp.Body)
+	line, err := br.ReadString('\n')
+	if err != nil || line != "chunk 1\n" {
+		t.Fatalf("Expected first chunk, got %q (%v)", line, err)
+	}
+	if elapsed := time.Since(start); elapsed > 300*time.Millisecond {
+		t.Errorf("Expected the first chunk to be flushed immediately, took %v", elapsed)
+	}
+	rest, _ := io.ReadAll(br)
+	if string(rest) != "chunk 2\nchunk 3\n" {
+		t.Errorf("Expected remaining chunks, got %q", rest)
+	}
+}
+
+func TestIntegration_ClientTimeoutCancelsBackend(t *testing.T) {
+	backend := fakebackend.NewHTTP(t)
+	rd := newTestRedirector(t, map[string]string{"BACKEND_URLS": backend.URL})
+
+	client := &http.Client{Timeout: 100 * time.Millisecond}
+	if _, err := client.Get(rd.URL + "/slow?delay=10s"); err == nil {
+		t.Fatal("Expected client timeout")
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for backend.Cancelled() == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if backend.Cancelled() != 1 {
+		t.Errorf("Expected the abandoned request to be cancelled at the backend")
+	}
+}
+
+func TestIntegration_ReadHeaderTimeout(t *testing.T) {
+	backend := fakebackend.NewHTTP(t)
+	addr := startRedirector(t, map[string]string{
+		"BACKEND_URLS":               backend.URL,
+		"SERVER_READ_HEADER_TIMEOUT": "100ms",
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n")
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, 512)
+	n, err := conn.Read(buf)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Fatal("Expected the server to give up on the partial request")
+	}
+	if strings.Contains(string(buf[:n]), "200 OK") {
+		t.Errorf("Expected the partial request not to be proxied, got %q", buf[:n])
+	}
+}
+
+func TestIntegration_Failover(t *testing.T) {
+	primary := fakebackend.NewHTTP(t)
+	secondary := fakebackend.NewHTTP(t)
+	rd := newTestRedirector(t, map[string]string{
+		"BACKEND_URLS":           primary.URL + "," + secondary.URL,
+		"BACKEND_SELECTION":      "priority",
+		"BACKEND_PROBE_INTERVAL": "0",
+	})
+
+	if code, _ := get(t, rd.URL+"/", nil); code != http.StatusOK || len(primary.Requests()) != 1 {
+		t.Fatalf("Expected the primary to serve while healthy, got %d", code)
+	}
+
+	// Three consecutive failures mark the primary down
+	primary.SetStatus(http.StatusServiceUnavailable)
+	for i := 0; i < 3; i++ {
+		get(t, rd.URL+"/", nil)
+	}
+	if code, body := get(t, rd.URL+"/after", nil); code != http.StatusOK || body != "GET /after" {
+		t.Errorf("Expected failover to the secondary, got %d %q", code, body)
+	}
+	if last := secondary.Last(); last == nil || last.URL.Path != "/after" {
+		t.Errorf("Expected the secondary to receive the request")
+	}
+}
+
+func TestIntegration_Revocation(t *testing.T) {
+	backend := fakebackend.NewHTTP(t)
+	rd := newTestRedirector(t, map[string]string{
+		"BACKEND_URLS":        backend.URL,
+		"VERIFICATION_HEADER": "X-Session-Id",
+		"ADMIN_TOKEN":         "0123456789abcdef",
+	})
+	implant := http.Header{"X-Session-Id": {"implant-7"}}
+	if code, _ := get(t, rd.URL+"/beacon", implant); code != http.StatusOK {
+		t.Fatalf("Expected the implant to be proxied before revocation, got %d", code)
+	}
+
+	req, _ := http.NewRequest("POST", rd.URL+"/_admin/revocations", strings.NewReader(`{"kind":"token","value":"implant-7"}`))
+	req.Header.Set("Authorization", "Bearer 0123456789abcdef")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("Expected the revocation to be accepted, got %d", resp.StatusCode)
+	}
+
+	if code, body := get(t, rd.URL+"/beacon", implant); code != http.StatusBadGateway || body != "Bad Gateway" {
+		t.Errorf("Expected the revoked implant to get the decoy, got %d %q", code, body)
+	}
+	if code, _ := get(t, rd.URL+"/beacon", http.Header{"X-Session-Id": {"implant-8"}}); code != http.StatusOK {
+		t.Errorf("Expected other implants to be unaffected, got %d", code)
+	}
+}
+
+func TestIntegration_Canary(t *testing.T) {
+	backend := fakebackend.NewHTTP(t)
+	webhook := fakebackend.NewHTTP(t)
+	rd := newTestRedirector(t, map[string]string{
+		"BACKEND_URLS":      backend.URL,
+		"QUERY_CANARIES":    "ref=sample-42",
+		"ALERT_WEBHOOK_URL": webhook.URL + "/hook",
+	})
+
+	if code, body := get(t, rd.URL+"/payload.bin?ref=sample-42", nil); code != http.StatusBadGateway || body != "Bad Gateway" {
+		t.Errorf("Expected the canary request to get the decoy, got %d %q", code, body)
+	}
+	if n := len(backend.Requests()); n != 0 {
+		t.Errorf("Expected the canary request never to reach the backend, saw %d", n)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for webhook.Last() == nil && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if last := webhook.Last(); last == nil || last.Method != "POST" || last.URL.Path != "/hook" {
+		t.Errorf("Expected the canary to be reported to the webhook")
+	}
+}
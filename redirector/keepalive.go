@@ -0,0 +1,62 @@
+package redirector
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"google-redirector/config"
+)
+
+// connLifetime caps how long and how many requests an inbound HTTP/1.1
+// connection may serve. Once a limit is reached the response carries
+// "Connection: close", forcing the client to reconnect through the load
+// balancer and land on a fresh path.
+type connLifetime struct {
+	keepAlive   bool
+	idleTimeout time.Duration
+	maxRequests int
+	maxAge      time.Duration
+}
+
+type connInfoKey struct{}
+
+// connInfo is attached to each connection's context by ConnContext.
+type connInfo struct {
+	accepted time.Time
+	requests atomic.Int64
+}
+
+func connLifetimeFromConfig(cfg *config.Config) *connLifetime {
+	return &connLifetime{
+		keepAlive:   cfg.Bool("SERVER_KEEPALIVE", true),
+		idleTimeout: cfg.Duration("SERVER_IDLE_TIMEOUT", 0),
+		maxRequests: cfg.Int("SERVER_MAX_REQUESTS_PER_CONN", 0),
+		maxAge:      cfg.Duration("SERVER_MAX_CONN_AGE", 0),
+	}
+}
+
+// configure applies the settings to server.
+func (l *connLifetime) configure(server *http.Server) {
+	server.SetKeepAlivesEnabled(l.keepAlive)
+	server.IdleTimeout = l.idleTimeout
+	server.ConnContext = func(ctx context.Context, _ net.Conn) context.Context {
+		return context.WithValue(ctx, connInfoKey{}, &connInfo{accepted: time.Now()})
+	}
+}
+
+// track counts r against its connection and marks the response as the last
+// one on it when a limit has been reached.
+func (l *connLifetime) track(w http.ResponseWriter, r *http.Request) {
+	info, ok := r.Context().Value(connInfoKey{}).(*connInfo)
+	if !ok {
+		return
+	}
+	n := info.requests.Add(1)
+	if (l.maxRequests > 0 && n >= int64(l.maxRequests)) ||
+		(l.maxAge > 0 && time.Since(info.accepted) >= l.maxAge) {
+		w.Header().Set("Connection", "close")
+	}
+}
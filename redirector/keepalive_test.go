@@ -0,0 +1,29 @@
+package redirector
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestConnLifetime_MaxRequests(t *testing.T) {
+	lifetime := &connLifetime{keepAlive: true, maxRequests: 2}
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lifetime.track(w, r)
+	}))
+	lifetime.configure(server.Config)
+	server.Start()
+	defer server.Close()
+
+	client := server.Client()
+	for i, wantClose := range []bool{false, true} {
+		resp, err := client.Get(server.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.Close != wantClose {
+			t.Errorf("Request %d: expected close=%v, got %v", i+1, wantClose, resp.Close)
+		}
+	}
+}
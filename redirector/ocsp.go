@@ -0,0 +1,165 @@
+package redirector
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspStapler keeps a certificate's OCSP staple fresh in the background and
+// hands the current version to the TLS listener via GetCertificate.
+type ocspStapler struct {
+	leaf   *x509.Certificate
+	issuer *x509.Certificate
+	client *http.Client
+	cert   atomic.Pointer[tls.Certificate]
+}
+
+// newOCSPStapler returns nil when the certificate has no OCSP responder or no
+// issuer in its chain, since there is nothing to staple in those cases.
+func newOCSPStapler(cert tls.Certificate) (*ocspStapler, error) {
+	if len(cert.Certificate) < 2 {
+		return nil, nil
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	if len(leaf.OCSPServer) == 0 {
+		return nil, nil
+	}
+	issuer, err := x509.ParseCertificate(cert.Certificate[1])
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ocspStapler{
+		leaf:   leaf,
+		issuer: issuer,
+		client: &http.Client{Timeout: 15 * time.Second},
+	}
+	s.cert.Store(&cert)
+	return s, nil
+}
+
+func (s *ocspStapler) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.cert.Load(), nil
+}
+
+// run refreshes the staple halfway through each response's validity window,
+// retrying sooner after failures, until ctx is cancelled. The previous
+// staple is kept until it expires so a flaky responder doesn't immediately
+// drop stapling.
+func (s *ocspStapler) run(ctx context.Context) {
+	var expires time.Time
+	for {
+		wait := 5 * time.Minute
+		staple, next, err := s.fetch()
+		if err != nil {
+			log.Printf("OCSP refresh failed: %v", err)
+			if !expires.IsZero() && time.Now().After(expires) {
+				s.setStaple(nil)
+				expires = time.Time{}
+			}
+		} else {
+			s.setStaple(staple)
+			expires = next
+			if !next.IsZero() {
+				wait = time.Until(next) / 2
+			} else {
+				wait = time.Hour
+			}
+			if wait < time.Minute {
+				wait = time.Minute
+			}
+			log.Printf("OCSP staple refreshed (next update %s)", next.Format(time.RFC3339))
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+func (s *ocspStapler) setStaple(staple []byte) {
+	cert := *s.cert.Load()
+	cert.OCSPStaple = staple
+	s.cert.Store(&cert)
+}
+
+// fetch requests a fresh response and returns it along with its nextUpdate.
+func (s *ocspStapler) fetch() ([]byte, time.Time, error) {
+	req, err := ocsp.CreateRequest(s.leaf, s.issuer, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	resp, err := s.client.Post(s.leaf.OCSPServer[0], "application/ocsp-request", bytes.NewReader(req))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("responder returned %d", resp.StatusCode)
+	}
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	next, err := checkOCSPResponse(raw, s.leaf, s.issuer, time.Now())
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return raw, next, nil
+}
+
+// checkOCSPResponse verifies that raw is a signed, current "good" response
+// for leaf and returns its nextUpdate (zero if the responder omitted it).
+// The response must be signed by issuer or by a responder it delegated to,
+// so a matching serial number can only be leaf's.
+func checkOCSPResponse(raw []byte, leaf, issuer *x509.Certificate, now time.Time) (time.Time, error) {
+	resp, err := ocsp.ParseResponseForCert(raw, leaf, issuer)
+	if err != nil {
+		return time.Time{}, err
+	}
+	if resp.Certificate != nil && !bytes.Equal(resp.Certificate.Raw, issuer.Raw) && !hasOCSPSigning(resp.Certificate) {
+		return time.Time{}, errors.New("delegated responder lacks OCSP signing usage")
+	}
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return time.Time{}, errors.New("certificate revoked")
+	default:
+		return time.Time{}, errors.New("certificate status unknown")
+	}
+	if resp.ThisUpdate.After(now.Add(5 * time.Minute)) {
+		return time.Time{}, errors.New("response thisUpdate is in the future")
+	}
+	if !resp.NextUpdate.IsZero() && resp.NextUpdate.Before(now) {
+		return time.Time{}, errors.New("response is expired")
+	}
+	return resp.NextUpdate, nil
+}
+
+func hasOCSPSigning(cert *x509.Certificate) bool {
+	for _, eku := range cert.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageOCSPSigning {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,155 @@
+package redirector
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ocsp"
+)
+
+type testOCSPResponder struct {
+	ca     *x509.Certificate
+	caKey  *ecdsa.PrivateKey
+	revoke bool
+}
+
+// respond signs a response for the single certificate named in req.
+func (r *testOCSPResponder) respond(t *testing.T, req []byte) []byte {
+	t.Helper()
+
+	parsed, err := ocsp.ParseRequest(req)
+	if err != nil {
+		t.Fatalf("Responder could not parse request: %v", err)
+	}
+	tmpl := ocsp.Response{
+		Status:       ocsp.Good,
+		SerialNumber: parsed.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Minute),
+		NextUpdate:   time.Now().Add(time.Hour),
+	}
+	if r.revoke {
+		tmpl.Status = ocsp.Revoked
+		tmpl.RevokedAt = tmpl.ThisUpdate
+	}
+	resp, err := ocsp.CreateResponse(r.ca, r.ca, tmpl, r.caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// newTestOCSPChain returns a CA-issued leaf whose OCSP responder is served
+// by the returned test server.
+func newTestOCSPChain(t *testing.T, responder *testOCSPResponder) (tls.Certificate, *httptest.Server) {
+	t.Helper()
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, caTmpl, caTmpl, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	responder.ca, _ = x509.ParseCertificate(caDER)
+	responder.caKey = caKey
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(responder.respond(t, body))
+	}))
+
+	leafKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	leafTmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		OCSPServer:   []string{server.URL},
+	}
+	leafDER, err := x509.CreateCertificate(rand.Reader, leafTmpl, responder.ca, &leafKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{leafDER, caDER}, PrivateKey: leafKey}, server
+}
+
+func TestOCSPStapler_Fetch(t *testing.T) {
+	responder := &testOCSPResponder{}
+	cert, server := newTestOCSPChain(t, responder)
+	defer server.Close()
+
+	stapler, err := newOCSPStapler(cert)
+	if err != nil || stapler == nil {
+		t.Fatalf("Expected stapler, got %v (err %v)", stapler, err)
+	}
+
+	staple, next, err := stapler.fetch()
+	if err != nil {
+		t.Fatalf("Fetch failed: %v", err)
+	}
+	if len(staple) == 0 || next.Before(time.Now()) {
+		t.Errorf("Unexpected staple (%d bytes) or next update %v", len(staple), next)
+	}
+
+	stapler.setStaple(staple)
+	got, _ := stapler.getCertificate(nil)
+	if len(got.OCSPStaple) != len(staple) {
+		t.Errorf("Expected served certificate to carry the staple")
+	}
+}
+
+func TestOCSPStapler_RejectsRevoked(t *testing.T) {
+	responder := &testOCSPResponder{revoke: true}
+	cert, server := newTestOCSPChain(t, responder)
+	defer server.Close()
+
+	stapler, _ := newOCSPStapler(cert)
+	if _, _, err := stapler.fetch(); err == nil {
+		t.Fatal("Expected revoked response to be rejected")
+	}
+}
+
+func TestOCSPStapler_SkipsSelfSigned(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stapler, err := newOCSPStapler(cert); stapler != nil || err != nil {
+		t.Errorf("Expected no stapler for a certificate without an issuer, got %v (err %v)", stapler, err)
+	}
+}
+
+func TestOCSPStapler_RejectsOtherIssuer(t *testing.T) {
+	responder := &testOCSPResponder{}
+	cert, server := newTestOCSPChain(t, responder)
+	defer server.Close()
+	other := &testOCSPResponder{}
+	_, otherServer := newTestOCSPChain(t, other)
+	defer otherServer.Close()
+
+	stapler, _ := newOCSPStapler(cert)
+	req, _ := ocsp.CreateRequest(stapler.leaf, stapler.issuer, nil)
+	// Same serial number, but signed by a CA that didn't issue the leaf
+	if _, err := checkOCSPResponse(other.respond(t, req), stapler.leaf, stapler.issuer, time.Now()); err == nil {
+		t.Error("Expected a response signed by another CA to be rejected")
+	}
+}
@@ -0,0 +1,660 @@
+// Package redirector assembles the backend pool, WebSocket relay and request
+// filters into a server. The binary in the repository root is a thin
+// wrapper around it, and other Go tools can embed the redirector the same
+// way, supplying the settings documented in the README from a map:
+//
+//	cfg := config.FromMap(map[string]string{
+//		"BACKEND_URLS": "https://c2.example.com",
+//		"LISTEN_ADDR":  "127.0.0.1:8443",
+//	})
+//	err := redirector.New(cfg).ListenAndServe(ctx)
+package redirector
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"time"
+
+	"google-redirector/admin"
+	"google-redirector/clientip"
+	"google-redirector/cluster"
+	"google-redirector/config"
+	"google-redirector/filter"
+	"google-redirector/monitor"
+	"google-redirector/plugins"
+	"google-redirector/proxy"
+	"google-redirector/store"
+	"google-redirector/wsproxy"
+)
+
+// shutdownGrace is how long in-flight requests get to finish once the
+// context passed to ListenAndServe is cancelled. Cloud Run allows 10s after
+// SIGTERM, and the binary still needs time to ship logs after that.
+const shutdownGrace = 2 * time.Second
+
+// Redirector is a configured but not yet running redirector.
+type Redirector struct {
+	cfg *config.Config
+
+	once      sync.Once
+	err       error
+	handler   http.Handler
+	stop      context.CancelFunc // ends the background loops started by build
+	slowloris *filter.SlowlorisGuard
+	limits    *filter.Limits
+	lifetime  *connLifetime
+	tlsConfig *tls.Config
+	ws        *wsproxy.Proxy
+	replay    *filter.ReplayGuard
+	state     *store.Store
+	cluster   *cluster.Node
+}
+
+// New returns a redirector that reads its settings from cfg. Nothing is
+// validated until Handler or ListenAndServe is called.
+//
+// TRUSTED_PROXY_HOPS is applied process-wide (see clientip.TrustedHops), so
+// a program should not run redirectors that disagree about it.
+func New(cfg *config.Config) *Redirector {
+	return &Redirector{cfg: cfg}
+}
+
+// Handler returns the redirector's request handler, for programs that run
+// their own http.Server. Listener-level settings (TLS, slowloris first-byte
+// deadlines and bans, header and keep-alive limits) only apply through
+// ListenAndServe, and such programs should call Shutdown once their server's
+// Shutdown has returned, so WebSocket relays end with it and state is saved.
+func (rd *Redirector) Handler() (http.Handler, error) {
+	rd.once.Do(func() {
+		if rd.err = rd.build(); rd.err != nil {
+			// Closed here so a failed build doesn't keep the database open
+			rd.stop()
+			if rd.state != nil {
+				rd.state.Close()
+				rd.state = nil
+			}
+		}
+	})
+	return rd.handler, rd.err
+}
+
+// ListenAndServe serves on LISTEN_ADDR (":$PORT", or ":8080", by default)
+// until ctx is cancelled, then shuts down gracefully.
+func (rd *Redirector) ListenAndServe(ctx context.Context) error {
+	if _, err := rd.Handler(); err != nil {
+		return err
+	}
+
+	addr := rd.cfg.String("LISTEN_ADDR", ":"+rd.cfg.String("PORT", "8080"))
+	log.Printf("Google redirector starting on %s", addr)
+
+	server := &http.Server{
+		Addr:              addr,
+		Handler:           rd.handler,
+		ReadHeaderTimeout: rd.slowloris.HeaderTimeout(),
+		MaxHeaderBytes:    rd.limits.ServerMaxHeaderBytes(),
+		ConnState:         rd.slowloris.ConnState,
+	}
+	rd.lifetime.configure(server)
+
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	ln = rd.slowloris.Listener(ln)
+
+	if rd.tlsConfig != nil {
+		// Serve on our own TLS listener so the config (and its rotating
+		// session ticket keys) is used as-is instead of being cloned.
+		log.Printf("Local TLS listener: enabled (ALPN %s)", strings.Join(rd.tlsConfig.NextProtos, ","))
+		ln = tls.NewListener(ln, rd.tlsConfig)
+	}
+
+	errc := make(chan error, 1)
+	go func() { errc <- server.Serve(ln) }()
+
+	select {
+	case err := <-errc:
+		rd.Shutdown()
+		return err
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer cancel()
+	// Serve returns as soon as Shutdown starts, so wait for Shutdown itself
+	// before saving state. Hijacked WebSocket connections are not tracked by
+	// it and are closed by rd.Shutdown.
+	server.Shutdown(shutdownCtx)
+	rd.Shutdown()
+	if err := <-errc; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Shutdown stops the background work (probes, refreshes, periodic saves),
+// closes every open WebSocket relay and tunnel, saves the replay cache,
+// closes the state database and sends peers any pending cluster events.
+// ListenAndServe does this itself when its context is cancelled.
+func (rd *Redirector) Shutdown() {
+	if rd.stop != nil {
+		rd.stop()
+	}
+	if rd.ws != nil {
+		rd.ws.Shutdown()
+	}
+	if rd.replay != nil {
+		rd.replay.Save()
+	}
+	if rd.state != nil {
+		rd.state.Close()
+	}
+	if rd.cluster != nil {
+		rd.cluster.Flush()
+	}
+}
+
+// build validates the configuration and wires everything together.
+func (rd *Redirector) build() error {
+	cfg := rd.cfg
+	ctx, stop := context.WithCancel(context.Background())
+	rd.stop = stop
+	verificationHeader := cfg.String("VERIFICATION_HEADER", "")
+
+	pool, err := proxy.NewPool(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid backend configuration: %v", err)
+	}
+
+	signer, err := proxy.NewSigner(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid SigV4 configuration: %v", err)
+	}
+
+	guard, err := proxy.NewDialGuard(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid SSRF configuration: %v", err)
+	}
+
+	obfs, err := proxy.NewObfuscator(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid padding configuration: %v", err)
+	}
+
+	envelope, err := proxy.NewEnvelope(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid client envelope configuration: %v", err)
+	}
+
+	chain, err := plugins.FromConfig(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid plugin configuration: %v", err)
+	}
+
+	decoy, err := filter.NewDecoy(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid decoy configuration: %v", err)
+	}
+
+	api, err := admin.New(cfg, decoy)
+	if err != nil {
+		return fmt.Errorf("invalid admin API configuration: %v", err)
+	}
+
+	state, err := store.New(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid state database configuration: %v", err)
+	}
+	rd.state = state
+	if state != nil {
+		state.Start(ctx)
+		chain = append(chain, state.Plugin())
+	}
+
+	metrics := monitor.NewMetrics(pool)
+	alerts, err := monitor.NewAlerts(cfg, metrics)
+	if err != nil {
+		return fmt.Errorf("invalid alert configuration: %v", err)
+	}
+	if api != nil || alerts != nil {
+		chain = append(chain, metrics.Plugin())
+	}
+	if alerts != nil {
+		alerts.Start(ctx)
+	}
+
+	// Always skip TLS verification for simplicity
+	rp := &httputil.ReverseProxy{Director: pool.Director, ModifyResponse: chain.Response}
+
+	backendDialer := proxy.NewDialer(30*time.Second, guard)
+	backendTLS := &tls.Config{InsecureSkipVerify: true}
+	base := &http.Transport{
+		DialContext:     backendDialer.DialContext,
+		TLSClientConfig: backendTLS,
+	}
+	warm := proxy.NewWarmPool(cfg, pool, backendDialer, backendTLS)
+	if warm != nil {
+		warm.Start(ctx)
+		base.DialContext = warm.Dial
+		base.DialTLSContext = warm.DialTLS
+	}
+
+	var transport http.RoundTripper = base
+	if obfs != nil {
+		transport = obfs.Transport(transport)
+	}
+	if signer != nil {
+		transport = signer.Transport(transport)
+	}
+	transport = pool.Transport(transport)
+	// Probes skip the jitter and signing, which would skew the latencies
+	// backends are chosen by
+	pool.Probe(ctx, base)
+	transport, backpressure, err := proxy.NewBackpressure(cfg, transport)
+	if err != nil {
+		return fmt.Errorf("invalid backpressure configuration: %v", err)
+	}
+	rp.Transport = transport
+
+	// Simple logging
+	originalDirector := rp.Director
+	rp.Director = func(req *http.Request) {
+		// The envelope describes the request as the client sent it, and is
+		// bound to the one the backend receives
+		var client *http.Request
+		if envelope != nil {
+			client = req.WithContext(req.Context())
+			u := *req.URL
+			client.URL = &u
+		}
+		originalDirector(req)
+		if envelope != nil {
+			if signer != nil {
+				req.Host = req.URL.Host // as Sign will send it
+			}
+			envelope.Seal(req, client)
+		}
+		log.Printf("%s %s -> %s", req.Method, req.URL.Path, req.URL.String())
+	}
+
+	// Error handler
+	rp.ErrorHandler = func(rw http.ResponseWriter, req *http.Request, err error) {
+		log.Printf("Proxy error: %v", err)
+		metrics.ProxyError()
+		rw.WriteHeader(http.StatusBadGateway)
+		rw.Write([]byte("Bad Gateway"))
+	}
+
+	throttle, err := proxy.NewThrottle(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid throttle configuration: %v", err)
+	}
+
+	clientip.TrustedHops = cfg.Int("TRUSTED_PROXY_HOPS", 0)
+	slowloris := filter.NewSlowlorisGuard(cfg)
+	if state != nil {
+		if err := slowloris.UseStore(state); err != nil {
+			return fmt.Errorf("loading bans from %s: %v", state, err)
+		}
+	}
+
+	limits, err := filter.NewLimits(cfg, decoy)
+	if err != nil {
+		return fmt.Errorf("invalid request limit configuration: %v", err)
+	}
+
+	lifetime := connLifetimeFromConfig(cfg)
+
+	ws, err := wsproxy.New(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid WebSocket configuration: %v", err)
+	}
+	ws.Pool = pool
+	ws.Signer = signer
+	ws.Dialer = proxy.NewDialer(10*time.Second, guard)
+	ws.Throttle = throttle
+	ws.Obfuscator = obfs
+	ws.Envelope = envelope
+	ws.Decoy = decoy
+	ws.Plugins = chain
+
+	doh, err := proxy.NewDoH(cfg, proxy.NewDialer(5*time.Second, guard))
+	if err != nil {
+		return fmt.Errorf("invalid DoH configuration: %v", err)
+	}
+
+	script, err := filter.NewRouteScript(cfg, pool)
+	if err != nil {
+		return fmt.Errorf("invalid route script: %v", err)
+	}
+
+	revocations, err := filter.NewRevocations(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid revocation configuration: %v", err)
+	}
+
+	replay, err := filter.NewReplayGuard(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid replay protection configuration: %v", err)
+	}
+	rd.replay = replay
+	if replay != nil {
+		if state != nil {
+			if err := replay.UseStore(state); err != nil {
+				return fmt.Errorf("loading replay nonces from %s: %v", state, err)
+			}
+		}
+		replay.Start(ctx)
+	}
+
+	node, err := cluster.New(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid cluster configuration: %v", err)
+	}
+	rd.cluster = node
+	if node != nil {
+		slowloris.UseCluster(node)
+		if revocations != nil {
+			revocations.UseCluster(node)
+		}
+		if replay != nil {
+			replay.UseCluster(node)
+		}
+		node.Start(ctx)
+	}
+
+	if api != nil {
+		api.Handle("revocations", revocations)
+		api.Handle("metrics", metrics)
+		if node != nil {
+			api.Handle("cluster", node)
+		}
+	}
+
+	asns, err := filter.NewASNFilter(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid ASN filter configuration: %v", err)
+	}
+	if asns != nil {
+		asns.Start(ctx)
+		if envelope != nil {
+			envelope.Network = asns.Network
+		}
+	}
+
+	redirects, err := filter.NewRedirects(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid redirect rules: %v", err)
+	}
+
+	query, err := filter.NewQueryFilter(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid query filter configuration: %v", err)
+	}
+
+	referers, err := filter.NewRefererGate(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid Referer gate configuration: %v", err)
+	}
+
+	methods, err := filter.NewMethodFilter(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid method filter configuration: %v", err)
+	}
+
+	normalizer, err := filter.NewNormalizer(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid request normalization configuration: %v", err)
+	}
+
+	delays, err := filter.NewResponseDelay(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid response delay configuration: %v", err)
+	}
+
+	tlsConfig, err := tlsListenerConfig(ctx, cfg)
+	if err != nil {
+		return fmt.Errorf("invalid TLS listener configuration: %v", err)
+	}
+
+	// WebSocket and HTTP handler
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		metrics.Request()
+		r = clientip.With(r)
+		if envelope != nil {
+			r = proxy.Received(r, time.Now())
+		}
+		lifetime.track(w, r)
+		if delays != nil && !wsproxy.IsWebSocketRequest(r) {
+			w = delays.Wrap(w, r)
+		}
+		if slowloris.TooManyHeaders(r) {
+			log.Printf("Rejecting %s %s from %s: too many headers", r.Method, r.URL.Path, clientip.From(r))
+			chain.Block(r, "too many headers")
+			limits.Reject(w, r)
+			return
+		}
+		if limit := limits.Exceeded(r); limit != "" {
+			log.Printf("Rejecting %s %s from %s: %s limit exceeded", r.Method, r.URL.Path, clientip.From(r), limit)
+			chain.Block(r, limit+" limit exceeded")
+			limits.Reject(w, r)
+			return
+		}
+		// Every later check must see the request the backend will get
+		if normalizer != nil {
+			if problem := normalizer.Normalize(r); problem != "" {
+				log.Printf("Rejecting %s %s from %s: %s", r.Method, r.URL.Path, clientip.From(r), problem)
+				chain.Block(r, problem)
+				decoy.Serve(w, r)
+				return
+			}
+		}
+		if api != nil && api.Handles(r) {
+			api.ServeHTTP(w, r)
+			return
+		}
+		// Canaries come first: whoever holds a leaked URL is unlikely to
+		// pass the other checks
+		if query != nil {
+			if canary := query.Canary(r); canary != "" {
+				detail := fmt.Sprintf("%s from %s on %s %s (User-Agent %q)", canary, clientip.From(r), r.Method, r.URL.Path, r.UserAgent())
+				log.Printf("Canary tripped: %s", detail)
+				if alerts != nil {
+					alerts.Event("canary", canary+" "+clientip.From(r), detail)
+				}
+				chain.Block(r, "canary "+canary)
+				decoy.Serve(w, r)
+				return
+			}
+		}
+		if asns != nil {
+			if network := asns.Blocked(r); network != "" {
+				log.Printf("Rejecting %s %s from %s: blocked network %s", r.Method, r.URL.Path, clientip.From(r), network)
+				chain.Block(r, "blocked network "+network)
+				decoy.Serve(w, r)
+				return
+			}
+		}
+		// Lure links are followed by browsers without the verification header
+		if redirects != nil && redirects.Serve(w, r) {
+			return
+		}
+		// Check for verification header
+		if verificationHeader != "" {
+			if r.Header.Get(verificationHeader) == "" {
+				chain.Block(r, "missing verification header")
+				decoy.Serve(w, r)
+				return
+			}
+		}
+		if revocations != nil {
+			if kind := revocations.Revoked(r); kind != "" {
+				log.Printf("Rejecting %s %s from %s: revoked %s", r.Method, r.URL.Path, clientip.From(r), kind)
+				chain.Block(r, "revoked "+kind)
+				decoy.Serve(w, r)
+				return
+			}
+		}
+		if replay != nil {
+			if reason := replay.Check(r, time.Now()); reason != "" {
+				log.Printf("Rejecting %s %s from %s: %s", r.Method, r.URL.Path, clientip.From(r), reason)
+				chain.Block(r, reason)
+				decoy.Serve(w, r)
+				return
+			}
+		}
+		if query != nil && !query.Allowed(r) {
+			log.Printf("Rejecting %s %s from %s: query parameters", r.Method, r.URL.Path, clientip.From(r))
+			chain.Block(r, "query parameters")
+			decoy.Serve(w, r)
+			return
+		}
+		if referers != nil && !referers.Allowed(r) {
+			log.Printf("Rejecting %s %s from %s: unexpected Referer %q", r.Method, r.URL.Path, clientip.From(r), r.Referer())
+			chain.Block(r, "unexpected Referer")
+			decoy.Serve(w, r)
+			return
+		}
+		if methods != nil {
+			var ok bool
+			if r, ok = methods.Apply(r); !ok {
+				log.Printf("Rejecting %s %s from %s: method not allowed", r.Method, r.URL.Path, clientip.From(r))
+				chain.Block(r, "method not allowed")
+				decoy.Serve(w, r)
+				return
+			}
+		}
+		if !chain.Request(w, r) {
+			return
+		}
+		if script != nil {
+			var ok bool
+			if r, ok = script.Apply(r); !ok {
+				chain.Block(r, "route script")
+				decoy.Serve(w, r)
+				return
+			}
+		}
+		if doh != nil && doh.Handles(r) {
+			doh.Serve(w, r, rp)
+			return
+		}
+		// Check if this is a WebSocket upgrade request
+		if wsproxy.IsWebSocketRequest(r) {
+			ws.ServeHTTP(w, r)
+			return
+		}
+		if throttle != nil {
+			lim := throttle.Limiter(r.Context(), clientip.From(r))
+			defer lim.Release()
+			if r.Body != nil {
+				r.Body = lim.ReadCloser(r.Body)
+			}
+			w = lim.ResponseWriter(w)
+		}
+		rp.ServeHTTP(w, r)
+	})
+
+	log.Printf("Proxying to: %s", pool)
+	log.Printf("TLS verification: disabled")
+	log.Printf("WebSocket support: enabled (%s)", ws)
+	if script != nil {
+		log.Printf("Route script: %s", script)
+	}
+	if len(chain) > 0 {
+		log.Printf("Plugins: %s", chain)
+	}
+	if api != nil {
+		log.Printf("Admin API: enabled (%s)", api)
+	}
+	if alerts != nil {
+		log.Printf("Alerting: enabled (%s)", alerts)
+	}
+	if revocations != nil {
+		log.Printf("Revocation list: enabled (%s)", revocations)
+	}
+	if state != nil {
+		log.Printf("State database: enabled (%s)", state)
+	}
+	if node != nil {
+		log.Printf("Cluster sync: enabled (%s)", node)
+	}
+	if replay != nil {
+		log.Printf("Replay protection: enabled (%s)", replay)
+	}
+	if asns != nil {
+		log.Printf("ASN filter: enabled (%s)", asns)
+	}
+	if redirects != nil {
+		log.Printf("Redirect rules: enabled (%s)", redirects)
+	}
+	if query != nil {
+		log.Printf("Query filter: enabled (%s)", query)
+	}
+	if referers != nil {
+		log.Printf("Referer gate: enabled (%s)", referers)
+	}
+	if methods != nil {
+		log.Printf("Method filter: enabled (%s)", methods)
+	}
+	if normalizer != nil {
+		log.Printf("Request normalization: enabled (%s)", normalizer)
+	}
+	if delays != nil {
+		log.Printf("Response delays: enabled (%s)", delays)
+	}
+	if doh != nil {
+		log.Printf("DNS-over-HTTPS relay: enabled (%s)", doh)
+	}
+	if tunnels := ws.Tunnels(); tunnels != "" {
+		log.Printf("WebSocket TCP tunnels: enabled (%s)", tunnels)
+	}
+	if ws.Strict() {
+		log.Printf("WebSocket strict RFC 6455 mode: enabled")
+	}
+	if guard != nil {
+		log.Printf("SSRF protection: enabled (%s)", guard)
+	}
+	if throttle != nil {
+		log.Printf("Bandwidth throttling: enabled (%s)", throttle)
+	}
+	if backpressure != nil {
+		log.Printf("Backpressure retry: enabled (%s)", backpressure)
+	}
+	if warm != nil {
+		log.Printf("Connection pre-warming: %s", warm)
+	}
+	if obfs != nil {
+		log.Printf("Backend padding and jitter: enabled (%s)", obfs)
+		if !ws.Strict() {
+			log.Printf("WebSocket frames are not padded or delayed without WS_STRICT_RFC6455")
+		}
+	}
+	if envelope != nil {
+		log.Printf("Client envelope: enabled (%s)", envelope)
+	}
+	if signer != nil {
+		log.Printf("SigV4 signing: enabled (%s)", signer)
+	}
+	if slowloris.Active() {
+		log.Printf("Slowloris protection: %s", slowloris)
+	}
+
+	rd.handler = mux
+	rd.slowloris = slowloris
+	rd.limits = limits
+	rd.lifetime = lifetime
+	rd.tlsConfig = tlsConfig
+	rd.ws = ws
+	return nil
+}
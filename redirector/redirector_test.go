@@ -0,0 +1,127 @@
+package redirector
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google-redirector/config"
+)
+
+func TestRedirector_Handler(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("backend " + r.URL.Path))
+	}))
+	defer backend.Close()
+
+	rd := New(config.FromMap(map[string]string{
+		"BACKEND_URLS":        backend.URL,
+		"VERIFICATION_HEADER": "X-Session-Id",
+		"DECOY_STATUS":        "404",
+	}))
+	h, err := rd.Handler()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/beacon", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected unverified request to get the decoy, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/beacon", nil)
+	req.Header.Set("X-Session-Id", "abc")
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "backend /beacon" {
+		t.Errorf("Expected verified request to be proxied, got %d %q", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRedirector_InvalidConfig(t *testing.T) {
+	rd := New(config.FromMap(map[string]string{"BACKEND_SELECTION": "random"}))
+	if _, err := rd.Handler(); err == nil {
+		t.Errorf("Expected invalid configuration to be rejected")
+	}
+	if err := rd.ListenAndServe(context.Background()); err == nil {
+		t.Errorf("Expected ListenAndServe to report the configuration error")
+	}
+}
+
+func TestRedirector_InvalidConfigClosesState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	rd := New(config.FromMap(map[string]string{
+		"BACKEND_URLS":          "http://127.0.0.1:1",
+		"STATE_DB":              path,
+		"REQUEST_NORMALIZATION": "strict", // fails after the database is open
+	}))
+	if _, err := rd.Handler(); err == nil {
+		t.Fatal("Expected invalid configuration to be rejected")
+	}
+	if rd.state != nil {
+		t.Error("Expected the state database to be closed after a failed build")
+	}
+	rd.Shutdown()
+
+	rebuilt := New(config.FromMap(map[string]string{"BACKEND_URLS": "http://127.0.0.1:1", "STATE_DB": path}))
+	if _, err := rebuilt.Handler(); err != nil {
+		t.Errorf("Expected a rebuild on the same database to work, got %v", err)
+	}
+	rebuilt.Shutdown()
+}
+
+func TestRedirector_ListenAndServeShutsDown(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer backend.Close()
+
+	// Reserve a free port for the redirector
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- New(config.FromMap(map[string]string{
+			"BACKEND_URLS": backend.URL,
+			"LISTEN_ADDR":  addr,
+		})).ListenAndServe(ctx)
+	}()
+
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Get("http://" + addr + "/"); err == nil {
+			break
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("Redirector never came up: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Errorf("Expected proxied response, got %q", body)
+	}
+
+	cancel()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Errorf("Expected clean shutdown, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected ListenAndServe to return after cancel")
+	}
+}
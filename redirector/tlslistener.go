@@ -0,0 +1,245 @@
+package redirector
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"google-redirector/config"
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var tlsCurves = map[string]tls.CurveID{
+	"X25519": tls.X25519,
+	"P256":   tls.CurveP256,
+	"P384":   tls.CurveP384,
+	"P521":   tls.CurveP521,
+}
+
+// tlsCover defaults the TLS versions, cipher suites, curves and ALPN
+// protocols to those of a well-known server. Active scanners such as JARM
+// fingerprint a server by how it answers a series of crafted ClientHellos
+// (the version, cipher suite, ALPN protocol and extensions it picks). A
+// cover only changes which versions, suites and protocols can be picked:
+// crypto/tls fixes the order of ServerHello extensions and ranks suites by
+// its own preference whatever order they are listed in, so the handshake
+// still looks like Go's.
+type tlsCover struct {
+	minVersion, maxVersion string
+	cipherSuites           string
+	curves                 string
+	alpn                   string
+}
+
+const (
+	ecdheGCM    = "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"
+	ecdheChaCha = "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256"
+	ecdheCBC    = "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA"
+)
+
+// tlsCovers are selected by TLS_COVER. nginx and Apache are as packaged on
+// current Debian and Ubuntu with OpenSSL 3, where nginx offers h2 only when
+// configured to; IIS is Windows Server 2019, which has no TLS 1.3 or
+// ChaCha20 and offers h2 by default.
+var tlsCovers = map[string]tlsCover{
+	"nginx": {
+		minVersion: "1.2", maxVersion: "1.3",
+		cipherSuites: ecdheGCM + "," + ecdheChaCha + "," + ecdheCBC,
+		curves:       "X25519,P256,P521,P384",
+		alpn:         "http/1.1",
+	},
+	"apache": {
+		minVersion: "1.2", maxVersion: "1.3",
+		cipherSuites: ecdheGCM + "," + ecdheChaCha,
+		curves:       "X25519,P256,P521,P384",
+		alpn:         "http/1.1",
+	},
+	"iis": {
+		minVersion: "1.2", maxVersion: "1.2",
+		cipherSuites: ecdheGCM + "," + ecdheCBC,
+		curves:       "X25519,P256,P384",
+		alpn:         "h2,http/1.1",
+	},
+}
+
+// tlsListenerConfig builds the config for the local TLS listener. It
+// returns nil when TLS_CERT_FILE is unset, in which case the redirector
+// serves plain HTTP and relies on Cloud Run (or another front end) for TLS.
+// OCSP refreshes and ticket key rotation stop when ctx is cancelled.
+func tlsListenerConfig(ctx context.Context, cfg *config.Config) (*tls.Config, error) {
+	certFile := cfg.String("TLS_CERT_FILE", "")
+	if certFile == "" {
+		return nil, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(certFile, cfg.String("TLS_KEY_FILE", ""))
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS_CERT_FILE/TLS_KEY_FILE: %v", err)
+	}
+
+	// A cover only supplies defaults; the TLS_* settings still win. h2 is
+	// opt-in, or comes with the iis cover, because HTTP/2 connections can't
+	// be hijacked for WebSocket.
+	cover := tlsCover{minVersion: "1.2", alpn: "http/1.1"}
+	if name := cfg.String("TLS_COVER", ""); name != "" {
+		var ok bool
+		if cover, ok = tlsCovers[name]; !ok {
+			return nil, fmt.Errorf("unknown TLS_COVER %q (expected nginx, apache or iis)", name)
+		}
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		NextProtos:   cfg.List("TLS_ALPN", cover.alpn),
+	}
+
+	if cfg.Bool("OCSP_STAPLING", true) {
+		stapler, err := newOCSPStapler(cert)
+		if err != nil {
+			return nil, fmt.Errorf("setting up OCSP stapling: %v", err)
+		}
+		if stapler != nil {
+			tlsConfig.Certificates = nil
+			tlsConfig.GetCertificate = stapler.getCertificate
+			go stapler.run(ctx)
+		}
+	}
+
+	if tlsConfig.MinVersion, err = parseTLSVersion("TLS_MIN_VERSION", cfg.String("TLS_MIN_VERSION", cover.minVersion)); err != nil {
+		return nil, err
+	}
+	if v := cfg.String("TLS_MAX_VERSION", cover.maxVersion); v != "" {
+		if tlsConfig.MaxVersion, err = parseTLSVersion("TLS_MAX_VERSION", v); err != nil {
+			return nil, err
+		}
+	}
+
+	if names := cfg.List("TLS_CIPHER_SUITES", cover.cipherSuites); len(names) > 0 {
+		if tlsConfig.CipherSuites, err = parseCipherSuites(names); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, name := range cfg.List("TLS_CURVES", cover.curves) {
+		curve, ok := tlsCurves[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown TLS_CURVES entry %q", name)
+		}
+		tlsConfig.CurvePreferences = append(tlsConfig.CurvePreferences, curve)
+	}
+
+	if caFile := cfg.String("TLS_CLIENT_CA_FILE", ""); caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading TLS_CLIENT_CA_FILE: %v", err)
+		}
+		tlsConfig.ClientCAs = x509.NewCertPool()
+		if !tlsConfig.ClientCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in TLS_CLIENT_CA_FILE")
+		}
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	if pinFile := cfg.String("TLS_CLIENT_PINS_FILE", ""); pinFile != "" {
+		pins, err := loadClientPins(pinFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS_CLIENT_PINS_FILE: %v", err)
+		}
+		pins.reloadOnSIGHUP()
+		// Without a CA the pins alone decide who gets in
+		if tlsConfig.ClientAuth == tls.NoClientCert {
+			tlsConfig.ClientAuth = tls.RequireAnyClientCert
+		}
+		tlsConfig.VerifyConnection = pins.verifyConnection
+	}
+
+	if !cfg.Bool("TLS_SESSION_TICKETS", true) {
+		tlsConfig.SessionTicketsDisabled = true
+	} else if v := cfg.String("TLS_SESSION_TICKET_ROTATION", ""); v != "" {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid TLS_SESSION_TICKET_ROTATION %q", v)
+		}
+		if err := rotateSessionTicketKeys(ctx, tlsConfig, interval); err != nil {
+			return nil, err
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+func parseTLSVersion(key, value string) (uint16, error) {
+	v, ok := tlsVersions[value]
+	if !ok {
+		return 0, fmt.Errorf("invalid %s %q (expected 1.0, 1.1, 1.2 or 1.3)", key, value)
+	}
+	return v, nil
+}
+
+// parseCipherSuites maps IANA suite names onto IDs. Only secure suites are
+// accepted; TLS 1.3 suites are not configurable in crypto/tls.
+func parseCipherSuites(names []string) ([]uint16, error) {
+	known := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		known[s.Name] = s.ID
+	}
+
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure TLS_CIPHER_SUITES entry %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// rotateSessionTicketKeys installs a fresh ticket key every interval while
+// keeping the previous two so recently issued tickets still resume, until
+// ctx is cancelled.
+func rotateSessionTicketKeys(ctx context.Context, cfg *tls.Config, interval time.Duration) error {
+	var keys [][32]byte
+	rotate := func() error {
+		var key [32]byte
+		if _, err := rand.Read(key[:]); err != nil {
+			return err
+		}
+		keys = append([][32]byte{key}, keys...)
+		if len(keys) > 3 {
+			keys = keys[:3]
+		}
+		cfg.SetSessionTicketKeys(keys)
+		return nil
+	}
+	if err := rotate(); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if err := rotate(); err != nil {
+					log.Printf("Session ticket key rotation failed: %v", err)
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,158 @@
+package redirector
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google-redirector/config"
+)
+
+// writeTestCert writes a self-signed certificate and key into dir and
+// returns their paths.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return certFile, keyFile
+}
+
+func TestTLSListenerConfig_FromConfig(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	t.Setenv("TLS_CERT_FILE", certFile)
+	t.Setenv("TLS_KEY_FILE", keyFile)
+	t.Setenv("TLS_MIN_VERSION", "1.2")
+	t.Setenv("TLS_MAX_VERSION", "1.2")
+	t.Setenv("TLS_CIPHER_SUITES", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+	t.Setenv("TLS_CURVES", "X25519,P256")
+	t.Setenv("TLS_ALPN", "http/1.1")
+
+	cfg, err := tlsListenerConfig(context.Background(), config.FromEnv())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if cfg.MinVersion != tls.VersionTLS12 || cfg.MaxVersion != tls.VersionTLS12 {
+		t.Errorf("Expected TLS 1.2 only, got min=%x max=%x", cfg.MinVersion, cfg.MaxVersion)
+	}
+	if len(cfg.CipherSuites) != 1 || cfg.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Errorf("Unexpected cipher suites: %v", cfg.CipherSuites)
+	}
+	if len(cfg.CurvePreferences) != 2 || cfg.CurvePreferences[0] != tls.X25519 {
+		t.Errorf("Unexpected curves: %v", cfg.CurvePreferences)
+	}
+	if len(cfg.NextProtos) != 1 || cfg.NextProtos[0] != "http/1.1" {
+		t.Errorf("Unexpected ALPN: %v", cfg.NextProtos)
+	}
+}
+
+func TestTLSListenerConfig_RejectsInsecureSuite(t *testing.T) {
+	if _, err := parseCipherSuites([]string{"TLS_RSA_WITH_RC4_128_SHA"}); err == nil {
+		t.Error("Expected insecure cipher suite to be rejected")
+	}
+}
+
+func TestTLSListenerConfig_Cover(t *testing.T) {
+	certFile, keyFile := writeTestCert(t, t.TempDir())
+	cfg, err := tlsListenerConfig(context.Background(), config.FromMap(map[string]string{
+		"TLS_CERT_FILE": certFile,
+		"TLS_KEY_FILE":  keyFile,
+		"TLS_COVER":     "iis",
+		"TLS_ALPN":      "http/1.1", // explicit settings override the cover
+	}))
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if version, alpn := coverHandshake(t, cfg); version != tls.VersionTLS12 || alpn != "http/1.1" {
+		t.Errorf("Expected TLS_ALPN to override the cover, got %s and %q", tls.VersionName(version), alpn)
+	}
+
+	tests := []struct {
+		cover   string
+		version uint16
+		alpn    string
+	}{
+		{"nginx", tls.VersionTLS13, "http/1.1"},
+		{"apache", tls.VersionTLS13, "http/1.1"},
+		{"iis", tls.VersionTLS12, "h2"},
+	}
+	for _, tt := range tests {
+		cfg, err := tlsListenerConfig(context.Background(), config.FromMap(map[string]string{
+			"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_COVER": tt.cover,
+		}))
+		if err != nil {
+			t.Errorf("Cover %s: %v", tt.cover, err)
+			continue
+		}
+		if version, alpn := coverHandshake(t, cfg); version != tt.version || alpn != tt.alpn {
+			t.Errorf("Cover %s: expected %s and %q, got %s and %q", tt.cover, tls.VersionName(tt.version), tt.alpn, tls.VersionName(version), alpn)
+		}
+	}
+	if _, err := tlsListenerConfig(context.Background(), config.FromMap(map[string]string{
+		"TLS_CERT_FILE": certFile, "TLS_KEY_FILE": keyFile, "TLS_COVER": "caddy",
+	})); err == nil {
+		t.Error("Expected an error for an unknown cover")
+	}
+}
+
+// coverHandshake completes a handshake with a server using cfg, offering
+// every version and both ALPN protocols, and returns what was negotiated.
+func coverHandshake(t *testing.T, cfg *tls.Config) (version uint16, alpn string) {
+	t.Helper()
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.(*tls.Conn).Handshake()
+	}()
+
+	conn, err := tls.Dial("tcp", ln.Addr().String(), &tls.Config{
+		InsecureSkipVerify: true,
+		NextProtos:         []string{"h2", "http/1.1"},
+	})
+	if err != nil {
+		t.Fatalf("Handshake failed: %v", err)
+	}
+	defer conn.Close()
+	state := conn.ConnectionState()
+	return state.Version, state.NegotiatedProtocol
+}
@@ -0,0 +1,346 @@
+// Package store keeps the redirector's runtime state (slowloris bans, replay
+// nonces and per-client counters) in an embedded SQLite database, so it
+// survives restarts and can be inspected with the sqlite3 shell:
+//
+//	sqlite3 state.db "SELECT ip, requests, blocked, datetime(last_seen, 'unixepoch') FROM clients ORDER BY blocked DESC"
+//
+// Times are stored as Unix seconds. One-time URLs are out of scope: the
+// redirector has no such feature, so there is no state of theirs to keep.
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"google-redirector/clientip"
+	"google-redirector/config"
+	"google-redirector/plugins"
+	_ "modernc.org/sqlite" // pure Go, so CGO_ENABLED=0 builds keep working
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS bans (
+	ip    TEXT PRIMARY KEY,
+	until INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS nonces (
+	hash    BLOB PRIMARY KEY,
+	expires INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS clients (
+	ip           TEXT PRIMARY KEY,
+	requests     INTEGER NOT NULL DEFAULT 0,
+	blocked      INTEGER NOT NULL DEFAULT 0,
+	first_seen   INTEGER NOT NULL,
+	last_seen    INTEGER NOT NULL,
+	block_reason TEXT
+);
+CREATE INDEX IF NOT EXISTS clients_last_seen ON clients (last_seen);`
+
+// Store is an open state database. Bans and client counters are gathered
+// in memory and written on every flush (see Start), along with anything
+// registered through OnFlush. Clients not seen for STATE_CLIENT_RETENTION
+// are dropped on flush.
+type Store struct {
+	path      string
+	db        *sql.DB
+	interval  time.Duration
+	retention time.Duration // 0 keeps every client
+
+	flushMu sync.Mutex // serialises flushes with each other and Close
+	closed  bool
+
+	mu       sync.Mutex
+	clients  map[string]*clientStats // deltas since the last flush
+	bans     map[string]time.Time    // made since the last flush
+	flushers []func()
+}
+
+type clientStats struct {
+	requests, blocked   int64
+	firstSeen, lastSeen time.Time
+	blockReason         string
+}
+
+// Nonce is a remembered replay nonce, by hash.
+type Nonce struct {
+	Hash    []byte
+	Expires time.Time
+}
+
+// New returns nil unless STATE_DB names the database file, which is
+// created if needed.
+func New(cfg *config.Config) (*Store, error) {
+	path := cfg.String("STATE_DB", "")
+	if path == "" {
+		return nil, nil
+	}
+	interval := cfg.Duration("STATE_FLUSH_INTERVAL", 10*time.Second)
+	if interval <= 0 {
+		return nil, fmt.Errorf("STATE_FLUSH_INTERVAL must be positive")
+	}
+	retention := cfg.Duration("STATE_CLIENT_RETENTION", 30*24*time.Hour)
+	if retention < 0 {
+		return nil, fmt.Errorf("STATE_CLIENT_RETENTION must not be negative")
+	}
+
+	dsn := "file:" + url.PathEscape(path) + "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+	// SQLite serialises writers anyway; one connection avoids SQLITE_BUSY
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(schema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("opening %s: %v", path, err)
+	}
+
+	return &Store{
+		path:      path,
+		db:        db,
+		interval:  interval,
+		retention: retention,
+		clients:   make(map[string]*clientStats),
+		bans:      make(map[string]time.Time),
+	}, nil
+}
+
+// Start flushes every STATE_FLUSH_INTERVAL until ctx is cancelled or the
+// store is closed.
+func (s *Store) Start(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if !s.flush() {
+					return
+				}
+			}
+		}
+	}()
+}
+
+func (s *Store) String() string {
+	return s.path
+}
+
+// OnFlush has fn called on every flush and on Close, for state kept in
+// memory elsewhere that should be written periodically.
+func (s *Store) OnFlush(fn func()) {
+	s.mu.Lock()
+	s.flushers = append(s.flushers, fn)
+	s.mu.Unlock()
+}
+
+// flush writes the pending state, reporting false once the store is closed.
+func (s *Store) flush() bool {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	return s.flushLocked()
+}
+
+func (s *Store) flushLocked() bool {
+	if s.closed {
+		return false
+	}
+	s.mu.Lock()
+	flushers := s.flushers
+	clients, bans := s.clients, s.bans
+	s.clients = make(map[string]*clientStats)
+	s.bans = make(map[string]time.Time)
+	s.mu.Unlock()
+
+	for _, fn := range flushers {
+		fn()
+	}
+	if err := s.saveBans(bans); err != nil {
+		log.Printf("Saving bans to %s failed: %v", s.path, err)
+	}
+	if err := s.saveClients(clients, time.Now()); err != nil {
+		log.Printf("Saving client counters to %s failed: %v", s.path, err)
+	}
+	return true
+}
+
+// Close flushes and closes the database. The store must not be used
+// afterwards.
+func (s *Store) Close() error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+	if !s.flushLocked() {
+		return nil
+	}
+	s.closed = true
+	return s.db.Close()
+}
+
+// Ban records that ip is banned until the given time. It is written on the
+// next flush, so it is cheap enough to call with other locks held.
+func (s *Store) Ban(ip string, until time.Time) {
+	s.mu.Lock()
+	s.bans[ip] = until
+	s.mu.Unlock()
+}
+
+func (s *Store) saveBans(bans map[string]time.Time) error {
+	if len(bans) == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for ip, until := range bans {
+		if _, err := tx.Exec(`INSERT INTO bans (ip, until) VALUES (?, ?)
+			ON CONFLICT (ip) DO UPDATE SET until = excluded.until`, ip, until.Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Bans returns the bans still in force at now, dropping expired ones.
+func (s *Store) Bans(now time.Time) (map[string]time.Time, error) {
+	if _, err := s.db.Exec(`DELETE FROM bans WHERE until <= ?`, now.Unix()); err != nil {
+		return nil, err
+	}
+	rows, err := s.db.Query(`SELECT ip, until FROM bans`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bans := make(map[string]time.Time)
+	for rows.Next() {
+		var ip string
+		var until int64
+		if err := rows.Scan(&ip, &until); err != nil {
+			return nil, err
+		}
+		bans[ip] = time.Unix(until, 0)
+	}
+	return bans, rows.Err()
+}
+
+// SaveNonces adds nonces and drops those expired at now.
+func (s *Store) SaveNonces(nonces []Nonce, now time.Time) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, n := range nonces {
+		if _, err := tx.Exec(`INSERT INTO nonces (hash, expires) VALUES (?, ?)
+			ON CONFLICT (hash) DO UPDATE SET expires = excluded.expires`, n.Hash, n.Expires.Unix()); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM nonces WHERE expires <= ?`, now.Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Nonces returns the nonces unexpired at now, soonest to expire first.
+func (s *Store) Nonces(now time.Time) ([]Nonce, error) {
+	rows, err := s.db.Query(`SELECT hash, expires FROM nonces WHERE expires > ? ORDER BY expires`, now.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var nonces []Nonce
+	for rows.Next() {
+		var n Nonce
+		var expires int64
+		if err := rows.Scan(&n.Hash, &expires); err != nil {
+			return nil, err
+		}
+		n.Expires = time.Unix(expires, 0)
+		nonces = append(nonces, n)
+	}
+	return nonces, rows.Err()
+}
+
+// Plugin counts requests and blocks per client address.
+func (s *Store) Plugin() *plugins.Plugin {
+	return &plugins.Plugin{
+		Name: "store",
+		OnRequest: func(w http.ResponseWriter, r *http.Request) bool {
+			s.count(r, "")
+			return true
+		},
+		OnBlock: func(r *http.Request, reason string) {
+			s.count(r, reason)
+		},
+	}
+}
+
+// count records a request from r's client, blocked if reason isn't "".
+func (s *Store) count(r *http.Request, reason string) {
+	ip := clientip.FromContext(r.Context())
+	if ip == "" {
+		ip = clientip.From(r)
+	}
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := s.clients[ip]
+	if c == nil {
+		c = &clientStats{firstSeen: now}
+		s.clients[ip] = c
+	}
+	c.lastSeen = now
+	if reason == "" {
+		c.requests++
+	} else {
+		c.blocked++
+		c.blockReason = reason
+	}
+}
+
+// saveClients adds the counters in clients and drops clients last seen
+// more than the retention before now.
+func (s *Store) saveClients(clients map[string]*clientStats, now time.Time) error {
+	if len(clients) == 0 && s.retention == 0 {
+		return nil
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for ip, c := range clients {
+		var reason any
+		if c.blockReason != "" {
+			reason = c.blockReason
+		}
+		if _, err := tx.Exec(`INSERT INTO clients (ip, requests, blocked, first_seen, last_seen, block_reason)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT (ip) DO UPDATE SET
+				requests = requests + excluded.requests,
+				blocked = blocked + excluded.blocked,
+				last_seen = excluded.last_seen,
+				block_reason = COALESCE(excluded.block_reason, block_reason)`,
+			ip, c.requests, c.blocked, c.firstSeen.Unix(), c.lastSeen.Unix(), reason); err != nil {
+			return err
+		}
+	}
+	if s.retention > 0 {
+		if _, err := tx.Exec(`DELETE FROM clients WHERE last_seen < ?`, now.Add(-s.retention).Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
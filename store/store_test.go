@@ -0,0 +1,128 @@
+package store
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google-redirector/clientip"
+	"google-redirector/config"
+)
+
+func openTestStore(t *testing.T, path string) *Store {
+	t.Helper()
+	s, err := New(config.FromMap(map[string]string{"STATE_DB": path, "STATE_FLUSH_INTERVAL": "1h"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStore_Bans(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	s := openTestStore(t, path)
+	now := time.Now()
+	s.Ban("192.0.2.1", now.Add(time.Hour))
+	s.Ban("192.0.2.2", now.Add(-time.Second))
+	s.Close()
+
+	s = openTestStore(t, path)
+	defer s.Close()
+	bans, err := s.Bans(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bans) != 1 || bans["192.0.2.1"].Unix() != now.Add(time.Hour).Unix() {
+		t.Errorf("Expected only the unexpired ban to survive a reopen, got %v", bans)
+	}
+}
+
+func TestStore_Nonces(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "state.db"))
+	defer s.Close()
+	now := time.Now()
+	err := s.SaveNonces([]Nonce{
+		{Hash: []byte("late"), Expires: now.Add(2 * time.Minute)},
+		{Hash: []byte("soon"), Expires: now.Add(time.Minute)},
+		{Hash: []byte("gone"), Expires: now.Add(-time.Minute)},
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonces, err := s.Nonces(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(nonces) != 2 || !bytes.Equal(nonces[0].Hash, []byte("soon")) || !bytes.Equal(nonces[1].Hash, []byte("late")) {
+		t.Errorf("Expected the unexpired nonces, soonest first, got %v", nonces)
+	}
+}
+
+func TestStore_ClientCounters(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "state.db"))
+	defer s.Close()
+	flushed := 0
+	s.OnFlush(func() { flushed++ })
+
+	p := s.Plugin()
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = "198.51.100.7:1234"
+		r = clientip.With(r)
+		p.OnRequest(httptest.NewRecorder(), r)
+		p.OnBlock(r, "missing verification header")
+		s.flush()
+	}
+	if flushed != 2 {
+		t.Errorf("Expected OnFlush hooks to run on every flush, ran %d times", flushed)
+	}
+
+	var requests, blocked int
+	var reason string
+	err := s.db.QueryRow(`SELECT requests, blocked, block_reason FROM clients WHERE ip = ?`, "198.51.100.7").Scan(&requests, &blocked, &reason)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requests != 2 || blocked != 2 || reason != "missing verification header" {
+		t.Errorf("Expected 2 requests, 2 blocked and the last reason, got %d, %d and %q", requests, blocked, reason)
+	}
+}
+
+func TestStore_ClientRetention(t *testing.T) {
+	s, err := New(config.FromMap(map[string]string{
+		"STATE_DB":               filepath.Join(t.TempDir(), "state.db"),
+		"STATE_CLIENT_RETENTION": "24h",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	now := time.Now()
+	stale, recent := now.Add(-48*time.Hour).Unix(), now.Add(-time.Hour).Unix()
+	if _, err := s.db.Exec(`INSERT INTO clients (ip, first_seen, last_seen) VALUES ('192.0.2.1', ?, ?), ('192.0.2.2', ?, ?)`, stale, stale, recent, recent); err != nil {
+		t.Fatal(err)
+	}
+	s.flush()
+
+	var ip string
+	if err := s.db.QueryRow(`SELECT group_concat(ip) FROM clients`).Scan(&ip); err != nil {
+		t.Fatal(err)
+	}
+	if ip != "192.0.2.2" {
+		t.Errorf("Expected only the recent client to be kept, got %q", ip)
+	}
+}
+
+func TestStore_Config(t *testing.T) {
+	if s, err := New(config.FromMap(nil)); s != nil || err != nil {
+		t.Errorf("Expected no state database by default, got %v (%v)", s, err)
+	}
+	if _, err := New(config.FromMap(map[string]string{"STATE_DB": filepath.Join(t.TempDir(), "missing", "state.db")})); err == nil {
+		t.Error("Expected an error for an unwritable database path")
+	}
+	if _, err := New(config.FromMap(map[string]string{"STATE_DB": filepath.Join(t.TempDir(), "state.db"), "STATE_CLIENT_RETENTION": "-1h"})); err == nil {
+		t.Error("Expected an error for a negative client retention")
+	}
+}
@@ -0,0 +1,520 @@
+// Package wsproxy relays WebSocket upgrades to the backend and terminates
+// TCP-over-WebSocket tunnels.
+package wsproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google-redirector/clientip"
+	"google-redirector/config"
+	"google-redirector/filter"
+	"google-redirector/plugins"
+	"google-redirector/proxy"
+)
+
+// IsWebSocketRequest reports whether r asks to upgrade to WebSocket.
+func IsWebSocketRequest(r *http.Request) bool {
+	return strings.ToLower(r.Header.Get("Upgrade")) == "websocket" &&
+		strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade")
+}
+
+// Proxy relays WebSocket upgrades to the backend over a hijacked
+// connection. New fills in the settings it owns; the shared dependencies
+// are set by the caller, and Signer, Throttle, Envelope and Plugins may be
+// left nil.
+type Proxy struct {
+	Pool     *proxy.Pool
+	Signer   *proxy.Signer
+	Dialer   *net.Dialer
+	Throttle *proxy.Throttle
+	// Obfuscator pads and delays frames on the backend leg (strict mode
+	// only, since frames are opaque otherwise) and pads the upgrade request.
+	Obfuscator *proxy.Obfuscator
+	Envelope   *proxy.Envelope
+	Decoy      *filter.Decoy
+	Plugins    plugins.Chain
+
+	protos  *subprotocolPolicy
+	origin  *originPolicy
+	headers *headerForwarding
+	tunnel  *wsTunnel
+	strict  bool // validate frames and run the close handshake (RFC 6455)
+	// rehandshake sends the backend our own Sec-WebSocket-Key and answers
+	// the client's key ourselves instead of replaying both unchanged.
+	rehandshake bool
+	// idle ends relays and tunnels on which neither side has sent anything
+	// for this long, since a hijacked connection's request context isn't
+	// cancelled when the client silently goes away.
+	idle time.Duration
+
+	// base outlives every request and is cancelled by Shutdown, which is
+	// how hijacked connections (invisible to http.Server) learn about it.
+	baseOnce   sync.Once
+	base       context.Context
+	cancelBase context.CancelCauseFunc
+}
+
+var (
+	errShuttingDown = errors.New("server shutting down")
+	errIdle         = errors.New("idle timeout")
+)
+
+// New reads the WS_* settings from cfg.
+func New(cfg *config.Config) (*Proxy, error) {
+	protos, err := subprotocolPolicyFromConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("subprotocols: %v", err)
+	}
+	origin, err := originPolicyFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	headers, err := headerForwardingFromConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := wsTunnelFromConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("tunnels: %v", err)
+	}
+	idle := cfg.Duration("WS_IDLE_TIMEOUT", 10*time.Minute)
+	if idle < 0 {
+		return nil, fmt.Errorf("WS_IDLE_TIMEOUT must not be negative")
+	}
+	return &Proxy{
+		protos:      protos,
+		origin:      origin,
+		headers:     headers,
+		tunnel:      tunnel,
+		strict:      cfg.Bool("WS_STRICT_RFC6455", false),
+		rehandshake: cfg.Bool("WS_REHANDSHAKE", false),
+		idle:        idle,
+	}, nil
+}
+
+func (p *Proxy) String() string {
+	s := fmt.Sprintf("subprotocols: %s, %d allowed, %d mapped", p.protos.mode, len(p.protos.allow), len(p.protos.toBackend))
+	if p.rehandshake {
+		s += ", independent handshake"
+	}
+	if p.origin != nil {
+		s += ", " + p.origin.String()
+	}
+	if p.headers.all {
+		s += ", all headers forwarded"
+	}
+	return s
+}
+
+// Tunnels describes the TCP tunnel targets, or returns "" when tunnels are
+// disabled.
+func (p *Proxy) Tunnels() string {
+	if p.tunnel == nil {
+		return ""
+	}
+	return fmt.Sprintf("%d targets under %s", len(p.tunnel.targets), p.tunnel.prefix)
+}
+
+// Strict reports whether WS_STRICT_RFC6455 is on.
+func (p *Proxy) Strict() bool {
+	return p.strict
+}
+
+// Shutdown ends every open relay and tunnel, sending 1001 (going away) where
+// the close handshake is in use. Install it with http.Server's
+// RegisterOnShutdown.
+func (p *Proxy) Shutdown() {
+	p.initBase()
+	p.cancelBase(errShuttingDown)
+}
+
+func (p *Proxy) initBase() {
+	p.baseOnce.Do(func() {
+		p.base, p.cancelBase = context.WithCancelCause(context.Background())
+	})
+}
+
+// relayContext returns a context for the lifetime of a hijacked relay. It is
+// cancelled when r's context is, on Shutdown, and by the returned func.
+func (p *Proxy) relayContext(r *http.Request) (context.Context, context.CancelCauseFunc) {
+	p.initBase()
+	ctx, cancel := context.WithCancelCause(r.Context())
+	stop := context.AfterFunc(p.base, func() { cancel(context.Cause(p.base)) })
+	return ctx, func(cause error) {
+		stop()
+		cancel(cause)
+	}
+}
+
+// closeOnDone closes conns as soon as ctx is done, which unblocks the copy
+// goroutines on both sides. Legs still open first get a close frame with
+// code. The returned func disarms it once the relay has ended by itself.
+func closeOnDone(ctx context.Context, code uint16, legs []*wsLeg, conns ...net.Conn) func() bool {
+	return context.AfterFunc(ctx, func() {
+		log.Printf("WebSocket relay cancelled: %v", context.Cause(ctx))
+		for _, l := range legs {
+			l.sendClose(code)
+		}
+		for _, c := range conns {
+			c.Close()
+		}
+	})
+}
+
+// idleWatch cancels a relay once nothing has been read from either side for
+// the proxy's idle timeout. Pings count, so clients that keep the connection
+// alive with them are never cut off.
+type idleWatch struct {
+	last atomic.Int64 // UnixNano of the last read
+}
+
+// watchIdle starts an idleWatch that calls cancel, or returns nil when there
+// is no idle timeout. It stops with ctx.
+func (p *Proxy) watchIdle(ctx context.Context, cancel context.CancelCauseFunc) *idleWatch {
+	if p.idle <= 0 {
+		return nil
+	}
+	w := &idleWatch{}
+	w.last.Store(time.Now().UnixNano())
+	go func() {
+		timer := time.NewTimer(p.idle)
+		defer timer.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+			}
+			idle := time.Since(time.Unix(0, w.last.Load()))
+			if idle >= p.idle {
+				cancel(errIdle)
+				return
+			}
+			timer.Reset(p.idle - idle)
+		}
+	}()
+	return w
+}
+
+// reader returns r, recording every read from it as activity.
+func (w *idleWatch) reader(r io.Reader) io.Reader {
+	if w == nil {
+		return r
+	}
+	return &activityReader{r: r, w: w}
+}
+
+type activityReader struct {
+	r io.Reader
+	w *idleWatch
+}
+
+func (a *activityReader) Read(p []byte) (int, error) {
+	n, err := a.r.Read(p)
+	if n > 0 {
+		a.w.last.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// ServeHTTP handles an upgrade request, which IsWebSocketRequest has
+// already identified.
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	log.Printf("WebSocket upgrade request: %s %s", r.Method, r.URL.Path)
+
+	if p.origin != nil {
+		if err := p.origin.check(r.Header); err != nil {
+			log.Printf("Rejected WebSocket upgrade from %s: %v", clientip.From(r), err)
+			p.Plugins.Block(r, err.Error())
+			p.Decoy.Serve(w, r)
+			return
+		}
+	}
+
+	if p.tunnel != nil {
+		if addr, ok := p.tunnel.match(r); ok {
+			p.serveTunnel(w, r, addr)
+			return
+		}
+	}
+
+	key, err := clientKey(r.Header)
+	if err != nil {
+		log.Printf("Rejected WebSocket upgrade from %s: %v", clientip.From(r), err)
+		p.Plugins.Block(r, err.Error())
+		p.Decoy.Serve(w, r)
+		return
+	}
+	backendKey := key
+	if p.rehandshake {
+		backendKey = newWebSocketKey()
+	}
+
+	offered := subprotocols(r.Header)
+	backendProtos, err := p.protos.offer(offered)
+	if err != nil {
+		log.Printf("Rejected WebSocket upgrade from %s: %v", clientip.From(r), err)
+		p.Plugins.Block(r, err.Error())
+		p.Decoy.Serve(w, r)
+		return
+	}
+
+	// Build backend WebSocket URL
+	target := p.Pool.PickFor(r)
+	backendURL := &url.URL{
+		Scheme:   "ws",
+		Host:     target.URL.Host,
+		Path:     r.URL.Path,
+		RawQuery: r.URL.RawQuery,
+	}
+	if target.URL.Scheme == "https" {
+		backendURL.Scheme = "wss"
+	}
+
+	if err := p.Plugins.TunnelOpen(r, backendURL.String()); err != nil {
+		log.Printf("Rejected WebSocket upgrade from %s: %v", clientip.From(r), err)
+		p.Plugins.Block(r, err.Error())
+		p.Decoy.Serve(w, r)
+		return
+	}
+
+	log.Printf("Connecting to backend WebSocket: %s", backendURL)
+
+	// Connect to backend
+	start := time.Now()
+	backendConn, backendResp, err := p.dialBackendWebSocket(r.Context(), backendURL, r, backendKey, backendProtos)
+	p.Pool.Observe(target, time.Since(start), err != nil)
+	if err != nil {
+		log.Printf("Backend WebSocket dial failed: %v", err)
+		http.Error(w, "Failed to connect to backend", http.StatusBadGateway)
+		return
+	}
+	defer backendConn.Close()
+
+	proto, err := p.protos.accept(offered, backendResp.Header.Get("Sec-WebSocket-Protocol"))
+	if err != nil {
+		log.Printf("Rejected WebSocket upgrade from %s: %v", clientip.From(r), err)
+		p.Plugins.Block(r, err.Error())
+		p.Decoy.Serve(w, r)
+		return
+	}
+
+	// Hijack client connection
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		log.Printf("Hijacking not supported")
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Hijack failed: %v", err)
+		return
+	}
+	defer clientConn.Close()
+	clientConn = withBuffered(clientConn, clientBuf.Reader)
+
+	// Send 101 Switching Protocols response to client
+	if err := writeSwitchingProtocols(clientConn, websocketAccept(key), proto, backendResp.Header.Get("Sec-WebSocket-Extensions")); err != nil {
+		log.Printf("Failed to send upgrade response: %v", err)
+		return
+	}
+
+	log.Printf("WebSocket connection established, proxying data...")
+
+	client := &wsLeg{name: "client", conn: clientConn, client: true}
+	backend := &wsLeg{name: "backend", conn: backendConn, obfs: p.Obfuscator}
+	var legs []*wsLeg
+	if p.strict {
+		legs = []*wsLeg{client, backend}
+	}
+	ctx, cancel := p.relayContext(r)
+	defer cancel(nil)
+	defer closeOnDone(ctx, closeGoingAway, legs, clientConn, backendConn)()
+	var clientSrc, backendSrc io.Reader = clientConn, backendConn
+	if p.Throttle != nil {
+		lim := p.Throttle.Limiter(ctx, clientip.From(r))
+		defer lim.Release()
+		clientSrc, backendSrc = lim.Reader(clientConn), lim.Reader(backendConn)
+	}
+	idle := p.watchIdle(ctx, cancel)
+	clientSrc, backendSrc = idle.reader(clientSrc), idle.reader(backendSrc)
+
+	if p.strict {
+		var rsvAllowed byte
+		if strings.Contains(backendResp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+			rsvAllowed = 0x40
+		}
+		relayStrict(ctx, client, backend, clientSrc, backendSrc, rsvAllowed)
+		return
+	}
+
+	// Bidirectional copy
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go pipe(backendConn, clientSrc, "client→backend", &wg)
+	go pipe(clientConn, backendSrc, "backend→client", &wg)
+
+	wg.Wait()
+}
+
+// dialBackendWebSocket performs the upgrade with the backend using key, and
+// fails unless the backend answers with the matching Sec-WebSocket-Accept.
+func (p *Proxy) dialBackendWebSocket(ctx context.Context, u *url.URL, r *http.Request, key string, protos []string) (net.Conn, *http.Response, error) {
+	// Determine host and port
+	host := u.Host
+	if !strings.Contains(host, ":") {
+		if u.Scheme == "wss" {
+			host += ":443"
+		} else {
+			host += ":80"
+		}
+	}
+
+	// Dial TCP connection
+	conn, err := p.Dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Wrap with TLS if wss
+	if u.Scheme == "wss" {
+		tlsConn := tls.Client(conn, &tls.Config{
+			ServerName:         u.Hostname(),
+			InsecureSkipVerify: true,
+		})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+		conn = tlsConn
+	}
+
+	// Build WebSocket upgrade request
+	req := &http.Request{
+		Method: "GET",
+		URL:    u,
+		Header: make(http.Header),
+		Host:   u.Host,
+	}
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+
+	// Handshake headers
+	req.Header.Set("Sec-WebSocket-Version", r.Header.Get("Sec-WebSocket-Version"))
+	req.Header.Set("Sec-WebSocket-Key", key)
+
+	if len(protos) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(protos, ", "))
+	}
+
+	if ext := r.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		req.Header.Set("Sec-WebSocket-Extensions", ext)
+	}
+
+	p.headers.copy(req.Header, r.Header)
+	if p.Envelope != nil {
+		p.Envelope.Seal(req, r)
+	}
+
+	// IAM-protected WebSocket APIs authenticate the upgrade request itself
+	if p.Signer != nil {
+		if err := p.Signer.Sign(req, time.Now()); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	if p.Obfuscator != nil && p.Obfuscator.Pads() {
+		p.Obfuscator.PadRequest(req)
+	}
+
+	// Send upgrade request
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	// Read response
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, nil, fmt.Errorf("expected 101, got %d", resp.StatusCode)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(key) {
+		conn.Close()
+		return nil, nil, fmt.Errorf("backend sent a missing or wrong Sec-WebSocket-Accept")
+	}
+
+	return withBuffered(conn, br), resp, nil
+}
+
+// writeSwitchingProtocols completes the client handshake, confirming proto
+// (already checked against the subprotocol policy) and the extensions the
+// backend agreed to, unless they are empty. Frames are relayed as-is, so the
+// client must use the same extensions as the backend.
+func writeSwitchingProtocols(clientConn net.Conn, accept, proto, extensions string) error {
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + accept + "\r\n"
+
+	if proto != "" {
+		resp += fmt.Sprintf("Sec-WebSocket-Protocol: %s\r\n", proto)
+	}
+	if extensions != "" {
+		resp += fmt.Sprintf("Sec-WebSocket-Extensions: %s\r\n", extensions)
+	}
+
+	resp += "\r\n"
+
+	_, err := clientConn.Write([]byte(resp))
+	return err
+}
+
+func pipe(dst net.Conn, src io.Reader, dir string, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	n, err := io.Copy(dst, src)
+
+	if err != nil && !strings.Contains(err.Error(), "use of closed network connection") {
+		log.Printf("pipe %s error: %v (copied %d bytes)", dir, err, n)
+	} else {
+		log.Printf("pipe %s finished (copied %d bytes)", dir, n)
+	}
+
+	// 1. WebSocket close frame
+	_ = dst.SetWriteDeadline(time.Now().Add(2 * time.Second))
+	_, _ = dst.Write([]byte{0x88, 0x02, 0x03, 0xe8})
+
+	// 2. Full TLS shutdown (if applicable)
+	if tc, ok := dst.(*tls.Conn); ok {
+		_ = tc.Close() // sends + drains close_notify
+	} else {
+		// 3. For plain TCP: half-close + full close
+		if sc, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = sc.CloseWrite()
+		}
+		_ = dst.Close()
+	}
+}
@@ -0,0 +1,123 @@
+package wsproxy
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google-redirector/config"
+	"google-redirector/filter"
+	"google-redirector/internal/fakebackend"
+	"google-redirector/proxy"
+)
+
+func newTestProxy(t *testing.T, backendURL string, settings map[string]string) *Proxy {
+	t.Helper()
+	pool, err := proxy.NewPool(config.FromMap(map[string]string{"BACKEND_URLS": backendURL}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := New(config.FromMap(settings))
+	if err != nil {
+		t.Fatal(err)
+	}
+	decoy, err := filter.NewDecoy(config.FromMap(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Pool = pool
+	p.Decoy = decoy
+	p.Dialer = proxy.NewDialer(time.Second, nil)
+	return p
+}
+
+// openRelay upgrades through server and checks that the echo works.
+func openRelay(t *testing.T, server *httptest.Server) net.Conn {
+	t.Helper()
+	conn, br, resp, err := fakebackend.DialWebSocket(server.Listener.Addr().String(), "/ws", nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %v (%v)", resp, err)
+	}
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	fakebackend.WriteFrame(conn, fakebackend.OpText, []byte("hi"), true)
+	if _, payload, err := fakebackend.ReadFrame(br); err != nil || string(payload) != "hi" {
+		t.Fatalf("Expected echo, got %q (%v)", payload, err)
+	}
+	return &bufferedConn{Conn: conn, r: br}
+}
+
+func TestProxy_ShutdownClosesRelays(t *testing.T) {
+	backend := fakebackend.NewWebSocket(t)
+
+	for _, strict := range []string{"false", "true"} {
+		p := newTestProxy(t, backend.URL, map[string]string{"WS_STRICT_RFC6455": strict})
+		server := httptest.NewServer(p)
+		conn := openRelay(t, server)
+
+		p.Shutdown()
+		opcode, payload, err := fakebackend.ReadFrame(conn)
+		if strict == "true" {
+			if err != nil || opcode != fakebackend.OpClose || binary.BigEndian.Uint16(payload) != closeGoingAway {
+				t.Errorf("Expected 1001 close frame in strict mode, got opcode %d %v (%v)", opcode, payload, err)
+			}
+			_, _, err = fakebackend.ReadFrame(conn)
+		}
+		if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+			t.Errorf("Expected connection to be closed on shutdown (strict=%s), got %v", strict, err)
+		}
+		conn.Close()
+		server.Close()
+	}
+}
+
+func TestProxy_RequestContextEndsRelay(t *testing.T) {
+	backend := fakebackend.NewWebSocket(t)
+	p := newTestProxy(t, backend.URL, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	server := httptest.NewUnstartedServer(p)
+	server.Config.BaseContext = func(net.Listener) context.Context { return ctx }
+	server.Start()
+	defer server.Close()
+
+	conn := openRelay(t, server)
+	defer conn.Close()
+
+	cancel()
+	_, _, err := fakebackend.ReadFrame(conn)
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Errorf("Expected relay to end with the request context, got %v", err)
+	}
+}
+
+func TestProxy_IdleTimeoutEndsRelay(t *testing.T) {
+	backend := fakebackend.NewWebSocket(t)
+	p := newTestProxy(t, backend.URL, map[string]string{"WS_IDLE_TIMEOUT": "300ms"})
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	conn := openRelay(t, server)
+	defer conn.Close()
+
+	// Traffic keeps the relay open past the timeout
+	for i := 0; i < 3; i++ {
+		time.Sleep(200 * time.Millisecond)
+		fakebackend.WriteFrame(conn, fakebackend.OpText, []byte("hi"), true)
+		if _, payload, err := fakebackend.ReadFrame(conn); err != nil || string(payload) != "hi" {
+			t.Fatalf("Expected an active relay to stay open, got %q (%v)", payload, err)
+		}
+	}
+
+	start := time.Now()
+	_, _, err := fakebackend.ReadFrame(conn)
+	if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+		t.Errorf("Expected an idle relay to be closed, got %v", err)
+	}
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("Expected the relay to be closed only once idle, closed after %v", d)
+	}
+}
@@ -0,0 +1,425 @@
+package wsproxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"google-redirector/proxy"
+)
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xa
+
+	closeNormal          = 1000
+	closeGoingAway       = 1001
+	closeProtocolError   = 1002
+	closeInvalidPayload  = 1007
+	closeHandshakeWindow = 5 * time.Second
+	closeWriteTimeout    = 2 * time.Second
+
+	// maxBufferedFrame is the largest frame payload read whole before it is
+	// written on; larger frames are streamed in chunks of this size.
+	maxBufferedFrame = 64 * 1024
+)
+
+// bufferedConn reads through r first, so bytes the peer sent right behind
+// the handshake (and that bufio already pulled off the socket) aren't lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// withBuffered only wraps conn when r is holding data, so the common case
+// keeps the concrete *tls.Conn / *net.TCPConn that pipe's shutdown relies on.
+func withBuffered(conn net.Conn, r *bufio.Reader) net.Conn {
+	if r == nil || r.Buffered() == 0 {
+		return conn
+	}
+	return &bufferedConn{Conn: conn, r: r}
+}
+
+// wsViolation is an RFC 6455 protocol error, carrying the close code sent to
+// both sides when it is detected.
+type wsViolation struct {
+	code uint16
+	msg  string
+}
+
+func (v *wsViolation) Error() string { return v.msg }
+
+func violation(code uint16, format string, args ...any) error {
+	return &wsViolation{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// wsLeg is one side of a relayed WebSocket. Frames are written to conn whole
+// while holding mu, so a close frame injected by the proxy never lands in
+// the middle of a relayed frame. mu is only held while writing: a relayed
+// frame is read from its sender first, unless it is too large to buffer.
+type wsLeg struct {
+	name   string
+	conn   net.Conn
+	client bool              // frames from the client are masked, frames to it are not
+	obfs   *proxy.Obfuscator // pads and delays frames written to conn
+
+	mu     sync.Mutex
+	closed bool // a close frame has been written to conn
+}
+
+type wsFrameHeader struct {
+	fin    bool
+	rsv    byte
+	opcode byte
+	masked bool
+	mask   [4]byte
+	length uint64
+	raw    []byte
+}
+
+func readFrameHeader(r io.Reader) (*wsFrameHeader, error) {
+	var buf [14]byte
+	if _, err := io.ReadFull(r, buf[:2]); err != nil {
+		return nil, err
+	}
+	h := &wsFrameHeader{
+		fin:    buf[0]&0x80 != 0,
+		rsv:    buf[0] & 0x70,
+		opcode: buf[0] & 0x0f,
+		masked: buf[1]&0x80 != 0,
+		length: uint64(buf[1] & 0x7f),
+	}
+
+	n := 2
+	switch h.length {
+	case 126:
+		if _, err := io.ReadFull(r, buf[2:4]); err != nil {
+			return nil, err
+		}
+		n = 4
+		h.length = uint64(binary.BigEndian.Uint16(buf[2:4]))
+		if h.length < 126 {
+			return nil, violation(closeProtocolError, "payload length %d not minimally encoded", h.length)
+		}
+	case 127:
+		if _, err := io.ReadFull(r, buf[2:10]); err != nil {
+			return nil, err
+		}
+		n = 10
+		h.length = binary.BigEndian.Uint64(buf[2:10])
+		if h.length>>63 != 0 {
+			return nil, violation(closeProtocolError, "payload length has the most significant bit set")
+		}
+		if h.length <= 0xffff {
+			return nil, violation(closeProtocolError, "payload length %d not minimally encoded", h.length)
+		}
+	}
+	if h.masked {
+		if _, err := io.ReadFull(r, buf[n:n+4]); err != nil {
+			return nil, err
+		}
+		copy(h.mask[:], buf[n:n+4])
+		n += 4
+	}
+	h.raw = append([]byte(nil), buf[:n]...)
+	return h, nil
+}
+
+// check validates a frame header from the client (fromClient) or backend.
+// fragmented tracks whether a data message is in progress on this leg;
+// rsvAllowed holds the RSV bits a negotiated extension may use.
+func (h *wsFrameHeader) check(fromClient bool, rsvAllowed byte, fragmented *bool) error {
+	if h.masked != fromClient {
+		if fromClient {
+			return violation(closeProtocolError, "unmasked frame from client")
+		}
+		return violation(closeProtocolError, "masked frame from backend")
+	}
+	control := h.opcode&0x08 != 0
+	if h.rsv&^rsvAllowed != 0 || (h.rsv != 0 && (control || h.opcode == opContinuation)) {
+		return violation(closeProtocolError, "reserved bits %#x set on opcode %#x", h.rsv>>4, h.opcode)
+	}
+
+	switch h.opcode {
+	case opContinuation:
+		if !*fragmented {
+			return violation(closeProtocolError, "continuation frame outside a fragmented message")
+		}
+	case opText, opBinary:
+		if *fragmented {
+			return violation(closeProtocolError, "new data frame inside a fragmented message")
+		}
+	case opClose, opPing, opPong:
+		if !h.fin {
+			return violation(closeProtocolError, "fragmented control frame")
+		}
+		if h.length > 125 {
+			return violation(closeProtocolError, "control frame payload of %d bytes", h.length)
+		}
+		return nil
+	default:
+		return violation(closeProtocolError, "reserved opcode %#x", h.opcode)
+	}
+	*fragmented = !h.fin
+	return nil
+}
+
+// checkClosePayload validates the status code and reason of an (unmasked)
+// close frame payload.
+func checkClosePayload(p []byte) error {
+	if len(p) == 0 {
+		return nil
+	}
+	if len(p) == 1 {
+		return violation(closeProtocolError, "close frame with a 1-byte payload")
+	}
+	code := binary.BigEndian.Uint16(p)
+	if !(code >= 1000 && code <= 1003 || code >= 1007 && code <= 1014 || code >= 3000 && code <= 4999) {
+		return violation(closeProtocolError, "invalid close code %d", code)
+	}
+	if !utf8.Valid(p[2:]) {
+		return violation(closeInvalidPayload, "close reason is not valid UTF-8")
+	}
+	return nil
+}
+
+// relayFrames copies frames read from src (the from leg) to dst, validating
+// each one. It returns nil once a close frame has been relayed, and ctx's
+// error if ctx ends while a frame is held back for jitter.
+func relayFrames(ctx context.Context, dst, from *wsLeg, src io.Reader, rsvAllowed byte) error {
+	fragmented := false
+	for {
+		h, err := readFrameHeader(src)
+		if err != nil {
+			return err
+		}
+		if err := h.check(from.client, rsvAllowed, &fragmented); err != nil {
+			return err
+		}
+
+		if h.opcode == opClose {
+			payload := make([]byte, h.length)
+			if _, err := io.ReadFull(src, payload); err != nil {
+				return err
+			}
+			plain := append([]byte(nil), payload...)
+			if h.masked {
+				for i := range plain {
+					plain[i] ^= h.mask[i%4]
+				}
+			}
+			if err := checkClosePayload(plain); err != nil {
+				return err
+			}
+			dst.mu.Lock()
+			_, err = dst.conn.Write(append(h.raw, payload...))
+			dst.closed = true
+			dst.mu.Unlock()
+			return err
+		}
+
+		if dst.obfs != nil {
+			if err := dst.obfs.Wait(ctx); err != nil {
+				return err
+			}
+		}
+		if err := relayPayload(dst, h, src); err != nil {
+			return err
+		}
+	}
+}
+
+// relayPayload writes the frame h, whose payload is next in src, to dst.
+// Payloads up to maxBufferedFrame are read before dst is locked, so a slow
+// sender doesn't hold up the proxy's own frames to dst. Larger ones are read
+// a chunk at a time, and dst stays locked until the frame is complete.
+func relayPayload(dst *wsLeg, h *wsFrameHeader, src io.Reader) error {
+	size := min(h.length, maxBufferedFrame)
+	buf := append(make([]byte, 0, len(h.raw)+int(size)), h.raw...)
+	locked := false
+	defer func() {
+		if locked {
+			dst.mu.Unlock()
+		}
+	}()
+	for remaining := h.length; ; {
+		n := min(remaining, size)
+		start := len(buf)
+		buf = buf[:start+int(n)]
+		if _, err := io.ReadFull(src, buf[start:]); err != nil {
+			return err
+		}
+		remaining -= n
+		if !locked {
+			dst.mu.Lock()
+			locked = true
+		}
+		if _, err := dst.conn.Write(buf); err != nil {
+			return err
+		}
+		if remaining == 0 {
+			break
+		}
+		buf = buf[:0]
+	}
+	if dst.obfs != nil {
+		return dst.padLocked(len(h.raw) + int(h.length))
+	}
+	return nil
+}
+
+// sendClose writes a close frame with code to the leg, unless one has
+// already been sent. A relayed frame still being written is waited for, up
+// to closeWriteTimeout. Frames to the backend are masked, as RFC 6455
+// requires of clients.
+func (l *wsLeg) sendClose(code uint16) {
+	if !l.lockWithin(closeWriteTimeout) {
+		log.Printf("WebSocket %s busy, closing without a close frame", l.name)
+		return
+	}
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	l.closed = true
+
+	l.conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+	l.writeFrameLocked(opClose, binary.BigEndian.AppendUint16(nil, code))
+}
+
+// lockWithin locks l.mu, giving up after d.
+func (l *wsLeg) lockWithin(d time.Duration) bool {
+	deadline := time.Now().Add(d)
+	for !l.mu.TryLock() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// writeFrameLocked writes one unfragmented frame; l.mu must be held.
+func (l *wsLeg) writeFrameLocked(opcode byte, payload []byte) error {
+	frame := []byte{0x80 | opcode}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	if !l.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		frame[1] |= 0x80
+		frame = append(frame, mask[:]...)
+		start := len(frame)
+		frame = append(frame, payload...)
+		for i := range frame[start:] {
+			frame[start+i] ^= mask[i%4]
+		}
+	} else {
+		frame = append(frame, payload...)
+	}
+	_, err := l.conn.Write(frame)
+	return err
+}
+
+// padLocked follows a frame of size bytes with unsolicited pongs, which
+// RFC 6455 section 5.5.3 says need no answer, so that together they fill a
+// padding bucket. Control frames carry at most 125 bytes, so large gaps take
+// several; l.mu must be held.
+func (l *wsLeg) padLocked(size int) error {
+	hdr := 2
+	if !l.client {
+		hdr += 4 // mask
+	}
+	pad := l.obfs.Padding(size, hdr)
+	for pad > 0 {
+		n := pad - hdr
+		if n > 125 {
+			n = 125
+			// Never leave a remainder too small for another frame
+			if rest := pad - hdr - n; rest > 0 && rest < hdr {
+				n -= hdr
+			}
+		}
+		payload := make([]byte, n)
+		rand.Read(payload)
+		if err := l.writeFrameLocked(opPong, payload); err != nil {
+			return err
+		}
+		pad -= hdr + n
+	}
+	return nil
+}
+
+// relayStrict relays frames in both directions until the close handshake
+// completes. Protocol violations are logged and both sides get a close frame
+// with the matching code; a side that disappears without a close frame
+// leaves the other with 1001 (going away).
+func relayStrict(ctx context.Context, client, backend *wsLeg, clientSrc, backendSrc io.Reader, rsvAllowed byte) {
+	type result struct {
+		from *wsLeg
+		err  error
+	}
+	done := make(chan result, 2)
+	go func() { done <- result{client, relayFrames(ctx, backend, client, clientSrc, rsvAllowed)} }()
+	go func() { done <- result{backend, relayFrames(ctx, client, backend, backendSrc, rsvAllowed)} }()
+
+	other := func(l *wsLeg) *wsLeg {
+		if l == client {
+			return backend
+		}
+		return client
+	}
+	report := func(res result) bool {
+		var v *wsViolation
+		switch {
+		case res.err == nil:
+			return false
+		case errors.As(res.err, &v):
+			log.Printf("WebSocket protocol violation by %s: %s", res.from.name, v.msg)
+			client.sendClose(v.code)
+			backend.sendClose(v.code)
+			return true
+		default:
+			log.Printf("WebSocket %s went away without a close frame: %v", res.from.name, res.err)
+			other(res.from).sendClose(closeGoingAway)
+			return false
+		}
+	}
+
+	if !report(<-done) {
+		// Give the other side time to answer the close
+		timer := time.NewTimer(closeHandshakeWindow)
+		select {
+		case res := <-done:
+			report(res)
+		case <-timer.C:
+			log.Printf("WebSocket close handshake timed out")
+		}
+		timer.Stop()
+	}
+	client.conn.Close()
+	backend.conn.Close()
+}
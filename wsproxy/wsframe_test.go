@@ -0,0 +1,233 @@
+package wsproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google-redirector/config"
+	"google-redirector/internal/fakebackend"
+	"google-redirector/proxy"
+)
+
+// maskedFrame builds a single client frame with a fixed mask.
+func maskedFrame(opcode byte, payload []byte) []byte {
+	mask := [4]byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opcode, 0x80 | byte(len(payload))}
+	frame = append(frame, mask[:]...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	return frame
+}
+
+func readCloseCode(t *testing.T, conn net.Conn) uint16 {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	h, err := readFrameHeader(conn)
+	if err != nil {
+		t.Fatalf("Expected a close frame, got %v", err)
+	}
+	payload := make([]byte, h.length)
+	io.ReadFull(conn, payload)
+	for i := range payload {
+		payload[i] ^= h.mask[i%4]
+	}
+	if h.opcode != opClose || len(payload) < 2 {
+		t.Fatalf("Expected a close frame, got opcode %#x", h.opcode)
+	}
+	return binary.BigEndian.Uint16(payload)
+}
+
+func TestFrameHeader_Check(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+		ok    bool
+	}{
+		{"masked text", maskedFrame(opText, []byte("hi")), true},
+		{"unmasked client frame", []byte{0x81, 0x02, 'h', 'i'}, false},
+		{"reserved opcode", maskedFrame(0x3, nil), false},
+		{"fragmented ping", append([]byte{0x09}, maskedFrame(opPing, nil)[1:]...), false},
+		{"reserved bits", append([]byte{0xc1}, maskedFrame(opText, nil)[1:]...), false},
+		{"non-minimal length", []byte{0x82, 0xfe, 0x00, 0x05, 0, 0, 0, 0}, false},
+	}
+	for _, tt := range tests {
+		fragmented := false
+		h, err := readFrameHeader(bytes.NewReader(tt.frame))
+		if err == nil {
+			err = h.check(true, 0, &fragmented)
+		}
+		var v *wsViolation
+		if tt.ok && err != nil {
+			t.Errorf("%s: unexpected error %v", tt.name, err)
+		}
+		if !tt.ok && !errors.As(err, &v) {
+			t.Errorf("%s: expected a protocol violation, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestCheckClosePayload(t *testing.T) {
+	if err := checkClosePayload([]byte{0x03, 0xe8, 'b', 'y', 'e'}); err != nil {
+		t.Errorf("Expected 1000 with a reason to pass, got %v", err)
+	}
+	if err := checkClosePayload([]byte{0x03, 0xed}); err == nil {
+		t.Errorf("Expected 1005 to be rejected on the wire")
+	}
+	if err := checkClosePayload([]byte{0x03, 0xe8, 0xff}); err == nil {
+		t.Errorf("Expected invalid UTF-8 reason to be rejected")
+	}
+}
+
+func TestRelayStrict_CloseHandshake(t *testing.T) {
+	clientConn, clientPeer := net.Pipe()
+	backendConn, backendPeer := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		relayStrict(context.Background(), &wsLeg{name: "client", conn: clientConn, client: true},
+			&wsLeg{name: "backend", conn: backendConn}, clientConn, backendConn, 0)
+		close(done)
+	}()
+
+	text := maskedFrame(opText, []byte("hello"))
+	go clientPeer.Write(text)
+	got := make([]byte, len(text))
+	backendPeer.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadFull(backendPeer, got); err != nil || !bytes.Equal(got, text) {
+		t.Fatalf("Expected frame relayed unchanged, got %x (%v)", got, err)
+	}
+
+	go clientPeer.Write(maskedFrame(opClose, []byte{0x03, 0xe8}))
+	if code := readCloseCode(t, backendPeer); code != 1000 {
+		t.Errorf("Expected close 1000 at backend, got %d", code)
+	}
+	go backendPeer.Write([]byte{0x88, 0x02, 0x03, 0xe8})
+	if code := readCloseCode(t, clientPeer); code != 1000 {
+		t.Errorf("Expected close 1000 at client, got %d", code)
+	}
+
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Errorf("Expected relay to finish after the close handshake")
+	}
+}
+
+func TestRelayStrict_Violation(t *testing.T) {
+	clientConn, clientPeer := net.Pipe()
+	backendConn, backendPeer := net.Pipe()
+	go relayStrict(context.Background(), &wsLeg{name: "client", conn: clientConn, client: true},
+		&wsLeg{name: "backend", conn: backendConn}, clientConn, backendConn, 0)
+
+	// Unmasked frame from the client
+	go clientPeer.Write([]byte{0x81, 0x02, 'h', 'i'})
+
+	codes := make(chan uint16, 1)
+	go func() { codes <- readCloseCode(t, clientPeer) }()
+	if code := readCloseCode(t, backendPeer); code != closeProtocolError {
+		t.Errorf("Expected close 1002 at backend, got %d", code)
+	}
+	if code := <-codes; code != closeProtocolError {
+		t.Errorf("Expected close 1002 at client, got %d", code)
+	}
+}
+
+func TestRelayFrames_SlowSenderDoesNotHoldLeg(t *testing.T) {
+	backendConn, backendPeer := net.Pipe()
+	backend := &wsLeg{name: "backend", conn: backendConn}
+	src, srcPeer := net.Pipe()
+	defer srcPeer.Close()
+	go relayFrames(context.Background(), backend, &wsLeg{name: "client", client: true}, src, 0)
+
+	// Half a frame, and then nothing
+	frame := maskedFrame(opText, []byte("hello"))
+	go srcPeer.Write(frame[:len(frame)-2])
+
+	done := make(chan struct{})
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		backend.sendClose(closeGoingAway)
+		close(done)
+	}()
+	if code := readCloseCode(t, backendPeer); code != closeGoingAway {
+		t.Errorf("Expected the close frame to get through, got %d", code)
+	}
+	<-done
+}
+
+func TestRelayFrames_LargeFrame(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789abcdef"), 10000) // several chunks
+	frame := []byte{0x82, 127}
+	frame = binary.BigEndian.AppendUint64(frame, uint64(len(payload)))
+	frame = append(frame, payload...)
+
+	out := &recordConn{}
+	if err := relayFrames(context.Background(), &wsLeg{name: "client", conn: out, client: true}, &wsLeg{name: "backend"}, bytes.NewReader(frame), 0); err != io.EOF {
+		t.Fatalf("Expected the relay to end at EOF, got %v", err)
+	}
+	if !bytes.Equal(out.buf.Bytes(), frame) {
+		t.Errorf("Expected the frame relayed unchanged, got %d of %d bytes", out.buf.Len(), len(frame))
+	}
+}
+
+// recordConn keeps everything written to it.
+type recordConn struct {
+	net.Conn
+	buf bytes.Buffer
+}
+
+func (c *recordConn) Write(p []byte) (int, error) { return c.buf.Write(p) }
+
+func TestWsLeg_PadWithPongs(t *testing.T) {
+	obfs, err := proxy.NewObfuscator(config.FromMap(map[string]string{"PAD_BUCKETS": "64,512,4K"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, size := range []int{10, 60, 64, 100, 380, 4000, 5000} {
+		conn := &recordConn{}
+		leg := &wsLeg{name: "backend", conn: conn, obfs: obfs}
+		if err := leg.padLocked(size); err != nil {
+			t.Fatal(err)
+		}
+		total := size + conn.buf.Len()
+		if total != 64 && total != 512 && total != 4096 && total != 8192 {
+			t.Errorf("%d-byte frame: expected padding to a bucket, got %d bytes", size, total)
+		}
+		for conn.buf.Len() > 0 {
+			h, err := readFrameHeader(&conn.buf)
+			if err != nil {
+				t.Fatalf("%d-byte frame: unreadable padding: %v", size, err)
+			}
+			if h.opcode != opPong || !h.masked || h.length > 125 {
+				t.Errorf("%d-byte frame: expected masked pongs, got opcode %d length %d", size, h.opcode, h.length)
+			}
+			conn.buf.Next(int(h.length))
+		}
+	}
+}
+
+func TestProxy_PaddedRelay(t *testing.T) {
+	backend := fakebackend.NewWebSocket(t)
+	p := newTestProxy(t, backend.URL, map[string]string{"WS_STRICT_RFC6455": "true"})
+	obfs, err := proxy.NewObfuscator(config.FromMap(map[string]string{"PAD_BUCKETS": "1K"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Obfuscator = obfs
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	// The backend ignores the padding pongs and still echoes
+	conn := openRelay(t, server)
+	conn.Close()
+	if pad := backend.Last().Header.Get("X-Pad"); pad == "" {
+		t.Errorf("Expected the upgrade request to be padded")
+	}
+}
@@ -0,0 +1,85 @@
+package wsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"google-redirector/config"
+)
+
+// handshakeHeaders are set by the redirector itself on the backend upgrade
+// request and never copied from the client.
+var handshakeHeaders = map[string]bool{
+	"Connection":               true,
+	"Upgrade":                  true,
+	"Host":                     true,
+	"Sec-Websocket-Key":        true,
+	"Sec-Websocket-Version":    true,
+	"Sec-Websocket-Protocol":   true,
+	"Sec-Websocket-Extensions": true,
+	"Sec-Websocket-Accept":     true,
+}
+
+// hopByHopHeaders only apply to the connection they arrived on (RFC 9110
+// section 7.6.1).
+var hopByHopHeaders = map[string]bool{
+	"Keep-Alive":          true,
+	"Proxy-Connection":    true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+}
+
+// headerForwarding decides which client headers accompany the upgrade to
+// the backend. "minimal" is the historical set (Authorization only, besides
+// the handshake itself); "all" copies everything the client sent, so
+// cookies, User-Agent, Origin and custom C2 headers reach the team server
+// as they would on a plain HTTP request. Either way, headers on the strip
+// list are dropped.
+type headerForwarding struct {
+	all   bool
+	strip map[string]bool
+}
+
+func headerForwardingFromConfig(cfg *config.Config) (*headerForwarding, error) {
+	f := &headerForwarding{strip: make(map[string]bool)}
+	switch mode := cfg.String("WS_FORWARD_HEADERS", "minimal"); mode {
+	case "minimal":
+	case "all":
+		f.all = true
+	default:
+		return nil, fmt.Errorf("invalid WS_FORWARD_HEADERS %q (expected minimal or all)", mode)
+	}
+	for _, name := range cfg.List("WS_STRIP_HEADERS", "") {
+		f.strip[textproto.CanonicalMIMEHeaderKey(name)] = true
+	}
+	return f, nil
+}
+
+// copy adds the forwarded headers from src to dst.
+func (f *headerForwarding) copy(dst, src http.Header) {
+	if !f.all {
+		if auth := src.Get("Authorization"); auth != "" && !f.strip["Authorization"] {
+			dst.Set("Authorization", auth)
+		}
+		return
+	}
+
+	// Headers named in Connection are hop-by-hop as well
+	connection := make(map[string]bool)
+	for _, v := range src.Values("Connection") {
+		for _, name := range strings.Split(v, ",") {
+			connection[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(name))] = true
+		}
+	}
+	for name, values := range src {
+		if handshakeHeaders[name] || hopByHopHeaders[name] || connection[name] || f.strip[name] {
+			continue
+		}
+		dst[name] = append([]string(nil), values...)
+	}
+}
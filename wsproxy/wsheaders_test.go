@@ -0,0 +1,96 @@
+package wsproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google-redirector/config"
+	"google-redirector/internal/fakebackend"
+)
+
+func TestHeaderForwarding_Copy(t *testing.T) {
+	src := http.Header{
+		"Authorization":     {"Bearer x"},
+		"Cookie":            {"session=1"},
+		"User-Agent":        {"implant/1.0"},
+		"X-Forwarded-For":   {"203.0.113.7"},
+		"Connection":        {"Upgrade, X-Hop"},
+		"X-Hop":             {"1"},
+		"Keep-Alive":        {"timeout=5"},
+		"Sec-Websocket-Key": {"dGhlIHNhbXBsZSBub25jZQ=="},
+	}
+
+	f, err := headerForwardingFromConfig(config.FromMap(map[string]string{"WS_STRIP_HEADERS": "x-forwarded-for"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst := http.Header{}
+	f.copy(dst, src)
+	if len(dst) != 1 || dst.Get("Authorization") != "Bearer x" {
+		t.Errorf("Expected only Authorization in minimal mode, got %v", dst)
+	}
+
+	f, err = headerForwardingFromConfig(config.FromMap(map[string]string{
+		"WS_FORWARD_HEADERS": "all",
+		"WS_STRIP_HEADERS":   "x-forwarded-for",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	dst = http.Header{}
+	f.copy(dst, src)
+	for _, name := range []string{"Authorization", "Cookie", "User-Agent"} {
+		if dst.Get(name) != src.Get(name) {
+			t.Errorf("Expected %s to be forwarded, got %v", name, dst)
+		}
+	}
+	for _, name := range []string{"X-Forwarded-For", "Connection", "X-Hop", "Keep-Alive", "Sec-Websocket-Key"} {
+		if _, ok := dst[name]; ok {
+			t.Errorf("Expected %s not to be forwarded", name)
+		}
+	}
+}
+
+func TestHeaderForwarding_InvalidMode(t *testing.T) {
+	if _, err := New(config.FromMap(map[string]string{"WS_FORWARD_HEADERS": "some"})); err == nil {
+		t.Errorf("Expected invalid WS_FORWARD_HEADERS to be rejected")
+	}
+}
+
+func TestProxy_ForwardsAllHeaders(t *testing.T) {
+	backend := fakebackend.NewWebSocket(t)
+	p := newTestProxy(t, backend.URL, map[string]string{
+		"WS_FORWARD_HEADERS": "all",
+		"WS_STRIP_HEADERS":   "X-Redirector-Secret",
+	})
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	conn, _, resp, err := fakebackend.DialWebSocket(server.Listener.Addr().String(), "/ws", http.Header{
+		"Cookie":              {"session=abc"},
+		"User-Agent":          {"implant/1.0"},
+		"Origin":              {"https://example.com"},
+		"X-Task-Id":           {"42"},
+		"X-Redirector-Secret": {"s3cret"},
+	})
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %v (%v)", resp, err)
+	}
+	conn.Close()
+
+	got := backend.Last().Header
+	for name, want := range map[string]string{
+		"Cookie":     "session=abc",
+		"User-Agent": "implant/1.0",
+		"Origin":     "https://example.com",
+		"X-Task-Id":  "42",
+	} {
+		if got.Get(name) != want {
+			t.Errorf("Expected %s %q at the backend, got %q", name, want, got.Get(name))
+		}
+	}
+	if got.Get("X-Redirector-Secret") != "" {
+		t.Errorf("Expected stripped header not to reach the backend")
+	}
+}
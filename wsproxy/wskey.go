@@ -0,0 +1,45 @@
+package wsproxy
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// clientKey returns the client's Sec-WebSocket-Key. Header-rewriting CDNs
+// sometimes repeat the header (or fold the copies into one, comma
+// separated); identical copies are collapsed, while conflicting or
+// malformed keys are refused since no single Accept value could satisfy
+// the client.
+func clientKey(h http.Header) (string, error) {
+	var key string
+	for _, v := range h.Values("Sec-WebSocket-Key") {
+		for _, k := range strings.Split(v, ",") {
+			k = strings.TrimSpace(k)
+			if k == "" {
+				continue
+			}
+			if key != "" && k != key {
+				return "", fmt.Errorf("conflicting Sec-WebSocket-Key values")
+			}
+			key = k
+		}
+	}
+	if key == "" {
+		return "", fmt.Errorf("missing Sec-WebSocket-Key")
+	}
+	if raw, err := base64.StdEncoding.DecodeString(key); err != nil || len(raw) != 16 {
+		return "", fmt.Errorf("malformed Sec-WebSocket-Key %q", key)
+	}
+	return key, nil
+}
+
+// newWebSocketKey returns a fresh random key for the redirector's own
+// handshake with the backend.
+func newWebSocketKey() string {
+	var raw [16]byte
+	rand.Read(raw[:])
+	return base64.StdEncoding.EncodeToString(raw[:])
+}
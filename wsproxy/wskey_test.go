@@ -0,0 +1,74 @@
+package wsproxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google-redirector/internal/fakebackend"
+)
+
+func TestClientKey(t *testing.T) {
+	const key = "dGhlIHNhbXBsZSBub25jZQ=="
+	tests := []struct {
+		values []string
+		ok     bool
+	}{
+		{[]string{key}, true},
+		{[]string{key, key}, true},
+		{[]string{key + ", " + key}, true},
+		{[]string{key, "AQIDBAUGBwgJCgsMDQ4PEC=="}, false},
+		{[]string{"not-base64"}, false},
+		{[]string{"c2hvcnQ="}, false},
+		{nil, false},
+	}
+	for _, tt := range tests {
+		h := http.Header{"Sec-Websocket-Key": tt.values}
+		got, err := clientKey(h)
+		if tt.ok && (err != nil || got != key) {
+			t.Errorf("%q: expected %s, got %q (%v)", tt.values, key, got, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%q: expected key to be refused", tt.values)
+		}
+	}
+}
+
+func TestProxy_Rehandshake(t *testing.T) {
+	backend := fakebackend.NewWebSocket(t)
+	const clientKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+	for _, rehandshake := range []string{"false", "true"} {
+		p := newTestProxy(t, backend.URL, map[string]string{"WS_REHANDSHAKE": rehandshake})
+		server := httptest.NewServer(p)
+
+		// A CDN that repeats the key must not break the handshake
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		fmt.Fprintf(conn, "GET /ws HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: %s\r\nSec-WebSocket-Key: %s\r\n\r\n",
+			server.Listener.Addr(), clientKey, clientKey)
+		resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+		if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("Expected 101, got %v (%v)", resp, err)
+		}
+		conn.Close()
+		server.Close()
+
+		if got := resp.Header.Get("Sec-WebSocket-Accept"); got != websocketAccept(clientKey) {
+			t.Errorf("rehandshake=%s: expected Accept for the client's key, got %s", rehandshake, got)
+		}
+		sent := backend.Last().Header.Values("Sec-WebSocket-Key")
+		if len(sent) != 1 {
+			t.Fatalf("rehandshake=%s: expected exactly one key toward the backend, got %q", rehandshake, sent)
+		}
+		if replayed := sent[0] == clientKey; replayed != (rehandshake == "false") {
+			t.Errorf("rehandshake=%s: unexpected backend key %s", rehandshake, sent[0])
+		}
+	}
+}
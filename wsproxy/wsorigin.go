@@ -0,0 +1,83 @@
+package wsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"google-redirector/config"
+)
+
+// originPolicy checks the Origin header of upgrade requests. Browsers always
+// send Origin on WebSocket handshakes and implants usually don't, so
+// requiring its absence (or an expected value) stops a malicious page from
+// probing the redirector through a visitor's browser.
+type originPolicy struct {
+	mode    string // "allow" or "absent"
+	allow   map[string]bool
+	pattern *regexp.Regexp
+}
+
+// originPolicyFromConfig returns nil unless WS_ORIGIN_POLICY is "allow" or
+// "absent".
+func originPolicyFromConfig(cfg *config.Config) (*originPolicy, error) {
+	p := &originPolicy{mode: cfg.String("WS_ORIGIN_POLICY", "any")}
+	switch p.mode {
+	case "any":
+		return nil, nil
+	case "allow", "absent":
+	default:
+		return nil, fmt.Errorf("invalid WS_ORIGIN_POLICY %q (expected any, allow or absent)", p.mode)
+	}
+
+	if allow := cfg.List("WS_ORIGIN_ALLOW", ""); len(allow) > 0 {
+		p.allow = make(map[string]bool)
+		for _, origin := range allow {
+			p.allow[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+		}
+	}
+	if expr := cfg.String("WS_ORIGIN_PATTERN", ""); expr != "" {
+		// Anchored, so "https://example\.com" can't be satisfied by
+		// https://example.com.attacker.net
+		re, err := regexp.Compile("^(?:" + expr + ")$")
+		if err != nil {
+			return nil, fmt.Errorf("invalid WS_ORIGIN_PATTERN: %v", err)
+		}
+		p.pattern = re
+	}
+	if p.mode == "allow" && p.allow == nil && p.pattern == nil {
+		return nil, fmt.Errorf("WS_ORIGIN_POLICY=allow needs WS_ORIGIN_ALLOW or WS_ORIGIN_PATTERN")
+	}
+	return p, nil
+}
+
+func (p *originPolicy) String() string {
+	if p.mode == "absent" {
+		return "origin must be absent"
+	}
+	s := fmt.Sprintf("origin: %d allowed", len(p.allow))
+	if p.pattern != nil {
+		s += fmt.Sprintf(", pattern %s", p.pattern)
+	}
+	return s
+}
+
+// check returns an error describing why the request's Origin is refused.
+func (p *originPolicy) check(h http.Header) error {
+	origins := h.Values("Origin")
+	if p.mode == "absent" {
+		if len(origins) > 0 {
+			return fmt.Errorf("unexpected Origin %q", origins[0])
+		}
+		return nil
+	}
+	if len(origins) != 1 {
+		return fmt.Errorf("expected one Origin header, got %d", len(origins))
+	}
+	origin := strings.ToLower(strings.TrimSuffix(origins[0], "/"))
+	if p.allow[origin] || p.pattern != nil && p.pattern.MatchString(origin) {
+		return nil
+	}
+	return fmt.Errorf("Origin %q not allowed", origins[0])
+}
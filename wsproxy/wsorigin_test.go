@@ -0,0 +1,76 @@
+package wsproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google-redirector/config"
+	"google-redirector/internal/fakebackend"
+)
+
+func TestOriginPolicy_Check(t *testing.T) {
+	tests := []struct {
+		settings map[string]string
+		origins  []string
+		ok       bool
+	}{
+		{map[string]string{"WS_ORIGIN_POLICY": "absent"}, nil, true},
+		{map[string]string{"WS_ORIGIN_POLICY": "absent"}, []string{"https://evil.test"}, false},
+		{map[string]string{"WS_ORIGIN_POLICY": "allow", "WS_ORIGIN_ALLOW": "https://app.example.com"}, []string{"HTTPS://App.Example.com"}, true},
+		{map[string]string{"WS_ORIGIN_POLICY": "allow", "WS_ORIGIN_ALLOW": "https://app.example.com"}, []string{"https://evil.test"}, false},
+		{map[string]string{"WS_ORIGIN_POLICY": "allow", "WS_ORIGIN_ALLOW": "https://app.example.com"}, nil, false},
+		{map[string]string{"WS_ORIGIN_POLICY": "allow", "WS_ORIGIN_PATTERN": `https://[a-z]+\.example\.com`}, []string{"https://cdn.example.com"}, true},
+		{map[string]string{"WS_ORIGIN_POLICY": "allow", "WS_ORIGIN_PATTERN": `https://[a-z]+\.example\.com`}, []string{"https://cdn.example.com.evil.test"}, false},
+	}
+	for _, tt := range tests {
+		p, err := originPolicyFromConfig(config.FromMap(tt.settings))
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = p.check(http.Header{"Origin": tt.origins})
+		if tt.ok && err != nil {
+			t.Errorf("%v %q: expected origin to be allowed, got %v", tt.settings, tt.origins, err)
+		}
+		if !tt.ok && err == nil {
+			t.Errorf("%v %q: expected origin to be refused", tt.settings, tt.origins)
+		}
+	}
+}
+
+func TestOriginPolicy_Config(t *testing.T) {
+	if p, err := originPolicyFromConfig(config.FromMap(nil)); p != nil || err != nil {
+		t.Errorf("Expected no origin policy by default, got %v (%v)", p, err)
+	}
+	for _, settings := range []map[string]string{
+		{"WS_ORIGIN_POLICY": "strict"},
+		{"WS_ORIGIN_POLICY": "allow"},
+		{"WS_ORIGIN_POLICY": "allow", "WS_ORIGIN_PATTERN": "("},
+	} {
+		if _, err := originPolicyFromConfig(config.FromMap(settings)); err == nil {
+			t.Errorf("%v: expected configuration error", settings)
+		}
+	}
+}
+
+func TestProxy_OriginMismatchGetsDecoy(t *testing.T) {
+	backend := fakebackend.NewWebSocket(t)
+	p := newTestProxy(t, backend.URL, map[string]string{"WS_ORIGIN_POLICY": "absent"})
+	server := httptest.NewServer(p)
+	defer server.Close()
+
+	_, _, resp, err := fakebackend.DialWebSocket(server.Listener.Addr().String(), "/ws",
+		http.Header{"Origin": {"https://evil.test"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected cross-site upgrade to get the decoy, got %d", resp.StatusCode)
+	}
+	if n := len(backend.Requests()); n != 0 {
+		t.Errorf("Expected refused upgrade never to reach the backend, saw %d", n)
+	}
+
+	conn := openRelay(t, server)
+	conn.Close()
+}
@@ -0,0 +1,111 @@
+package wsproxy
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"google-redirector/config"
+)
+
+// subprotocolPolicy controls how Sec-WebSocket-Protocol is carried between
+// client and backend. Values are compared as exact tokens rather than
+// substrings, and may be restricted to an allowlist or renamed on the way
+// through (client name on one side, backend name on the other).
+type subprotocolPolicy struct {
+	mode      string // "passthrough", "strip" or "require"
+	allow     map[string]bool
+	toBackend map[string]string
+	toClient  map[string]string
+}
+
+func subprotocolPolicyFromConfig(cfg *config.Config) (*subprotocolPolicy, error) {
+	p := &subprotocolPolicy{
+		mode:      cfg.String("WS_SUBPROTOCOL_MODE", "passthrough"),
+		toBackend: make(map[string]string),
+		toClient:  make(map[string]string),
+	}
+	switch p.mode {
+	case "passthrough", "strip", "require":
+	default:
+		return nil, fmt.Errorf("invalid WS_SUBPROTOCOL_MODE %q (expected passthrough, strip or require)", p.mode)
+	}
+
+	if allow := cfg.List("WS_SUBPROTOCOL_ALLOW", ""); len(allow) > 0 {
+		p.allow = make(map[string]bool)
+		for _, proto := range allow {
+			p.allow[proto] = true
+		}
+	}
+	for _, pair := range cfg.List("WS_SUBPROTOCOL_MAP", "") {
+		client, backend, ok := strings.Cut(pair, "=")
+		if !ok || client == "" || backend == "" {
+			return nil, fmt.Errorf("invalid WS_SUBPROTOCOL_MAP entry %q (expected client=backend)", pair)
+		}
+		p.toBackend[client] = backend
+		p.toClient[backend] = client
+	}
+	if p.mode == "require" && p.allow == nil {
+		return nil, fmt.Errorf("WS_SUBPROTOCOL_MODE=require needs WS_SUBPROTOCOL_ALLOW")
+	}
+	return p, nil
+}
+
+// subprotocols parses every Sec-WebSocket-Protocol header into tokens.
+func subprotocols(h http.Header) []string {
+	var protos []string
+	for _, v := range h.Values("Sec-WebSocket-Protocol") {
+		protos = append(protos, config.SplitList(v)...)
+	}
+	return protos
+}
+
+// offer turns the client's offered subprotocols into the list sent to the
+// backend. Allowlisting applies to client-side names, before mapping.
+func (p *subprotocolPolicy) offer(client []string) ([]string, error) {
+	if p.mode == "strip" {
+		return nil, nil
+	}
+	var backend []string
+	for _, proto := range client {
+		if p.allow != nil && !p.allow[proto] {
+			continue
+		}
+		if mapped, ok := p.toBackend[proto]; ok {
+			proto = mapped
+		}
+		backend = append(backend, proto)
+	}
+	if p.mode == "require" && len(backend) == 0 {
+		return nil, fmt.Errorf("no allowed subprotocol offered (client offered %q)", client)
+	}
+	return backend, nil
+}
+
+// accept checks the backend's selected subprotocol and returns the name to
+// confirm to the client, or "" to confirm none.
+func (p *subprotocolPolicy) accept(client []string, selected string) (string, error) {
+	if p.mode == "strip" {
+		return "", nil
+	}
+	if selected == "" {
+		if p.mode == "require" {
+			return "", fmt.Errorf("backend did not select a subprotocol")
+		}
+		return "", nil
+	}
+
+	name := selected
+	if mapped, ok := p.toClient[selected]; ok {
+		name = mapped
+	}
+	if p.allow != nil && !p.allow[name] {
+		return "", fmt.Errorf("backend selected disallowed subprotocol %q", selected)
+	}
+	for _, proto := range client {
+		if proto == name {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("backend selected %q, which the client did not offer", selected)
+}
@@ -0,0 +1,89 @@
+package wsproxy
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"google-redirector/config"
+)
+
+func TestSubprotocols_ExactTokens(t *testing.T) {
+	h := http.Header{}
+	h.Add("Sec-WebSocket-Protocol", "chat, superchat")
+	h.Add("Sec-WebSocket-Protocol", "mqtt")
+
+	got := subprotocols(h)
+	if want := []string{"chat", "superchat", "mqtt"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	// The old substring match accepted "chat" when only "superchat" was offered
+	p := &subprotocolPolicy{mode: "passthrough"}
+	if _, err := p.accept([]string{"superchat"}, "chat"); err == nil {
+		t.Errorf("Expected backend choice that the client never offered to be rejected")
+	}
+}
+
+func TestSubprotocolPolicy_AllowAndMap(t *testing.T) {
+	p := &subprotocolPolicy{
+		mode:      "require",
+		allow:     map[string]bool{"chat": true, "mqtt": true},
+		toBackend: map[string]string{"chat": "c2.v2"},
+		toClient:  map[string]string{"c2.v2": "chat"},
+	}
+	client := []string{"xmpp", "chat", "mqtt"}
+
+	offered, err := p.offer(client)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if want := []string{"c2.v2", "mqtt"}; !reflect.DeepEqual(offered, want) {
+		t.Errorf("Expected backend offer %q, got %q", want, offered)
+	}
+
+	if name, err := p.accept(client, "c2.v2"); err != nil || name != "chat" {
+		t.Errorf("Expected mapped name chat, got %q (%v)", name, err)
+	}
+	if _, err := p.accept(client, "xmpp"); err == nil {
+		t.Errorf("Expected disallowed backend choice to be rejected")
+	}
+	if _, err := p.accept(client, ""); err == nil {
+		t.Errorf("Expected missing subprotocol to be rejected in require mode")
+	}
+	if _, err := p.offer([]string{"xmpp"}); err == nil {
+		t.Errorf("Expected offer without an allowed subprotocol to be rejected")
+	}
+}
+
+func TestSubprotocolPolicy_Strip(t *testing.T) {
+	p := &subprotocolPolicy{mode: "strip"}
+	if offered, _ := p.offer([]string{"chat"}); len(offered) != 0 {
+		t.Errorf("Expected nothing forwarded, got %q", offered)
+	}
+	if name, err := p.accept([]string{"chat"}, "chat"); err != nil || name != "" {
+		t.Errorf("Expected no subprotocol confirmed, got %q (%v)", name, err)
+	}
+}
+
+func TestSubprotocolPolicyFromConfig(t *testing.T) {
+	t.Setenv("WS_SUBPROTOCOL_MODE", "require")
+	if _, err := subprotocolPolicyFromConfig(config.FromEnv()); err == nil {
+		t.Errorf("Expected require mode without an allowlist to fail")
+	}
+
+	t.Setenv("WS_SUBPROTOCOL_ALLOW", "chat")
+	t.Setenv("WS_SUBPROTOCOL_MAP", "chat=c2.v2")
+	p, err := subprotocolPolicyFromConfig(config.FromEnv())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if p.toBackend["chat"] != "c2.v2" || p.toClient["c2.v2"] != "chat" {
+		t.Errorf("Expected chat to map to c2.v2, got %v", p.toBackend)
+	}
+
+	t.Setenv("WS_SUBPROTOCOL_MAP", "chat")
+	if _, err := subprotocolPolicyFromConfig(config.FromEnv()); err == nil {
+		t.Errorf("Expected malformed map entry to fail")
+	}
+}
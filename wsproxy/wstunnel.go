@@ -0,0 +1,242 @@
+package wsproxy
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"google-redirector/clientip"
+	"google-redirector/config"
+)
+
+// wsTunnel terminates WebSocket upgrades on the redirector itself and
+// unwraps them into raw TCP connections to named targets, in the style of
+// wstunnel: each binary (or text) message from the client is written to the
+// target as-is and whatever the target sends comes back as binary frames.
+// Only targets listed in WS_TUNNEL_TARGETS are reachable, and tunnels go
+// through the same verification header and SSRF guard as everything else.
+type wsTunnel struct {
+	prefix  string
+	targets map[string]string // name -> host:port
+}
+
+// wsTunnelFromConfig returns nil unless WS_TUNNEL_TARGETS lists at least one
+// name=host:port pair.
+func wsTunnelFromConfig(cfg *config.Config) (*wsTunnel, error) {
+	pairs := cfg.List("WS_TUNNEL_TARGETS", "")
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	t := &wsTunnel{
+		prefix:  "/" + strings.Trim(cfg.String("WS_TUNNEL_PATH", "/tunnel/"), "/") + "/",
+		targets: make(map[string]string),
+	}
+	for _, pair := range pairs {
+		name, addr, ok := strings.Cut(pair, "=")
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid WS_TUNNEL_TARGETS entry %q (expected name=host:port)", pair)
+		}
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return nil, fmt.Errorf("invalid WS_TUNNEL_TARGETS address %q: %v", addr, err)
+		}
+		t.targets[name] = addr
+	}
+	return t, nil
+}
+
+// match returns the target for a tunnel path such as /tunnel/<name>.
+func (t *wsTunnel) match(r *http.Request) (string, bool) {
+	name, ok := strings.CutPrefix(r.URL.Path, t.prefix)
+	if !ok {
+		return "", false
+	}
+	addr, ok := t.targets[name]
+	return addr, ok
+}
+
+// websocketAccept computes Sec-WebSocket-Accept for a client key.
+func websocketAccept(key string) string {
+	h := sha1.Sum([]byte(key + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"))
+	return base64.StdEncoding.EncodeToString(h[:])
+}
+
+func (p *Proxy) serveTunnel(w http.ResponseWriter, r *http.Request, addr string) {
+	key, err := clientKey(r.Header)
+	if err != nil || r.Header.Get("Sec-WebSocket-Version") != "13" {
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return
+	}
+
+	if err := p.Plugins.TunnelOpen(r, addr); err != nil {
+		log.Printf("Rejected tunnel from %s to %s: %v", clientip.From(r), addr, err)
+		p.Plugins.Block(r, err.Error())
+		p.Decoy.Serve(w, r)
+		return
+	}
+
+	target, err := p.Dialer.DialContext(r.Context(), "tcp", addr)
+	if err != nil {
+		log.Printf("Tunnel dial to %s failed: %v", addr, err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+	defer target.Close()
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		log.Printf("Hijack failed: %v", err)
+		return
+	}
+	defer conn.Close()
+	conn = withBuffered(conn, buf.Reader)
+
+	resp := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(resp)); err != nil {
+		return
+	}
+	log.Printf("Tunnel opened: %s -> %s", clientip.From(r), addr)
+
+	client := &wsLeg{name: "client", conn: conn, client: true}
+	ctx, cancel := p.relayContext(r)
+	defer cancel(nil)
+	defer closeOnDone(ctx, closeGoingAway, []*wsLeg{client}, conn, target)()
+	var clientSrc, targetSrc io.Reader = conn, target
+	if p.Throttle != nil {
+		lim := p.Throttle.Limiter(ctx, clientip.From(r))
+		defer lim.Release()
+		clientSrc, targetSrc = lim.Reader(conn), lim.Reader(target)
+	}
+	idle := p.watchIdle(ctx, cancel)
+	clientSrc, targetSrc = idle.reader(clientSrc), idle.reader(targetSrc)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	var down int64
+	go func() {
+		defer wg.Done()
+		down = tunnelToClient(client, targetSrc)
+		// Target hung up: close the tunnel, giving the client a moment to answer
+		client.sendClose(closeNormal)
+		conn.SetReadDeadline(time.Now().Add(closeHandshakeWindow))
+	}()
+
+	up, err := tunnelFromClient(client, clientSrc, target)
+	var v *wsViolation
+	if errors.As(err, &v) {
+		log.Printf("Tunnel protocol violation by client: %s", v.msg)
+		client.sendClose(v.code)
+	}
+	target.Close()
+	wg.Wait()
+	log.Printf("Tunnel closed: %s -> %s (%d bytes up, %d bytes down)", clientip.From(r), addr, up, down)
+}
+
+// tunnelFromClient writes the payload of every data frame from the client to
+// the target, answering pings, until the client closes.
+func tunnelFromClient(client *wsLeg, src io.Reader, target net.Conn) (int64, error) {
+	var total int64
+	fragmented := false
+	for {
+		h, err := readFrameHeader(src)
+		if err != nil {
+			return total, err
+		}
+		if err := h.check(true, 0, &fragmented); err != nil {
+			return total, err
+		}
+		payload := &unmaskReader{r: io.LimitReader(src, int64(h.length)), mask: h.mask}
+
+		switch h.opcode {
+		case opPing:
+			data, err := io.ReadAll(payload)
+			if err != nil {
+				return total, err
+			}
+			client.mu.Lock()
+			err = client.writeFrameLocked(opPong, data)
+			client.mu.Unlock()
+			if err != nil {
+				return total, err
+			}
+		case opClose:
+			data, err := io.ReadAll(payload)
+			if err != nil {
+				return total, err
+			}
+			if err := checkClosePayload(data); err != nil {
+				return total, err
+			}
+			client.mu.Lock()
+			if !client.closed {
+				client.closed = true
+				client.writeFrameLocked(opClose, data)
+			}
+			client.mu.Unlock()
+			return total, nil
+		case opPong:
+			io.Copy(io.Discard, payload)
+		default:
+			n, err := io.Copy(target, payload)
+			total += n
+			if err != nil {
+				return total, err
+			}
+		}
+	}
+}
+
+// tunnelToClient sends everything read from the target to the client as
+// binary frames, until either side closes.
+func tunnelToClient(client *wsLeg, src io.Reader) int64 {
+	var total int64
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := src.Read(buf)
+		if n > 0 {
+			client.mu.Lock()
+			werr := io.ErrClosedPipe
+			if !client.closed {
+				werr = client.writeFrameLocked(opBinary, buf[:n])
+			}
+			client.mu.Unlock()
+			if werr != nil {
+				return total
+			}
+			total += int64(n)
+		}
+		if err != nil {
+			return total
+		}
+	}
+}
+
+type unmaskReader struct {
+	r    io.Reader
+	mask [4]byte
+	pos  int
+}
+
+func (u *unmaskReader) Read(p []byte) (int, error) {
+	n, err := u.r.Read(p)
+	for i := 0; i < n; i++ {
+		p[i] ^= u.mask[u.pos%4]
+		u.pos++
+	}
+	return n, err
+}
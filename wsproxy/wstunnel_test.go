@@ -0,0 +1,95 @@
+package wsproxy
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"google-redirector/config"
+	"google-redirector/proxy"
+)
+
+func TestWebsocketAccept(t *testing.T) {
+	// Example from RFC 6455 section 1.3
+	if got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ=="); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Errorf("Expected RFC 6455 accept value, got %s", got)
+	}
+}
+
+func TestWSTunnelFromConfig(t *testing.T) {
+	t.Setenv("WS_TUNNEL_TARGETS", "ssh=10.0.0.7:22")
+	tunnel, err := wsTunnelFromConfig(config.FromEnv())
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if addr, ok := tunnel.match(httptest.NewRequest("GET", "/tunnel/ssh", nil)); !ok || addr != "10.0.0.7:22" {
+		t.Errorf("Expected /tunnel/ssh to map to 10.0.0.7:22, got %q", addr)
+	}
+	if _, ok := tunnel.match(httptest.NewRequest("GET", "/tunnel/rdp", nil)); ok {
+		t.Errorf("Expected unlisted target to be unavailable")
+	}
+
+	t.Setenv("WS_TUNNEL_TARGETS", "ssh=10.0.0.7")
+	if _, err := wsTunnelFromConfig(config.FromEnv()); err == nil {
+		t.Errorf("Expected target without a port to fail")
+	}
+}
+
+func TestWSTunnel_EndToEnd(t *testing.T) {
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		for {
+			c, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() { io.Copy(c, c); c.Close() }()
+		}
+	}()
+
+	ws := &Proxy{
+		Dialer: proxy.NewDialer(time.Second, nil),
+		tunnel: &wsTunnel{prefix: "/tunnel/", targets: map[string]string{"echo": echo.Addr().String()}},
+	}
+	server := httptest.NewServer(ws)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	io.WriteString(conn, "GET /tunnel/echo HTTP/1.1\r\nHost: x\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Expected 101, got %v (%v)", resp, err)
+	}
+
+	conn.Write(maskedFrame(opBinary, []byte("ping over tcp")))
+	h, err := readFrameHeader(br)
+	if err != nil || h.opcode != opBinary || h.masked {
+		t.Fatalf("Expected unmasked binary frame, got %+v (%v)", h, err)
+	}
+	payload := make([]byte, h.length)
+	io.ReadFull(br, payload)
+	if string(payload) != "ping over tcp" {
+		t.Errorf("Expected echoed payload, got %q", payload)
+	}
+
+	conn.Write(maskedFrame(opClose, []byte{0x03, 0xe8}))
+	if h, err := readFrameHeader(br); err != nil || h.opcode != opClose {
+		t.Errorf("Expected close frame in reply, got %+v (%v)", h, err)
+	}
+}